@@ -6,20 +6,25 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"plugin"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 
 	_ "github.com/BelWue/flowpipeline/segments/alert/http"
 
@@ -80,6 +85,13 @@ import (
 
 var Version string
 
+// Exit codes, a clean shutdown after receiving SIGINT or SIGTERM exits with 0.
+const (
+	exitConfigError     = 1 // the config or a plugin could not be loaded, or -check found problems
+	exitFlowsLost       = 3 // the pipelines drained, but output segments failed to write some flows
+	exitShutdownTimeout = 5 // the pipelines did not drain in time or a second signal was received, flows still in them are lost
+)
+
 type flagArray []string
 
 func (i *flagArray) String() string {
@@ -99,6 +111,13 @@ func main() {
 	version := flag.Bool("v", false, "print version")
 	prettyLogging := flag.Bool("j", false, "Json log")
 	configFile := flag.String("c", "config.yml", "location of the config file in yml format")
+	metricsAddr := flag.String("metrics", "", "address to serve metrics about the pipelines and each of their segments on, such as ':9100', default is disabled")
+	adminAddr := flag.String("admin", "", "address to serve the admin API on, such as ':9100', which also serves the metrics and the endpoints of segments such as prometheus, default is disabled")
+	instrument := flag.Bool("instrument", false, "measure every segment for the metrics served by -metrics or -admin and allow pausing pipelines using the admin API, which adds a little overhead to every flow")
+	check := flag.Bool("check", false, "check the config file by instantiating all segments without running them, exits non-zero on problems")
+	batchSize := flag.Int("batch", 0, "maximum number of flows segments supporting it exchange at once, such as 256, default is 0 which passes single flows")
+	batchCapacity := flag.Int("batchcapacity", 16, "number of batches the channels between segments hold if -batch is set")
+	shutdownTimeout := flag.Duration("shutdowntimeout", 15*time.Second, "how long to wait for the pipelines to drain and outputs to flush after SIGINT or SIGTERM before force quitting")
 	flag.Parse()
 
 	if *version {
@@ -120,7 +139,7 @@ func main() {
 			} else {
 				log.Error().Err(err).Msgf("Problem loading the specified plugin '%s'", path)
 			}
-			return
+			os.Exit(exitConfigError)
 		} else {
 			log.Info().Msgf("Loaded plugin: %s", path)
 		}
@@ -129,6 +148,19 @@ func main() {
 	config, err := os.ReadFile(*configFile)
 	if err != nil {
 		log.Error().Err(err).Msg("Reading config file: ")
+		os.Exit(exitConfigError)
+	}
+
+	if *check {
+		problems := pipeline.CheckConfig(config)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d problems found\n", *configFile, len(problems))
+			os.Exit(exitConfigError)
+		}
+		fmt.Printf("%s: ok\n", *configFile)
 		return
 	}
 
@@ -139,25 +171,143 @@ func main() {
 		pipelineCount = int(*concurrency)
 	}
 
-	segmentReprs := pipeline.SegmentReprsFromConfig(config)
-	for i := 0; i < pipelineCount; i++ {
-		segments := pipeline.SegmentsFromRepr(segmentReprs)
-		pipe := pipeline.New(segments...)
-		pipe.Start()
-		pipe.AutoDrain()
-		defer pipe.Close()
+	// segments register their endpoints on the admin server while being built
+	var adminAPI *pipeline.AdminAPI
+	if *adminAddr != "" {
+		adminAPI, err = serveAdmin(*adminAddr, os.Getenv("FLOWPIPELINE_ADMIN_TOKEN"))
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to serve the admin API on %s: ", *adminAddr)
+		}
+	}
+	if *adminAddr != "" && !*instrument {
+		log.Info().Msg("Pausing pipelines using the admin API requires -instrument")
+	}
+
+	segmentReprs, err := pipeline.SegmentReprsFromConfig(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration: ")
+	}
+	pipelines := make([]*pipeline.Pipeline, pipelineCount)
+	for i := range pipelines {
+		pipelines[i], err = pipeline.NewFromRepr(segmentReprs)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid configuration: ")
+		}
+		pipelines[i].Batch(*batchSize, *batchCapacity)
+		if *instrument {
+			pipelines[i].Instrument()
+		}
+		pipelines[i].Start()
+		pipelines[i].AutoDrain()
+	}
+	if adminAPI != nil {
+		adminAPI.SetPipelines(pipelines)
+	}
+
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
 	}
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGINT)
-	signal.Notify(sigs, os.Interrupt, os.Interrupt)
-	<-sigs
-	log.Info().Msg("Received exit signal")
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigs; sig == syscall.SIGHUP; sig = <-sigs {
+		log.Info().Msgf("Received SIGHUP, reloading %s", *configFile)
+		newPipelines, err := pipeline.ReloadFile(pipelines, *configFile)
+		if err != nil {
+			log.Error().Err(err).Msg("Config reload failed, pipelines keep running with the previous config: ")
+			continue
+		}
+		pipelines = newPipelines
+		for _, pipe := range pipelines {
+			pipe.Batch(*batchSize, *batchCapacity)
+			if *instrument {
+				pipe.Instrument()
+			}
+			pipe.Start()
+			pipe.AutoDrain()
+		}
+		if adminAPI != nil {
+			adminAPI.SetPipelines(pipelines)
+		}
+		log.Info().Msgf("Config reloaded, started %d new pipelines", len(pipelines))
+	}
+	log.Info().Msg("Received exit signal, shutting down")
+	if adminAPI != nil {
+		adminAPI.SetShuttingDown()
+	}
+	go func() {
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				log.Error().Msg("Received a second exit signal - force quitting")
+				os.Exit(exitShutdownTimeout)
+			}
+		}
+	}()
+	os.Exit(shutdown(pipelines, *shutdownTimeout))
+}
+
+// Shuts down all pipelines at once and returns the exit code.
+func shutdown(pipelines []*pipeline.Pipeline, timeout time.Duration) int {
+	errs := make([]error, len(pipelines))
+	var wg sync.WaitGroup
+	for i, pipe := range pipelines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = pipe.Shutdown(timeout)
+		}()
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	code := shutdownExitCode(err)
+	switch code {
+	case exitShutdownTimeout:
+		log.Error().Msgf("Failed to shut down gracefully within %s - force quitting, flows still in the pipelines are lost", timeout)
+	case exitFlowsLost:
+		log.Error().Err(err).Msg("Shut down, but some flows could not be written: ")
+	default:
+		log.Info().Msg("Shut down gracefully, all flows have been processed")
+	}
+	return code
+}
+
+// Maps the errors of shutting down the pipelines to an exit code, where
+// losing flows in the pipelines takes precedence over failing to write some.
+func shutdownExitCode(err error) int {
+	switch {
+	case errors.Is(err, pipeline.ErrShutdownTimeout):
+		return exitShutdownTimeout
+	case err != nil:
+		return exitFlowsLost
+	}
+	return 0
+}
+
+// Serves metrics about the pipelines themselves, such as config reloads and
+// the throughput of each segment.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(pipeline.Registry, promhttp.HandlerOpts{}))
 	go func() {
-		<-time.After(time.Duration(15 * time.Second))
-		log.Fatal().Msg("Failed to shut down gracefully - force quitting")
-		os.Exit(5)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to serve metrics on %s", addr)
+		}
 	}()
+	log.Info().Msgf("Serving metrics on %s/metrics", addr)
+}
+
+// Starts the admin server with the admin API and the metrics about the
+// pipelines. Pausing and resuming requires the token if it is set.
+func serveAdmin(addr string, token string) (*pipeline.AdminAPI, error) {
+	if _, err := admin.ListenAndServe(addr); err != nil {
+		return nil, err
+	}
+	if _, err := admin.Handle("/metrics", promhttp.HandlerFor(pipeline.Registry, promhttp.HandlerOpts{})); err != nil {
+		return nil, err
+	}
+	adminAPI := pipeline.NewAdminAPI(token)
+	return adminAPI, adminAPI.Register()
 }
 
 func zerologLogLevel(logLevel *string) zerolog.Level {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pipeline"
+)
+
+// Runs main instead of the tests if the arguments for it are set, which lets
+// tests check the exit code of the binary.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("FLOWPIPELINE_TEST_ARGS"); ok {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Runs the test binary as flowpipeline with the given arguments and returns
+// its exit code.
+func runMain(t *testing.T, args ...string) int {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FLOWPIPELINE_TEST_ARGS="+strings.Join(args, " "))
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	valid, invalid := filepath.Join(dir, "valid.yml"), filepath.Join(dir, "invalid.yml")
+	if err := os.WriteFile(valid, []byte("- segment: pass\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(invalid, []byte("- segment: nonexistent\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.yml")
+	for _, test := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-v"}, 0},
+		{[]string{"-c", valid, "-check"}, 0},
+		{[]string{"-c", invalid, "-check"}, exitConfigError},
+		{[]string{"-c", missing, "-check"}, exitConfigError},
+		{[]string{"-c", missing}, exitConfigError},
+		{[]string{"-c", invalid}, exitConfigError},
+	} {
+		if code := runMain(t, test.args...); code != test.code {
+			t.Errorf("[error] Running with %v exited with %d, expected %d.", test.args, code, test.code)
+		}
+	}
+}
+
+func TestShutdownExitCode(t *testing.T) {
+	flowsLost := fmt.Errorf("json: %w", pipeline.ErrFlowsLost)
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{flowsLost, exitFlowsLost},
+		{pipeline.ErrShutdownTimeout, exitShutdownTimeout},
+		{errors.Join(flowsLost, pipeline.ErrShutdownTimeout), exitShutdownTimeout},
+	} {
+		if code := shutdownExitCode(test.err); code != test.code {
+			t.Errorf("[error] Shutdown error '%v' maps to exit code %d, expected %d.", test.err, code, test.code)
+		}
+	}
+}
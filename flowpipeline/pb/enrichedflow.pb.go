@@ -367,6 +367,58 @@ func (EnrichedFlow_RemoteAddrType) EnumDescriptor() ([]byte, []int) {
 	return file_pb_enrichedflow_proto_rawDescGZIP(), []int{0, 5}
 }
 
+type EnrichedFlow_MatchedSideType int32
+
+const (
+	EnrichedFlow_NotMatched  EnrichedFlow_MatchedSideType = 0
+	EnrichedFlow_MatchedSrc  EnrichedFlow_MatchedSideType = 1
+	EnrichedFlow_MatchedDst  EnrichedFlow_MatchedSideType = 2
+	EnrichedFlow_MatchedBoth EnrichedFlow_MatchedSideType = 3
+)
+
+// Enum value maps for EnrichedFlow_MatchedSideType.
+var (
+	EnrichedFlow_MatchedSideType_name = map[int32]string{
+		0: "NotMatched",
+		1: "MatchedSrc",
+		2: "MatchedDst",
+		3: "MatchedBoth",
+	}
+	EnrichedFlow_MatchedSideType_value = map[string]int32{
+		"NotMatched":  0,
+		"MatchedSrc":  1,
+		"MatchedDst":  2,
+		"MatchedBoth": 3,
+	}
+)
+
+func (x EnrichedFlow_MatchedSideType) Enum() *EnrichedFlow_MatchedSideType {
+	p := new(EnrichedFlow_MatchedSideType)
+	*p = x
+	return p
+}
+
+func (x EnrichedFlow_MatchedSideType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (EnrichedFlow_MatchedSideType) Descriptor() protoreflect.EnumDescriptor {
+	return file_pb_enrichedflow_proto_enumTypes[6].Descriptor()
+}
+
+func (EnrichedFlow_MatchedSideType) Type() protoreflect.EnumType {
+	return &file_pb_enrichedflow_proto_enumTypes[6]
+}
+
+func (x EnrichedFlow_MatchedSideType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use EnrichedFlow_MatchedSideType.Descriptor instead.
+func (EnrichedFlow_MatchedSideType) EnumDescriptor() ([]byte, []int) {
+	return file_pb_enrichedflow_proto_rawDescGZIP(), []int{0, 6}
+}
+
 type EnrichedFlow struct {
 	state           protoimpl.MessageState `protogen:"open.v1"`
 	Type            EnrichedFlow_FlowType  `protobuf:"varint,1,opt,name=type,proto3,enum=flowpb.EnrichedFlow_FlowType" json:"type,omitempty"`
@@ -536,6 +588,13 @@ type EnrichedFlow struct {
 	SamplerIP      string `protobuf:"bytes,2293,opt,name=SamplerIP,proto3" json:"SamplerIP,omitempty"`
 	SourceMAC      string `protobuf:"bytes,2294,opt,name=SourceMAC,proto3" json:"SourceMAC,omitempty"`
 	DestinationMAC string `protobuf:"bytes,2295,opt,name=DestinationMAC,proto3" json:"DestinationMAC,omitempty"`
+	// segments/matching
+	MatchedPrefix   string                       `protobuf:"bytes,2977,opt,name=MatchedPrefix,proto3" json:"MatchedPrefix,omitempty"`                                       // most specific list prefix containing a flow address, or the domain entry for matches by host name
+	RepScore        float64                      `protobuf:"fixed64,2978,opt,name=RepScore,proto3" json:"RepScore,omitempty"`                                               // reputation score of the matched indicator, if provided by the list
+	EventCategories []string                     `protobuf:"bytes,2979,rep,name=EventCategories,proto3" json:"EventCategories,omitempty"`                                   // event categories the matched indicator was reported for
+	Blacklists      []string                     `protobuf:"bytes,2980,rep,name=Blacklists,proto3" json:"Blacklists,omitempty"`                                             // source blacklists listing the matched indicator
+	MatchedSide     EnrichedFlow_MatchedSideType `protobuf:"varint,2981,opt,name=MatchedSide,proto3,enum=flowpb.EnrichedFlow_MatchedSideType" json:"MatchedSide,omitempty"` // which flow addresses are contained in the matching list
+	Severity        string                       `protobuf:"bytes,2982,opt,name=Severity,proto3" json:"Severity,omitempty"`                                                 // severity of the matched watchlist entry, one of low, medium, high or critical
 	// VRF
 	IngressVrfIDBW uint32 `protobuf:"varint,2539,opt,name=IngressVrfIDBW,proto3" json:"IngressVrfIDBW,omitempty"`
 	EgressVrfIDBW  uint32 `protobuf:"varint,2540,opt,name=EgressVrfIDBW,proto3" json:"EgressVrfIDBW,omitempty"`
@@ -1558,6 +1617,48 @@ func (x *EnrichedFlow) GetDestinationMAC() string {
 	return ""
 }
 
+func (x *EnrichedFlow) GetMatchedPrefix() string {
+	if x != nil {
+		return x.MatchedPrefix
+	}
+	return ""
+}
+
+func (x *EnrichedFlow) GetRepScore() float64 {
+	if x != nil {
+		return x.RepScore
+	}
+	return 0
+}
+
+func (x *EnrichedFlow) GetEventCategories() []string {
+	if x != nil {
+		return x.EventCategories
+	}
+	return nil
+}
+
+func (x *EnrichedFlow) GetBlacklists() []string {
+	if x != nil {
+		return x.Blacklists
+	}
+	return nil
+}
+
+func (x *EnrichedFlow) GetMatchedSide() EnrichedFlow_MatchedSideType {
+	if x != nil {
+		return x.MatchedSide
+	}
+	return EnrichedFlow_NotMatched
+}
+
+func (x *EnrichedFlow) GetSeverity() string {
+	if x != nil {
+		return x.Severity
+	}
+	return ""
+}
+
 func (x *EnrichedFlow) GetIngressVrfIDBW() uint32 {
 	if x != nil {
 		return x.IngressVrfIDBW
@@ -1597,7 +1698,7 @@ var File_pb_enrichedflow_proto protoreflect.FileDescriptor
 
 const file_pb_enrichedflow_proto_rawDesc = "" +
 	"\n" +
-	"\x15pb/enrichedflow.proto\x12\x06flowpb\"\xa9.\n" +
+	"\x15pb/enrichedflow.proto\x12\x06flowpb\"\xf30\n" +
 	"\fEnrichedFlow\x121\n" +
 	"\x04type\x18\x01 \x01(\x0e2\x1d.flowpb.EnrichedFlow.FlowTypeR\x04type\x12#\n" +
 	"\rtime_received\x18\x02 \x01(\x04R\ftimeReceived\x12(\n" +
@@ -1761,7 +1862,15 @@ const file_pb_enrichedflow_proto_rawDesc = "" +
 	"\tNextHopIP\x18\xf4\x11 \x01(\tR\tNextHopIP\x12\x1d\n" +
 	"\tSamplerIP\x18\xf5\x11 \x01(\tR\tSamplerIP\x12\x1d\n" +
 	"\tSourceMAC\x18\xf6\x11 \x01(\tR\tSourceMAC\x12'\n" +
-	"\x0eDestinationMAC\x18\xf7\x11 \x01(\tR\x0eDestinationMAC\x12'\n" +
+	"\x0eDestinationMAC\x18\xf7\x11 \x01(\tR\x0eDestinationMAC\x12%\n" +
+	"\rMatchedPrefix\x18\xa1\x17 \x01(\tR\rMatchedPrefix\x12\x1b\n" +
+	"\bRepScore\x18\xa2\x17 \x01(\x01R\bRepScore\x12)\n" +
+	"\x0fEventCategories\x18\xa3\x17 \x03(\tR\x0fEventCategories\x12\x1f\n" +
+	"\n" +
+	"Blacklists\x18\xa4\x17 \x03(\tR\n" +
+	"Blacklists\x12G\n" +
+	"\vMatchedSide\x18\xa5\x17 \x01(\x0e2$.flowpb.EnrichedFlow.MatchedSideTypeR\vMatchedSide\x12\x1b\n" +
+	"\bSeverity\x18\xa6\x17 \x01(\tR\bSeverity\x12'\n" +
 	"\x0eIngressVrfIDBW\x18\xeb\x13 \x01(\rR\x0eIngressVrfIDBW\x12%\n" +
 	"\rEgressVrfIDBW\x18\xec\x13 \x01(\rR\rEgressVrfIDBW\x12%\n" +
 	"\rTimeFlowStart\x18\xea\x13 \x01(\x04R\rTimeFlowStart\x12\x1f\n" +
@@ -1815,7 +1924,15 @@ const file_pb_enrichedflow_proto_rawDesc = "" +
 	"\x0eRemoteAddrType\x12\v\n" +
 	"\aNeither\x10\x00\x12\a\n" +
 	"\x03Src\x10\x01\x12\a\n" +
-	"\x03Dst\x10\x02B$Z\"github.com/BelWue/flowpipeline/pb;b\x06proto3"
+	"\x03Dst\x10\x02\"R\n" +
+	"\x0fMatchedSideType\x12\x0e\n" +
+	"\n" +
+	"NotMatched\x10\x00\x12\x0e\n" +
+	"\n" +
+	"MatchedSrc\x10\x01\x12\x0e\n" +
+	"\n" +
+	"MatchedDst\x10\x02\x12\x0f\n" +
+	"\vMatchedBoth\x10\x03B$Z\"github.com/BelWue/flowpipeline/pb;b\x06proto3"
 
 var (
 	file_pb_enrichedflow_proto_rawDescOnce sync.Once
@@ -1829,7 +1946,7 @@ func file_pb_enrichedflow_proto_rawDescGZIP() []byte {
 	return file_pb_enrichedflow_proto_rawDescData
 }
 
-var file_pb_enrichedflow_proto_enumTypes = make([]protoimpl.EnumInfo, 6)
+var file_pb_enrichedflow_proto_enumTypes = make([]protoimpl.EnumInfo, 7)
 var file_pb_enrichedflow_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
 var file_pb_enrichedflow_proto_goTypes = []any{
 	(EnrichedFlow_FlowType)(0),             // 0: flowpb.EnrichedFlow.FlowType
@@ -1838,23 +1955,25 @@ var file_pb_enrichedflow_proto_goTypes = []any{
 	(EnrichedFlow_ValidationStatusType)(0), // 3: flowpb.EnrichedFlow.ValidationStatusType
 	(EnrichedFlow_NormalizedType)(0),       // 4: flowpb.EnrichedFlow.NormalizedType
 	(EnrichedFlow_RemoteAddrType)(0),       // 5: flowpb.EnrichedFlow.RemoteAddrType
-	(*EnrichedFlow)(nil),                   // 6: flowpb.EnrichedFlow
+	(EnrichedFlow_MatchedSideType)(0),      // 6: flowpb.EnrichedFlow.MatchedSideType
+	(*EnrichedFlow)(nil),                   // 7: flowpb.EnrichedFlow
 }
 var file_pb_enrichedflow_proto_depIdxs = []int32{
-	0, // 0: flowpb.EnrichedFlow.type:type_name -> flowpb.EnrichedFlow.FlowType
-	1, // 1: flowpb.EnrichedFlow.layer_stack:type_name -> flowpb.EnrichedFlow.LayerStack
-	2, // 2: flowpb.EnrichedFlow.SrcAddrAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
-	2, // 3: flowpb.EnrichedFlow.DstAddrAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
-	2, // 4: flowpb.EnrichedFlow.SamplerAddrAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
-	2, // 5: flowpb.EnrichedFlow.NextHopAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
-	3, // 6: flowpb.EnrichedFlow.ValidationStatus:type_name -> flowpb.EnrichedFlow.ValidationStatusType
-	4, // 7: flowpb.EnrichedFlow.Normalized:type_name -> flowpb.EnrichedFlow.NormalizedType
-	5, // 8: flowpb.EnrichedFlow.RemoteAddr:type_name -> flowpb.EnrichedFlow.RemoteAddrType
-	9, // [9:9] is the sub-list for method output_type
-	9, // [9:9] is the sub-list for method input_type
-	9, // [9:9] is the sub-list for extension type_name
-	9, // [9:9] is the sub-list for extension extendee
-	0, // [0:9] is the sub-list for field type_name
+	0,  // 0: flowpb.EnrichedFlow.type:type_name -> flowpb.EnrichedFlow.FlowType
+	1,  // 1: flowpb.EnrichedFlow.layer_stack:type_name -> flowpb.EnrichedFlow.LayerStack
+	2,  // 2: flowpb.EnrichedFlow.SrcAddrAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
+	2,  // 3: flowpb.EnrichedFlow.DstAddrAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
+	2,  // 4: flowpb.EnrichedFlow.SamplerAddrAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
+	2,  // 5: flowpb.EnrichedFlow.NextHopAnon:type_name -> flowpb.EnrichedFlow.AnonymizedType
+	3,  // 6: flowpb.EnrichedFlow.ValidationStatus:type_name -> flowpb.EnrichedFlow.ValidationStatusType
+	4,  // 7: flowpb.EnrichedFlow.Normalized:type_name -> flowpb.EnrichedFlow.NormalizedType
+	5,  // 8: flowpb.EnrichedFlow.RemoteAddr:type_name -> flowpb.EnrichedFlow.RemoteAddrType
+	6,  // 9: flowpb.EnrichedFlow.MatchedSide:type_name -> flowpb.EnrichedFlow.MatchedSideType
+	10, // [10:10] is the sub-list for method output_type
+	10, // [10:10] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
 }
 
 func init() { file_pb_enrichedflow_proto_init() }
@@ -1867,7 +1986,7 @@ func file_pb_enrichedflow_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pb_enrichedflow_proto_rawDesc), len(file_pb_enrichedflow_proto_rawDesc)),
-			NumEnums:      6,
+			NumEnums:      7,
 			NumMessages:   1,
 			NumExtensions: 0,
 			NumServices:   0,
@@ -0,0 +1,155 @@
+// The admin package runs the process-wide admin HTTP server of flowpipeline.
+// It serves the admin API of the pipeline package, and segments can register
+// handlers on it instead of listening on a port of their own.
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	handlers = make(map[string]http.Handler)
+	lock     = &sync.RWMutex{}
+	enabled  bool
+)
+
+// Starts the admin server listening on addr. Handlers can be registered
+// before and after this.
+func ListenAndServe(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	lock.Lock()
+	enabled = true
+	lock.Unlock()
+	server := &http.Server{Handler: http.HandlerFunc(serveHTTP)}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msgf("Admin: Failed to serve on %s", addr)
+		}
+	}()
+	log.Info().Msgf("Admin: Listening on %s", addr)
+	return server, nil
+}
+
+// Reports whether the admin server has been started.
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return enabled
+}
+
+// Registers a handler for a path, or for all paths below it if the pattern
+// ends with a slash, with longer patterns taking precedence. Unlike with
+// http.ServeMux, handlers can be removed again using the returned function,
+// e.g. when the segment which registered them stops.
+func Handle(pattern string, handler http.Handler) (func(), error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("invalid admin path '%s', it must start with '/'", pattern)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := handlers[pattern]; ok {
+		return nil, fmt.Errorf("admin path '%s' is already in use", pattern)
+	}
+	handlers[pattern] = handler
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(handlers, pattern)
+	}, nil
+}
+
+// Returns path if the admin server has been started, or ":8080", the default
+// address of segments serving HTTP on a port of their own, otherwise.
+func DefaultEndpoint(path string) string {
+	if Enabled() {
+		return path
+	}
+	return ":8080"
+}
+
+// Serves the handler of a segment at endpoint, which is either a path on the
+// admin server such as "/prometheus", or an address to listen on with a
+// server of its own such as ":8080". In the first case, the handler sees
+// requests with the path prefix stripped. The returned function stops
+// serving.
+func ServeSegment(endpoint string, handler http.Handler) (func(), error) {
+	if strings.HasPrefix(endpoint, "/") {
+		if !Enabled() {
+			return nil, fmt.Errorf("endpoint '%s' is a path, but the admin server is not enabled", endpoint)
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		return Handle(endpoint+"/", http.StripPrefix(endpoint, handler))
+	}
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msgf("Admin: Failed to serve on %s", endpoint)
+		}
+	}()
+	return func() { server.Close() }, nil
+}
+
+func serveHTTP(w http.ResponseWriter, r *http.Request) {
+	lock.RLock()
+	handler, redirect := match(r.URL.Path)
+	lock.RUnlock()
+	switch {
+	case handler != nil:
+		handler.ServeHTTP(w, r)
+	case redirect:
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+	case r.URL.Path == "/":
+		listHandlers(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Finds the handler for path, or reports whether there is one for the path
+// with a trailing slash. Needs the lock to be held.
+func match(path string) (http.Handler, bool) {
+	if handler, ok := handlers[path]; ok {
+		return handler, false
+	}
+	var longest string
+	for pattern := range handlers {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(longest) {
+			longest = pattern
+		}
+	}
+	if longest != "" {
+		return handlers[longest], false
+	}
+	_, ok := handlers[path+"/"]
+	return nil, ok
+}
+
+func listHandlers(w http.ResponseWriter) {
+	lock.RLock()
+	patterns := make([]string, 0, len(handlers))
+	for pattern := range handlers {
+		patterns = append(patterns, pattern)
+	}
+	lock.RUnlock()
+	sort.Strings(patterns)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, pattern := range patterns {
+		fmt.Fprintln(w, pattern)
+	}
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testutilGet(t *testing.T, path string) (int, string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	serveHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	body, _ := io.ReadAll(recorder.Body)
+	return recorder.Code, string(body)
+}
+
+func testutilHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body + " " + r.URL.Path))
+	})
+}
+
+func TestHandle(t *testing.T) {
+	unregister, err := Handle("/a/", testutilHandler("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unregister()
+	unregisterLonger, err := Handle("/a/b/", testutilHandler("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Handle("/a/", testutilHandler("c")); err == nil {
+		t.Error("[error] Registering a path twice did not fail.")
+	}
+	if _, err := Handle("a", testutilHandler("c")); err == nil {
+		t.Error("[error] Registering a relative path did not fail.")
+	}
+
+	expectations := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/a/x", http.StatusOK, "a /a/x"},
+		{"/a/b/x", http.StatusOK, "b /a/b/x"},
+		{"/a", http.StatusMovedPermanently, ""},
+		{"/x", http.StatusNotFound, ""},
+		{"/", http.StatusOK, "/a/\n/a/b/\n"},
+	}
+	for _, expected := range expectations {
+		code, body := testutilGet(t, expected.path)
+		if code != expected.code || (expected.body != "" && body != expected.body) {
+			t.Errorf("[error] GET %s returned %d '%s', expected %d '%s'.", expected.path, code, body, expected.code, expected.body)
+		}
+	}
+
+	unregisterLonger()
+	if _, body := testutilGet(t, "/a/b/x"); body != "a /a/b/x" {
+		t.Errorf("[error] Unregistered handler still serves: %s", body)
+	}
+}
+
+func TestServeSegment(t *testing.T) {
+	if _, err := ServeSegment("/segment", testutilHandler("segment")); err == nil {
+		t.Error("[error] Serving a path without admin server did not fail.")
+	}
+	lock.Lock()
+	enabled = true
+	lock.Unlock()
+	defer func() {
+		lock.Lock()
+		enabled = false
+		lock.Unlock()
+	}()
+	if DefaultEndpoint("/segment") != "/segment" {
+		t.Errorf("[error] Wrong default endpoint with admin server: %s", DefaultEndpoint("/segment"))
+	}
+	stop, err := ServeSegment("/segment", testutilHandler("segment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := testutilGet(t, "/segment/metrics"); body != "segment /metrics" {
+		t.Errorf("[error] Segment handler got the wrong request: %s", body)
+	}
+	stop()
+	if code, _ := testutilGet(t, "/segment/metrics"); code != http.StatusNotFound {
+		t.Errorf("[error] Stopped segment handler still serves: %d", code)
+	}
+}
@@ -0,0 +1,286 @@
+package pipeline
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pipeline/admin"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// Config keys whose values are replaced by redacted in the admin API.
+var secretKey = regexp.MustCompile(`(?i)pass|secret|token|key|auth|credential`)
+
+const redacted = "<redacted>"
+
+// Serves the admin API on the admin server, which lists the running
+// pipelines, reports their health and allows pausing and resuming them:
+//
+//	GET  /health                     status of the process, 503 while shutting down
+//	GET  /pipelines                  all pipelines with their segments and configs
+//	GET  /pipelines/{index}          a single pipeline, starting at 0
+//	POST /pipelines/{index}/pause    pause a pipeline, or all of them if index is "all"
+//	POST /pipelines/{index}/resume   resume a pipeline, or all of them if index is "all"
+//
+// Pausing requires the pipelines to be instrumented. Pause and resume requests
+// have to carry the token as "Authorization: Bearer <token>" if one is set, or
+// else come from the local host.
+type AdminAPI struct {
+	lock         sync.RWMutex
+	pipelines    []*Pipeline
+	shuttingDown bool
+	started      time.Time
+	token        string
+	mux          *http.ServeMux
+}
+
+// Creates an AdminAPI, which serves no pipelines until SetPipelines is called.
+// An empty token restricts pausing and resuming to requests from the local
+// host.
+func NewAdminAPI(token string) *AdminAPI {
+	api := &AdminAPI{started: time.Now(), token: token, mux: http.NewServeMux()}
+	api.mux.HandleFunc("GET /health", api.health)
+	api.mux.HandleFunc("GET /pipelines", api.listPipelines)
+	api.mux.HandleFunc("GET /pipelines/{index}", api.getPipeline)
+	api.mux.HandleFunc("POST /pipelines/{index}/pause", api.pause)
+	api.mux.HandleFunc("POST /pipelines/{index}/resume", api.resume)
+	return api
+}
+
+// Registers the AdminAPI on the admin server.
+func (api *AdminAPI) Register() error {
+	for _, pattern := range []string{"/health", "/pipelines", "/pipelines/"} {
+		if _, err := admin.Handle(pattern, api); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+// Sets the pipelines to serve, called on start and after every reload.
+func (api *AdminAPI) SetPipelines(pipelines []*Pipeline) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.pipelines = pipelines
+}
+
+// Makes the health endpoint report that the process is shutting down.
+func (api *AdminAPI) SetShuttingDown() {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.shuttingDown = true
+}
+
+type healthRepr struct {
+	Status               string  `json:"status"` // one of "ok", "paused" if all pipelines are paused, or "shutting down"
+	Pipelines            int     `json:"pipelines"`
+	Paused               int     `json:"paused"`
+	LastReloadSuccessful bool    `json:"last_reload_successful"`
+	LastReloadError      string  `json:"last_reload_error,omitempty"`
+	UptimeSeconds        float64 `json:"uptime_seconds"`
+}
+
+func (api *AdminAPI) health(w http.ResponseWriter, r *http.Request) {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	health := healthRepr{Status: "ok", Pipelines: len(api.pipelines), UptimeSeconds: time.Since(api.started).Seconds()}
+	for _, pipeline := range api.pipelines {
+		if pipeline.Paused() {
+			health.Paused++
+		}
+	}
+	if err := lastReloadError(); err != nil {
+		health.LastReloadError = err.Error()
+	} else {
+		health.LastReloadSuccessful = true
+	}
+	status := http.StatusOK
+	switch {
+	case api.shuttingDown:
+		health.Status = "shutting down"
+		status = http.StatusServiceUnavailable
+	case health.Paused > 0 && health.Paused == health.Pipelines:
+		health.Status = "paused"
+	}
+	writeJSON(w, status, health)
+}
+
+type pipelineRepr struct {
+	Index    int           `json:"index"`
+	Paused   bool          `json:"paused"`
+	Segments []segmentRepr `json:"segments"`
+}
+
+type segmentRepr struct {
+	Index  int               `json:"index"` // starting at 1, like in the segment metrics
+	Name   string            `json:"segment"`
+	Jobs   int               `json:"jobs,omitempty"`
+	Config map[string]string `json:"config,omitempty"`
+	If     []segmentRepr     `json:"if,omitempty"`
+	Then   []segmentRepr     `json:"then,omitempty"`
+	Else   []segmentRepr     `json:"else,omitempty"`
+}
+
+func (api *AdminAPI) listPipelines(w http.ResponseWriter, r *http.Request) {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	pipelines := make([]pipelineRepr, len(api.pipelines))
+	for i, pipeline := range api.pipelines {
+		pipelines[i] = pipeline.repr(i)
+	}
+	writeJSON(w, http.StatusOK, pipelines)
+}
+
+func (api *AdminAPI) getPipeline(w http.ResponseWriter, r *http.Request) {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(api.pipelines) {
+		http.Error(w, fmt.Sprintf("no pipeline with index '%s'", r.PathValue("index")), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.pipelines[index].repr(index))
+}
+
+func (api *AdminAPI) pause(w http.ResponseWriter, r *http.Request) {
+	api.apply(w, r, "paused", (*Pipeline).Pause)
+}
+
+func (api *AdminAPI) resume(w http.ResponseWriter, r *http.Request) {
+	api.apply(w, r, "resumed", (*Pipeline).Resume)
+}
+
+// Applies action to the pipeline selected by the request, or to all of them.
+func (api *AdminAPI) apply(w http.ResponseWriter, r *http.Request, done string, action func(*Pipeline) error) {
+	if !api.authorized(r) {
+		if api.token != "" {
+			http.Error(w, "a valid admin token is required", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "only allowed from the local host unless an admin token is set", http.StatusForbidden)
+		}
+		return
+	}
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	selected := api.pipelines
+	if r.PathValue("index") != "all" {
+		index, err := strconv.Atoi(r.PathValue("index"))
+		if err != nil || index < 0 || index >= len(api.pipelines) {
+			http.Error(w, fmt.Sprintf("no pipeline with index '%s'", r.PathValue("index")), http.StatusNotFound)
+			return
+		}
+		selected = api.pipelines[index : index+1]
+	}
+	for _, pipeline := range selected {
+		if err := action(pipeline); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	log.Info().Msgf("Admin: %s %d pipelines", done, len(selected))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reports whether a request carries the token, or comes from the local host
+// if there is none.
+func (api *AdminAPI) authorized(r *http.Request) bool {
+	if api.token != "" {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+api.token)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Describes the Pipeline for the admin API. Pipelines not built from a config
+// only list the names of their segments.
+func (pipeline *Pipeline) repr(index int) pipelineRepr {
+	result := pipelineRepr{Index: index, Paused: pipeline.Paused()}
+	if pipeline.segmentReprs != nil {
+		result.Segments = redactedReprs(pipeline.segmentReprs)
+		return result
+	}
+	for i, segment := range pipeline.SegmentList {
+		result.Segments = append(result.Segments, segmentRepr{Index: i + 1, Name: segments.SegmentName(segment)})
+	}
+	return result
+}
+
+func redactedReprs(segmentReprs []SegmentRepr) []segmentRepr {
+	var result []segmentRepr
+	for i, repr := range segmentReprs {
+		config := repr.ExpandedConfig()
+		for key, value := range config {
+			config[key] = redactValue(key, value)
+		}
+		result = append(result, segmentRepr{
+			Index:  i + 1,
+			Name:   repr.Name,
+			Jobs:   repr.Jobs,
+			Config: config,
+			If:     redactedReprs(repr.If),
+			Then:   redactedReprs(repr.Then),
+			Else:   redactedReprs(repr.Else),
+		})
+	}
+	return result
+}
+
+// Hides secrets in a config value, i.e. values of keys looking like they hold
+// secrets, and passwords in URLs.
+func redactValue(key string, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretKey.MatchString(key) {
+		return redacted
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" {
+		return value
+	}
+	changed := false
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), "redacted")
+		changed = true
+	}
+	query := parsed.Query()
+	for name := range query {
+		if secretKey.MatchString(name) {
+			query.Set(name, "redacted")
+			changed = true
+		}
+	}
+	if !changed {
+		return value
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Warn().Err(err).Msg("Admin: Failed to write response: ")
+	}
+}
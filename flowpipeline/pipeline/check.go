@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// A problem found by CheckConfig.
+type ConfigProblem struct {
+	Segment string // position and name of the segment, e.g. "segment 2 (branch), then segment 1 (json)", empty if the whole config is affected
+	Message string
+}
+
+func (problem ConfigProblem) String() string {
+	if problem.Segment == "" {
+		return problem.Message
+	}
+	return fmt.Sprintf("%s: %s", problem.Segment, problem.Message)
+}
+
+// Checks a configuration without running it. The config is parsed and every
+// segment is instantiated, including the sub-pipelines of branch segments and
+// all jobs of parallelized segments, and any problems are returned together.
+// Segments are numbered starting at 1 within their pipeline. Segments
+// implementing segments.Checker only validate their config, such as output
+// segments which would otherwise truncate their files, and all others are
+// closed again right away. Errors logged during the check are collected as
+// problems instead of being passed on to the global logger.
+func CheckConfig(config []byte) []ConfigProblem {
+	writer := &problemWriter{logger: log.Logger}
+	log.Logger = zerolog.New(writer).Level(log.Logger.GetLevel())
+	defer func() {
+		log.Logger = writer.logger
+	}()
+
+	segmentReprs, err := SegmentReprsFromConfig(config)
+	if err != nil {
+		return []ConfigProblem{{Message: err.Error()}}
+	}
+	if len(segmentReprs) == 0 {
+		return []ConfigProblem{{Message: "the configuration does not contain any segments"}}
+	}
+	return checkSegmentReprs(writer, segmentReprs, "")
+}
+
+func checkSegmentReprs(writer *problemWriter, segmentReprs []SegmentRepr, parent string) []ConfigProblem {
+	var problems []ConfigProblem
+	for i, segmentrepr := range segmentReprs {
+		location := parent + segmentLocation(i, segmentrepr)
+
+		if segmentrepr.Name != "branch" && len(segmentrepr.If)+len(segmentrepr.Then)+len(segmentrepr.Else) > 0 {
+			problems = append(problems, ConfigProblem{location, "only branch segments can have 'if', 'then' and 'else' pipelines"})
+		}
+		problems = append(problems, checkSegmentReprs(writer, segmentrepr.If, location+", if ")...)
+		problems = append(problems, checkSegmentReprs(writer, segmentrepr.Then, location+", then ")...)
+		problems = append(problems, checkSegmentReprs(writer, segmentrepr.Else, location+", else ")...)
+
+		if segmentrepr.Name == "" {
+			problems = append(problems, ConfigProblem{location, "no segment name given"})
+			continue
+		}
+		segmentTemplate, ok := segments.FindSegment(segmentrepr.Name)
+		if !ok {
+			problems = append(problems, ConfigProblem{location, fmt.Sprintf("could not find a segment named '%s'", segmentrepr.Name)})
+			continue
+		}
+		var messages []string
+		for range max(segmentrepr.Jobs, 1) {
+			for _, message := range checkSegment(writer, segmentTemplate, segmentrepr) {
+				if !slices.Contains(messages, message) { // every job usually fails the same way
+					messages = append(messages, message)
+				}
+			}
+		}
+		for _, message := range messages {
+			problems = append(problems, ConfigProblem{location, message})
+		}
+	}
+	return problems
+}
+
+// Checks the config of a segment using its template, or else instantiates and
+// closes it, and returns its error and any error messages it logged while
+// doing so.
+func checkSegment(writer *problemWriter, segmentTemplate segments.Segment, segmentrepr SegmentRepr) []string {
+	writer.messages = nil
+	if checker, ok := segmentTemplate.(segments.Checker); ok {
+		if err := checker.Check(segmentrepr.ExpandedConfig()); err != nil {
+			return append(writer.messages, err.Error())
+		}
+		return writer.messages
+	}
+	segment, err := segments.Construct(segmentTemplate, segmentrepr.ExpandedConfig())
+	if err != nil {
+		if errors.Is(err, segments.ErrNotInitialized) && len(writer.messages) > 0 {
+			return writer.messages // the reasons have been logged
+		}
+		return append(writer.messages, err.Error())
+	}
+	segment.AddCustomConfig(segmentrepr.Config)
+	segment.Close()
+	return writer.messages
+}
+
+// Collects the messages of errors logged to it and passes any other log
+// entries on to the previous logger.
+type problemWriter struct {
+	logger   zerolog.Logger
+	messages []string
+}
+
+func (writer *problemWriter) Write(p []byte) (int, error) {
+	return writer.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (writer *problemWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	fields := make(map[string]any)
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return 0, err
+	}
+	message, _ := fields[zerolog.MessageFieldName].(string)
+	if level == zerolog.ErrorLevel {
+		if err, ok := fields[zerolog.ErrorFieldName].(string); ok {
+			message = fmt.Sprintf("%s: %s", strings.TrimRight(message, ": "), err)
+		}
+		writer.messages = append(writer.messages, message)
+		return len(p), nil
+	}
+	delete(fields, zerolog.LevelFieldName)
+	delete(fields, zerolog.MessageFieldName)
+	writer.logger.WithLevel(level).Fields(fields).Msg(message)
+	return len(p), nil
+}
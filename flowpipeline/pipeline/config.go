@@ -2,11 +2,10 @@ package pipeline
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
 
-	"github.com/rs/zerolog/log"
-
 	"github.com/BelWue/flowpipeline/pipeline/config"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/BelWue/flowpipeline/segments/controlflow/branch"
@@ -47,63 +46,131 @@ func (s *SegmentRepr) ExpandedConfig() map[string]string {
 
 // Builds a list of Segment objects from raw configuration bytes and
 // initializes a Pipeline with them.
-func NewFromConfig(config []byte) *Pipeline {
+func NewFromConfig(config []byte) (*Pipeline, error) {
 	// parse a list of SegmentReprs from yaml
-	segmentReprs := SegmentReprsFromConfig(config)
+	segmentReprs, err := SegmentReprsFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
 
-	// build segments from it
-	segments := SegmentsFromRepr(segmentReprs)
+	return NewFromRepr(segmentReprs)
+}
 
-	// we have Segments parsed and ready, instantiate them as actual pipeline
-	return New(segments...)
+// Builds a list of Segment objects from their config representations and
+// initializes a Pipeline with them, which keeps the representations for the
+// admin API.
+func NewFromRepr(segmentReprs []SegmentRepr) (*Pipeline, error) {
+	segments, err := SegmentsFromRepr(segmentReprs)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := New(segments...)
+	pipeline.segmentReprs = segmentReprs
+	return pipeline, nil
 }
 
 // SegmentReprsFromConfig returns a list of segment representation objects from a config.
-func SegmentReprsFromConfig(config []byte) []SegmentRepr {
+func SegmentReprsFromConfig(config []byte) ([]SegmentRepr, error) {
 	// parse a list of SegmentReprs from yaml
 	segmentReprs := []SegmentRepr{}
 
 	err := yaml.Unmarshal(config, &segmentReprs)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error parsing configuration YAML: ")
+		return nil, fmt.Errorf("error parsing configuration YAML: %w", err)
 	}
 
-	return segmentReprs
+	return segmentReprs, nil
 }
 
 // Creates a list of Segments from their config representations. Handles
-// recursive definitions found in Segments.
-func SegmentsFromRepr(segmentReprs []SegmentRepr) []segments.Segment {
-	segmentList := make([]segments.Segment, len(segmentReprs))
+// recursive definitions found in Segments. Errors name the segment which could
+// not be created by its position in the pipeline, starting at 1, and its name,
+// and all segments created before are closed again.
+func SegmentsFromRepr(segmentReprs []SegmentRepr) ([]segments.Segment, error) {
+	segmentList := make([]segments.Segment, 0, len(segmentReprs))
 	for i, segmentrepr := range segmentReprs {
+		segment, err := segmentFromRepr(segmentrepr)
+		if err != nil {
+			closeSegments(segmentList)
+			return nil, fmt.Errorf("%s%w", segmentLocation(i, segmentrepr), err)
+		}
+		segmentList = append(segmentList, segment)
+	}
+	return segmentList, nil
+}
+
+// Builds a single segment including its branches or parallel jobs. Errors
+// are prefixed for use after the segment's location, and the parts built
+// before an error are closed.
+func segmentFromRepr(segmentrepr SegmentRepr) (segments.Segment, error) {
+	var built []segments.Segment
+	ifSegments, err := SegmentsFromRepr(segmentrepr.If)
+	if err != nil {
+		return nil, fmt.Errorf(", if %w", err)
+	}
+	built = append(built, ifSegments...)
+	thenSegments, err := SegmentsFromRepr(segmentrepr.Then)
+	if err != nil {
+		closeSegments(built)
+		return nil, fmt.Errorf(", then %w", err)
+	}
+	built = append(built, thenSegments...)
+	elseSegments, err := SegmentsFromRepr(segmentrepr.Else)
+	if err != nil {
+		closeSegments(built)
+		return nil, fmt.Errorf(", else %w", err)
+	}
+	built = append(built, elseSegments...)
+	ifPipeline, thenPipeline, elsePipeline := New(ifSegments...), New(thenSegments...), New(elseSegments...)
+
+	segmentTemplate, ok := segments.FindSegment(segmentrepr.Name) // a typed nil instance
+	if !ok {
+		closeSegments(built)
+		return nil, fmt.Errorf(": could not find a segment named '%s'", segmentrepr.Name)
+	}
 
-		ifPipeline := New(SegmentsFromRepr(segmentrepr.If)...)
-		thenPipeline := New(SegmentsFromRepr(segmentrepr.Then)...)
-		elsePipeline := New(SegmentsFromRepr(segmentrepr.Else)...)
-
-		segmentTemplate := segments.LookupSegment(segmentrepr.Name) // a typed nil instance
-
-		if segmentrepr.Jobs <= 1 {
-			segmentList[i] = segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline, segmentTemplate, segmentrepr)
-		} else {
-			wrapper := &segments.ParallelizedSegment{}
-			for range segmentrepr.Jobs {
-				segment := segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline, segmentTemplate, segmentrepr)
-				if segment != nil {
-					wrapper.AddSegment(segment)
-				} else {
-					log.Fatal().Msgf("Configured segment '%s' could not be initialized properly, see previous messages.", segmentrepr.Name)
-				}
-			}
-			segmentList[i] = wrapper
+	if segmentrepr.Jobs <= 1 {
+		segment, err := segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline, segmentTemplate, segmentrepr)
+		if err != nil {
+			closeSegments(built)
+			return nil, fmt.Errorf(": %w", err)
 		}
+		return segment, nil
+	}
+	wrapper := &segments.ParallelizedSegment{}
+	for range segmentrepr.Jobs {
+		segment, err := segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline, segmentTemplate, segmentrepr)
+		if err != nil {
+			closeSegments(append(built, wrapper))
+			return nil, fmt.Errorf(": %w", err)
+		}
+		wrapper.AddSegment(segment)
+	}
+	return wrapper, nil
+}
+
+// Closes segments which have been built but are never run, including those
+// in branches and parallel jobs.
+func closeSegments(segmentList []segments.Segment) {
+	for _, segment := range flattenSegments(segmentList) {
+		segment.Close()
 	}
-	return segmentList
 }
 
-func segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline *Pipeline, segmentTemplate segments.Segment, segmentrepr SegmentRepr) segments.Segment {
-	// the Segment's New method knows how to handle our config
-	segment := segmentTemplate.New(segmentrepr.ExpandedConfig())
+// Describes the i-th segment of a pipeline for error messages.
+func segmentLocation(i int, segmentrepr SegmentRepr) string {
+	if segmentrepr.Name == "" {
+		return fmt.Sprintf("segment %d", i+1)
+	}
+	return fmt.Sprintf("segment %d (%s)", i+1, segmentrepr.Name)
+}
+
+func segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline *Pipeline, segmentTemplate segments.Segment, segmentrepr SegmentRepr) (segments.Segment, error) {
+	// the Segment's Construct or New method knows how to handle our config
+	segment, err := segments.Construct(segmentTemplate, segmentrepr.ExpandedConfig())
+	if err != nil {
+		return nil, err
+	}
 	switch segment := segment.(type) { // handle special segments
 	case *branch.Branch:
 		segment.ImportBranches(
@@ -113,5 +180,5 @@ func segmentFromTemplate(ifPipeline, thenPipeline, elsePipeline *Pipeline, segme
 		)
 	}
 	segment.AddCustomConfig(segmentrepr.Config)
-	return segment
+	return segment, nil
 }
@@ -0,0 +1,267 @@
+package pipeline
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+const (
+	dropTimeout = 10 * time.Second // flows not leaving a segment within this time count as dropped
+	maxInFlight = 1 << 16          // flows tracked per segment, the oldest beyond this count as dropped
+)
+
+var (
+	segmentLabels   = []string{"index", "name"}
+	segmentFlowsIn  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "flowpipeline_segment_flows_in_total", Help: "Number of flows passed to a segment."}, segmentLabels)
+	segmentFlowsOut = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "flowpipeline_segment_flows_out_total", Help: "Number of flows emitted by a segment, including those it created itself."}, segmentLabels)
+	segmentDropped  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "flowpipeline_segment_flows_dropped_total", Help: "Number of flows passed to a segment which it did not emit within 10 seconds or before stopping."}, segmentLabels)
+	segmentLatency  = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "flowpipeline_segment_latency_seconds",
+		Help:    "Time from passing a flow to a segment until the segment emitted it, including waiting for the segment to accept it.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, segmentLabels)
+	segmentReceiveWait = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "flowpipeline_segment_receive_wait_seconds_total", Help: "Time a segment had no flow to receive as the previous one did not emit any."}, segmentLabels)
+	segmentSendBlocked = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "flowpipeline_segment_send_blocked_seconds_total", Help: "Time flows emitted by a segment waited for the next one to accept them."}, segmentLabels)
+)
+
+func init() {
+	Registry.MustRegister(segmentFlowsIn, segmentFlowsOut, segmentDropped, segmentLatency, segmentReceiveWait, segmentSendBlocked)
+}
+
+// Makes Start insert a goroutine between all segments and at both ends of the
+// Pipeline, which passes flows on while measuring the segments before and
+// after it. The resulting metrics are available in Registry, labelled with the
+// index of the segment in the pipeline, starting at 1, and its name. Segments
+// in the sub-pipelines of branch segments are measured as part of their branch
+// segment. This must be called before Start, and adds a little overhead to
+// every flow, or batch of flows. It also allows pausing the Pipeline.
+func (pipeline *Pipeline) Instrument() {
+	pipeline.gate = &gate{}
+}
+
+// Returned by Pause and Resume for pipelines which have not been instrumented.
+var ErrNotInstrumented = errors.New("the pipeline has not been instrumented")
+
+// Pauses an instrumented Pipeline by holding all flows where they are, which
+// makes input segments stop receiving flows as soon as they block. Flows
+// segments hold on to themselves, such as batches of output segments, are not
+// flushed. Closing the pipeline resumes it first.
+func (pipeline *Pipeline) Pause() error {
+	if pipeline.gate == nil {
+		return ErrNotInstrumented
+	}
+	pipeline.gate.close()
+	return nil
+}
+
+// Resumes a paused Pipeline.
+func (pipeline *Pipeline) Resume() error {
+	if pipeline.gate == nil {
+		return ErrNotInstrumented
+	}
+	pipeline.gate.open()
+	return nil
+}
+
+// Reports whether the Pipeline is paused.
+func (pipeline *Pipeline) Paused() bool {
+	return pipeline.gate != nil && pipeline.gate.closed.Load() != nil
+}
+
+// Holds flows in all links of a pipeline while it is paused.
+type gate struct {
+	closed atomic.Pointer[chan struct{}] // nil while open, the channel is closed when opening again
+}
+
+func (gate *gate) close() {
+	opened := make(chan struct{})
+	gate.closed.CompareAndSwap(nil, &opened)
+}
+
+func (gate *gate) open() {
+	if opened := gate.closed.Swap(nil); opened != nil {
+		close(*opened)
+	}
+}
+
+func (gate *gate) wait() {
+	if opened := gate.closed.Load(); opened != nil {
+		<-*opened
+	}
+}
+
+// What segments exchange, either single flows or batches of them.
+type message interface {
+	*pb.EnrichedFlow | []*pb.EnrichedFlow
+}
+
+// Returns the flows in a message.
+func flowsOf[T message](msg T) []*pb.EnrichedFlow {
+	switch msg := any(msg).(type) {
+	case *pb.EnrichedFlow:
+		return []*pb.EnrichedFlow{msg}
+	case []*pb.EnrichedFlow:
+		return msg
+	}
+	return nil
+}
+
+// Passes flows from one segment to the next and measures them on the way.
+// The trackers are nil at the ends of the pipeline.
+type link[T message] struct {
+	from       <-chan T
+	to         chan<- T
+	gate       *gate
+	upstream   *segmentTracker
+	downstream *segmentTracker
+}
+
+func (link *link[T]) run(wg *sync.WaitGroup) {
+	defer func() {
+		close(link.to)
+		if link.upstream != nil {
+			link.upstream.stop()
+		}
+		wg.Done()
+	}()
+	for {
+		var msg T
+		var ok bool
+		select { // avoid looking at the clock if no waiting is involved
+		case msg, ok = <-link.from:
+		default:
+			start := time.Now()
+			msg, ok = <-link.from
+			if link.downstream != nil {
+				link.downstream.receiveWait.Add(time.Since(start).Seconds())
+			}
+		}
+		if !ok {
+			return
+		}
+		if link.upstream != nil {
+			link.upstream.leave(flowsOf(msg)...)
+		}
+		link.gate.wait() // holds a flow received while pausing until resumed
+		if link.downstream != nil {
+			link.downstream.enter(flowsOf(msg)...) // before sending, as the segment may emit it right away
+		}
+		select {
+		case link.to <- msg:
+		default:
+			start := time.Now()
+			link.to <- msg
+			if link.upstream != nil {
+				link.upstream.sendBlocked.Add(time.Since(start).Seconds())
+			}
+		}
+	}
+}
+
+// Keeps track of the flows inside a segment to find their latency and which
+// of them were dropped. Flows are told apart by their pointers, and a flow a
+// segment emits without it having been passed to it is assumed to replace
+// the oldest flow passed to it, such as with the keep policy of dropfields.
+// Input segments creating flows do not receive any.
+type segmentTracker struct {
+	lock     sync.Mutex
+	inFlight map[*pb.EnrichedFlow]time.Time
+	queue    []trackedFlow // in the order the flows entered, may contain flows which already left
+
+	flowsIn, flowsOut, dropped, receiveWait, sendBlocked prometheus.Counter
+	latency                                              prometheus.Observer
+}
+
+type trackedFlow struct {
+	flow    *pb.EnrichedFlow
+	entered time.Time
+}
+
+func newSegmentTracker(index int, name string) *segmentTracker {
+	labels := prometheus.Labels{"index": strconv.Itoa(index), "name": name}
+	return &segmentTracker{
+		inFlight:    make(map[*pb.EnrichedFlow]time.Time),
+		flowsIn:     segmentFlowsIn.With(labels),
+		flowsOut:    segmentFlowsOut.With(labels),
+		dropped:     segmentDropped.With(labels),
+		receiveWait: segmentReceiveWait.With(labels),
+		sendBlocked: segmentSendBlocked.With(labels),
+		latency:     segmentLatency.With(labels),
+	}
+}
+
+func (tracker *segmentTracker) enter(flows ...*pb.EnrichedFlow) {
+	now := time.Now()
+	tracker.flowsIn.Add(float64(len(flows)))
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for _, flow := range flows {
+		tracker.inFlight[flow] = now
+		tracker.queue = append(tracker.queue, trackedFlow{flow, now})
+	}
+	tracker.expire(now)
+}
+
+func (tracker *segmentTracker) leave(flows ...*pb.EnrichedFlow) {
+	now := time.Now()
+	tracker.flowsOut.Add(float64(len(flows)))
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for _, flow := range flows {
+		entered, ok := tracker.inFlight[flow]
+		if ok {
+			delete(tracker.inFlight, flow)
+		} else if oldest, found := tracker.popOldest(); found {
+			entered, ok = oldest.entered, true
+		}
+		if ok {
+			tracker.latency.Observe(now.Sub(entered).Seconds())
+		}
+	}
+	tracker.expire(now)
+}
+
+// Counts all flows still in the segment as dropped once it stopped.
+func (tracker *segmentTracker) stop() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.dropped.Add(float64(len(tracker.inFlight)))
+	tracker.inFlight = make(map[*pb.EnrichedFlow]time.Time)
+	tracker.queue = nil
+}
+
+// Removes the oldest flow still in the segment from the tracked flows.
+func (tracker *segmentTracker) popOldest() (trackedFlow, bool) {
+	for len(tracker.queue) > 0 {
+		oldest := tracker.queue[0]
+		tracker.queue = tracker.queue[1:]
+		if entered, ok := tracker.inFlight[oldest.flow]; ok && entered == oldest.entered {
+			delete(tracker.inFlight, oldest.flow)
+			return oldest, true
+		}
+	}
+	return trackedFlow{}, false
+}
+
+// Counts flows which did not leave the segment in time as dropped, and
+// forgets about flows which already left.
+func (tracker *segmentTracker) expire(now time.Time) {
+	for len(tracker.queue) > 0 {
+		oldest := tracker.queue[0]
+		if entered, ok := tracker.inFlight[oldest.flow]; ok && entered == oldest.entered {
+			if now.Sub(oldest.entered) < dropTimeout && len(tracker.queue) <= maxInFlight {
+				return
+			}
+			delete(tracker.inFlight, oldest.flow)
+			tracker.dropped.Inc()
+		}
+		tracker.queue = tracker.queue[1:]
+	}
+}
@@ -2,7 +2,10 @@
 package pipeline
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -20,6 +23,13 @@ type Pipeline struct {
 	Drop        chan *pb.EnrichedFlow
 	wg          *sync.WaitGroup
 	SegmentList []segments.Segment
+
+	out           chan *pb.EnrichedFlow // the same as Out
+	stages        []stage               // goroutines connecting the segments, set up by Start
+	gate          *gate                 // set by Instrument
+	batchSize     int                   // set by Batch
+	batchCapacity int                   // set by Batch
+	segmentReprs  []SegmentRepr         // set if built from a config
 }
 
 func (pipeline *Pipeline) GetInput() chan *pb.EnrichedFlow {
@@ -69,12 +79,63 @@ func (pipeline *Pipeline) Close() {
 		recover() // in case In is already closed
 		pipeline.wg.Wait()
 	}()
+	if pipeline.gate != nil {
+		pipeline.gate.open()
+	}
 	for _, segment := range pipeline.SegmentList {
 		segment.Close()
 	}
 	close(pipeline.In)
 }
 
+var (
+	// Returned by Shutdown if the pipeline did not drain in time. Any flows
+	// still in the pipeline are lost.
+	ErrShutdownTimeout = errors.New("timed out waiting for the pipeline to drain")
+	// Wrapped by errors of Shutdown and WriteError if segments failed to write
+	// some flows.
+	ErrFlowsLost = errors.New("flows lost")
+)
+
+// Shuts down a Pipeline like Close, but waits at most timeout for it to
+// drain. As closing In propagates through the pipeline in order, input
+// segments stop first, and every segment processes all flows it already
+// received before stopping, including output segments flushing their batches.
+// The returned error wraps ErrShutdownTimeout if the pipeline did not drain in
+// time, or ErrFlowsLost as returned by WriteError.
+func (pipeline *Pipeline) Shutdown(timeout time.Duration) error {
+	closed := make(chan struct{})
+	go func() {
+		pipeline.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return pipeline.WriteError()
+	case <-time.After(timeout):
+		return ErrShutdownTimeout
+	}
+}
+
+// Collects the errors of all segments implementing segments.WritingSegment,
+// including those in branches and parallel jobs, after the Pipeline has been
+// closed. The returned error wraps ErrFlowsLost, or is nil if all flows have
+// been written.
+func (pipeline *Pipeline) WriteError() error {
+	var errs []error
+	for _, segment := range flattenSegments(pipeline.SegmentList) {
+		if writing, ok := segment.(segments.WritingSegment); ok {
+			if err := writing.WriteError(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrFlowsLost, errors.Join(errs...))
+}
+
 // Initializes a new Pipeline object and then starts all segment goroutines
 // therein. Initialization includes creating any intermediate channels and
 // wiring up the segments in the segmentList with them.
@@ -88,13 +149,31 @@ func New(segmentList ...segments.Segment) *Pipeline {
 		channels[i+1] = make(chan *pb.EnrichedFlow)
 		segment.Rewire(channels[i], channels[i+1])
 	}
-	return &Pipeline{In: channels[0], Out: channels[len(channels)-1], wg: &sync.WaitGroup{}, SegmentList: segmentList}
+	return &Pipeline{In: channels[0], Out: channels[len(channels)-1], out: channels[len(channels)-1], wg: &sync.WaitGroup{}, SegmentList: segmentList}
 }
 
-// Starts the Pipeline by starting all segment goroutines therein.
+// Starts the Pipeline by starting all segment goroutines therein, and those
+// measuring them or passing batches between them if Instrument or Batch was
+// called.
 func (pipeline *Pipeline) Start() {
+	if pipeline.batchSize > 0 || pipeline.gate != nil {
+		pipeline.wire()
+	} // otherwise, the channels set up by New are used
 	for _, segment := range pipeline.SegmentList {
 		pipeline.wg.Add(1)
-		go segment.Run(pipeline.wg)
+		if batchSegment, ok := pipeline.batchSegment(segment); ok {
+			go batchSegment.RunBatch(pipeline.wg)
+		} else {
+			go segment.Run(pipeline.wg)
+		}
 	}
+	for _, stage := range pipeline.stages {
+		pipeline.wg.Add(1)
+		go stage.run(pipeline.wg)
+	}
+}
+
+// A goroutine connecting segments.
+type stage interface {
+	run(wg *sync.WaitGroup) // must close its output when its input is closed
 }
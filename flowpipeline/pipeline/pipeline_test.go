@@ -1,15 +1,26 @@
 package pipeline
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/BelWue/flowpipeline/segments/pass"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 
 	_ "github.com/BelWue/flowpipeline/segments/filter/drop"
 	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
 	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/output/json"
 	_ "github.com/BelWue/flowpipeline/segments/testing/generator"
 )
 
@@ -42,11 +53,14 @@ func TestPipelineTeardown(t *testing.T) {
 }
 
 func TestPipelineConfigSuccess(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: pass
   config:
     foo: $baz
     bar: $0`))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Type: 3}
 	fmsg := <-pipeline.Out
@@ -56,7 +70,7 @@ func TestPipelineConfigSuccess(t *testing.T) {
 }
 
 func Test_Branch_passthrough(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   if:
   - segment: flowfilter
@@ -73,6 +87,9 @@ func Test_Branch_passthrough(t *testing.T) {
       policy: drop
       fields: OutIf
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 6, InIf: 1, OutIf: 1}
 	fmsg := <-pipeline.Out
@@ -87,7 +104,7 @@ func Test_Branch_passthrough(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   if:
   - segment: generator
@@ -100,6 +117,9 @@ func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
       policy: drop
       fields: Bytes
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -113,11 +133,14 @@ func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_Then(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   then:
   - segment: generator
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -127,11 +150,14 @@ func Test_Branch_DeadlockFreeGeneration_Then(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_Else(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: branch
   else:
   - segment: generator
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -139,3 +165,516 @@ func Test_Branch_DeadlockFreeGeneration_Else(t *testing.T) {
 		<-pipeline.Out
 	}
 }
+
+func TestPipelineConfigErrors(t *testing.T) {
+	for config, expected := range map[string]string{
+		"- segment: [pass":                                  "error parsing configuration YAML: ",
+		"- segment: nonexistent":                            "segment 1 (nonexistent): could not find a segment named 'nonexistent'",
+		"- segment: pass\n- segment: dropfields\n  jobs: 2": "segment 2 (dropfields): the 'policy' parameter is required to be either 'keep' or 'drop'",
+		"- segment: branch\n  else:\n  - segment: pass\n  - segment: nonexistent": "segment 1 (branch), else segment 2 (nonexistent): could not find a segment named 'nonexistent'",
+	} {
+		pipeline, err := NewFromConfig([]byte(config))
+		if pipeline != nil || err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("[error] Expected error '%s', got '%v'.", expected, err)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	if problems := CheckConfig([]byte(`---
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+  then:
+  - segment: dropfields
+    config:
+      policy: keep
+      fields: Proto,Bytes
+- segment: pass
+  jobs: 4
+`)); len(problems) != 0 {
+		t.Errorf("[error] Valid config has problems: %v", problems)
+	}
+
+	problems := CheckConfig([]byte(`---
+- segment: pass
+- segment: nonexistent
+- segment: branch
+  then:
+  - segment: dropfields
+    config:
+      policy: keep
+      fields: Proto,Nonexistent
+  else:
+  - segment: dropfields
+    jobs: 2
+- segment: pass
+  if:
+  - segment: pass
+`))
+	expected := []string{
+		"segment 2 (nonexistent): could not find a segment named 'nonexistent'",
+		"segment 3 (branch), then segment 1 (dropfields): field 'Nonexistent' is not valid or can not be set",
+		"segment 3 (branch), else segment 1 (dropfields): the 'policy' parameter is required to be either 'keep' or 'drop'",
+		"segment 4 (pass): only branch segments can have 'if', 'then' and 'else' pipelines",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("[error] Expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.String() != expected[i] {
+			t.Errorf("[error] Got problem '%s', expected '%s'.", problem, expected[i])
+		}
+	}
+
+	if problems := CheckConfig([]byte("- segment: [pass")); len(problems) != 1 || problems[0].Segment != "" {
+		t.Errorf("[error] Expected a single problem for invalid YAML, got %v", problems)
+	}
+}
+
+func TestCheckConfig_noSideEffects(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flows.json")
+	if err := os.WriteFile(filename, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.Logger
+	defer func() {
+		log.Logger = logger
+	}()
+	output := &strings.Builder{}
+	log.Logger = zerolog.New(output)
+	problems := CheckConfig([]byte(fmt.Sprintf(`---
+- segment: json
+  config:
+    filename: %s
+- segment: json
+  config:
+    filename: %s
+`, filename, filepath.Join(filename, "missing", "flows.json"))))
+	if len(problems) != 1 || !strings.HasPrefix(problems[0].String(), "segment 2 (json): file specified in 'filename' is not accessible") {
+		t.Errorf("[error] Expected a single problem for the missing directory, got %v", problems)
+	}
+	if content, err := os.ReadFile(filename); err != nil || string(content) != "{}\n" {
+		t.Errorf("[error] Check changed the output file to '%s' (%v).", content, err)
+	}
+	log.Error().Msg("after the check")
+	if !strings.Contains(output.String(), "after the check") {
+		t.Error("[error] Check did not restore the global logger.")
+	}
+}
+
+// counts flows, used to test state inheritance on reloads
+type statefulCounter struct {
+	segments.BaseSegment
+	count int
+}
+
+func (segment statefulCounter) New(config map[string]string) segments.Segment {
+	return &statefulCounter{}
+}
+
+func (segment *statefulCounter) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.count += 1
+		segment.Out <- msg
+	}
+}
+
+func (segment *statefulCounter) InheritState(previous segments.Segment) {
+	segment.count = previous.(*statefulCounter).count
+}
+
+func init() {
+	segments.RegisterSegment("statefulcounter", &statefulCounter{})
+	segments.RegisterSegment("opencounter", &openCounter{})
+}
+
+// counts instances which have been built but not closed, used to test that
+// segments are closed if building a pipeline fails
+type openCounter struct {
+	pass.Pass
+}
+
+var openCounters atomic.Int64
+
+func (segment openCounter) New(config map[string]string) segments.Segment {
+	openCounters.Add(1)
+	return &openCounter{}
+}
+
+func (segment *openCounter) Close() {
+	openCounters.Add(-1)
+}
+
+func TestPipelineConfigErrors_closeSegments(t *testing.T) {
+	for _, config := range []string{
+		"- segment: opencounter\n- segment: nonexistent",
+		"- segment: opencounter\n  jobs: 3\n- segment: dropfields\n  jobs: 2",
+		"- segment: branch\n  if:\n  - segment: opencounter\n  then:\n  - segment: opencounter\n  else:\n  - segment: nonexistent",
+		"- segment: opencounter\n- segment: branch\n  then:\n  - segment: opencounter\n- segment: nonexistent",
+	} {
+		if _, err := NewFromConfig([]byte(config)); err == nil {
+			t.Fatalf("[error] Invalid config '%s' was accepted.", config)
+		}
+		if open := openCounters.Load(); open != 0 {
+			t.Errorf("[error] %d segments left open after failing to build '%s'.", open, config)
+			openCounters.Store(0)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte("- segment: statefulcounter\n- segment: statefulcounter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	for i := 0; i < 3; i++ {
+		pipeline.In <- &pb.EnrichedFlow{}
+		<-pipeline.Out
+	}
+	pipelines := []*Pipeline{pipeline}
+
+	if _, err := Reload(pipelines, []byte("- segment: nonexistent")); err == nil {
+		t.Fatal("[error] Reload accepted an invalid config.")
+	}
+	pipeline.In <- &pb.EnrichedFlow{} // keeps running
+	<-pipeline.Out
+	if value := testutilGauge(t, "flowpipeline_config_last_reload_successful"); value != 0 {
+		t.Errorf("[error] Failed reload reported as successful (%f).", value)
+	}
+
+	pipelines, err = Reload(pipelines, []byte(`---
+- segment: branch
+  then:
+  - segment: statefulcounter
+- segment: pass
+  jobs: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flattened := flattenSegments(pipelines[0].SegmentList)
+	if len(flattened) != 6 { // empty branches contain a pass segment
+		t.Fatalf("[error] Expected 6 segments after flattening, got %d.", len(flattened))
+	}
+	if counter := flattened[1].(*statefulCounter); counter.count != 4 {
+		t.Errorf("[error] Reloaded segment did not inherit the state of the first previous one, count is %d.", counter.count)
+	}
+	if value := testutilGauge(t, "flowpipeline_config_last_reload_successful"); value != 1 {
+		t.Errorf("[error] Successful reload reported as failed (%f).", value)
+	}
+	pipelines[0].Start()
+	pipelines[0].In <- &pb.EnrichedFlow{}
+	<-pipelines[0].Out
+	pipelines[0].Close()
+}
+
+// returns the value of a gauge in Registry
+func testutilGauge(t *testing.T, name string) float64 {
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("[error] Metric %s not found.", name)
+	return 0
+}
+
+// drops every other flow instead of writing it, and holds flows back until
+// release is closed if it is set
+type lossyOutput struct {
+	segments.BaseSegment
+	release chan struct{}
+	lost    *segments.LostFlows
+}
+
+func (segment lossyOutput) New(config map[string]string) segments.Segment {
+	return &lossyOutput{}
+}
+
+func (segment *lossyOutput) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	segment.lost = &segments.LostFlows{}
+	var received int
+	for msg := range segment.In {
+		received += 1
+		if received%2 == 0 {
+			segment.lost.Add(1, errors.New("dropped"))
+		}
+		segment.Out <- msg
+	}
+	if segment.release != nil {
+		<-segment.release
+	}
+}
+
+func (segment *lossyOutput) WriteError() error {
+	return segment.lost.Err()
+}
+
+func TestPipelineShutdown(t *testing.T) {
+	output := &lossyOutput{}
+	pipeline := New(&pass.Pass{}, output)
+	pipeline.Start()
+	pipeline.AutoDrain()
+	pipeline.In <- &pb.EnrichedFlow{}
+	if err := pipeline.Shutdown(time.Second); err != nil {
+		t.Errorf("[error] Shutdown reported an error without lost flows: %v", err)
+	}
+
+	parallel := &segments.ParallelizedSegment{}
+	parallel.AddSegment(&lossyOutput{})
+	pipeline = New(parallel)
+	pipeline.Start()
+	pipeline.AutoDrain()
+	pipeline.In <- &pb.EnrichedFlow{}
+	pipeline.In <- &pb.EnrichedFlow{}
+	err := pipeline.Shutdown(time.Second)
+	if !errors.Is(err, ErrFlowsLost) || !strings.Contains(err.Error(), "1 flows not written") {
+		t.Errorf("[error] Shutdown did not report the lost flow of a parallel job: %v", err)
+	}
+
+	output = &lossyOutput{release: make(chan struct{})}
+	defer close(output.release)
+	pipeline = New(output)
+	pipeline.Start()
+	pipeline.AutoDrain()
+	if err := pipeline.Shutdown(10 * time.Millisecond); !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("[error] Shutdown did not time out: %v", err)
+	}
+}
+
+func TestPipelineInstrument(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: flowfilter
+  config:
+    filter: proto tcp
+- segment: dropfields
+  config:
+    policy: keep
+    fields: Bytes
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Instrument()
+	pipeline.Start()
+	expectations := []struct {
+		metric, index, name string
+		value               float64
+	}{
+		{"flowpipeline_segment_flows_in_total", "1", "flowfilter", 2},
+		{"flowpipeline_segment_flows_out_total", "1", "flowfilter", 1},
+		{"flowpipeline_segment_flows_dropped_total", "1", "flowfilter", 1},
+		{"flowpipeline_segment_latency_seconds", "1", "flowfilter", 1},
+		{"flowpipeline_segment_flows_in_total", "2", "dropfields", 1},
+		{"flowpipeline_segment_flows_dropped_total", "2", "dropfields", 0},
+		{"flowpipeline_segment_latency_seconds", "2", "dropfields", 1}, // the new flow replaces the one passed in
+	}
+	before := make([]float64, len(expectations)) // in case of -count
+	for i, expected := range expectations {
+		before[i] = testutilSegmentMetric(t, expected.metric, expected.index, expected.name)
+	}
+
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6, Bytes: 42}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17, Bytes: 23}
+	if result := <-pipeline.Out; result.Bytes != 42 || result.Proto != 0 {
+		t.Errorf("[error] Instrumented pipeline returned the wrong flow: %v", result)
+	}
+	pipeline.Close()
+
+	for i, expected := range expectations {
+		if value := testutilSegmentMetric(t, expected.metric, expected.index, expected.name) - before[i]; value != expected.value {
+			t.Errorf("[error] Metric %s of segment %s (%s) is %f, expected %f.", expected.metric, expected.index, expected.name, value, expected.value)
+		}
+	}
+}
+
+// returns the value of a per-segment counter in Registry, or the sample count
+// of a histogram
+func testutilSegmentMetric(t *testing.T, name string, index string, segmentName string) float64 {
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["index"] == index && labels["name"] == segmentName {
+				if histogram := metric.GetHistogram(); histogram != nil {
+					return float64(histogram.GetSampleCount())
+				}
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	t.Fatalf("[error] Metric %s of segment %s (%s) not found.", name, index, segmentName)
+	return 0
+}
+
+func TestPipelinePause(t *testing.T) {
+	pipeline := New(&pass.Pass{})
+	if err := pipeline.Pause(); !errors.Is(err, ErrNotInstrumented) {
+		t.Errorf("[error] Pausing a pipeline which is not instrumented did not fail: %v", err)
+	}
+
+	pipeline.Instrument()
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{}
+	<-pipeline.Out
+	time.Sleep(10 * time.Millisecond) // lets all links wait for the next flow
+	if err := pipeline.Pause(); err != nil || !pipeline.Paused() {
+		t.Fatalf("[error] Pausing failed: %v", err)
+	}
+	go func() {
+		pipeline.In <- &pb.EnrichedFlow{Bytes: 42}
+	}()
+	select {
+	case <-pipeline.Out:
+		t.Fatal("[error] Paused pipeline passed a flow on.")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := pipeline.Resume(); err != nil || pipeline.Paused() {
+		t.Fatalf("[error] Resuming failed: %v", err)
+	}
+	if result := <-pipeline.Out; result.Bytes != 42 {
+		t.Errorf("[error] Resumed pipeline returned the wrong flow: %v", result)
+	}
+
+	pipeline.Pause()
+	pipeline.Close() // must not block
+}
+
+func TestPipelineBatch(t *testing.T) {
+	for _, instrumented := range []bool{false, true} {
+		pipeline, err := NewFromConfig([]byte(`---
+- segment: pass
+- segment: flowfilter
+  config:
+    filter: proto tcp
+- segment: pass
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline.Batch(4, 2)
+		if instrumented {
+			pipeline.Instrument()
+		}
+		pipeline.Start()
+		go func() {
+			for i := range 100 {
+				pipeline.In <- &pb.EnrichedFlow{Proto: 6 + 11*uint32(i%2), Bytes: uint64(i)}
+			}
+			pipeline.Close()
+		}()
+		var count uint64
+		for result := range pipeline.Out {
+			if result.Proto != 6 || result.Bytes != 2*count {
+				t.Errorf("[error] Batched pipeline returned the wrong flow: %v", result)
+			}
+			count++
+		}
+		if count != 50 {
+			t.Errorf("[error] Batched pipeline returned %d flows instead of 50.", count)
+		}
+	}
+}
+
+// Passes flows on like pass, but without native support for batches.
+type flowPass struct {
+	segments.BaseSegment
+}
+
+func (segment flowPass) New(config map[string]string) segments.Segment {
+	return &flowPass{}
+}
+
+func (segment *flowPass) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.Out <- msg
+	}
+}
+
+// Emits count flows like an input segment, then waits for the pipeline to
+// close.
+type flowSource struct {
+	segments.BaseSegment
+	count int
+}
+
+func (segment flowSource) New(config map[string]string) segments.Segment {
+	return &flowSource{}
+}
+
+func (segment *flowSource) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for range segment.count {
+		segment.Out <- &pb.EnrichedFlow{}
+	}
+	for range segment.In {
+	}
+}
+
+// Runs flows from an input segment through 19 more segments exchanging single
+// flows, batches, or alternately both with adapters in between.
+func BenchmarkPipeline_20Segments(b *testing.B) {
+	benchmarks := []struct {
+		name      string
+		batchSize int
+		segment   func(i int) segments.Segment
+	}{
+		{"flows", 0, func(i int) segments.Segment { return &pass.Pass{} }},
+		{"batches", 256, func(i int) segments.Segment { return &pass.Pass{} }},
+		{"batches_mixed", 256, func(i int) segments.Segment {
+			if i%2 == 0 {
+				return &flowPass{}
+			}
+			return &pass.Pass{}
+		}},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			segmentList := []segments.Segment{&flowSource{count: b.N}}
+			for i := range 19 {
+				segmentList = append(segmentList, benchmark.segment(i))
+			}
+			pipeline := New(segmentList...)
+			pipeline.Batch(benchmark.batchSize, 16)
+			b.ResetTimer()
+			pipeline.Start()
+			for range b.N {
+				<-pipeline.Out
+			}
+			b.StopTimer()
+			pipeline.Close()
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/controlflow/branch"
+)
+
+// Metrics about the pipelines themselves rather than the flows therein. The
+// flowpipeline binary serves them when started with the -metrics flag.
+var Registry = prometheus.NewRegistry()
+
+var (
+	configReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flowpipeline_config_reloads_total",
+			Help: "Number of config reloads by result, either success or failure.",
+		}, []string{"result"})
+	configLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flowpipeline_config_last_reload_successful",
+			Help: "Whether the last config reload succeeded.",
+		})
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "flowpipeline_config_last_reload_success_timestamp_seconds",
+			Help: "Time of the last successful config reload, or of the start if there was none.",
+		})
+)
+
+var (
+	lastReloadLock = &sync.RWMutex{}
+	lastReloadErr  error // nil if the last reload succeeded, for the admin API
+)
+
+func init() {
+	Registry.MustRegister(configReloads, configLastReloadSuccessful, configLastReloadSuccessTimestamp)
+	configReloads.WithLabelValues("success")
+	configReloads.WithLabelValues("failure")
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+}
+
+// Replaces running pipelines by as many new ones built from config. All new
+// pipelines are built before touching the old ones, and if this fails, those
+// built so far are closed, the error is returned and the old pipelines keep
+// running. Otherwise, the old
+// pipelines are closed, which drains them, segments of the new ones inherit
+// the state of their predecessors if they implement segments.StatefulSegment,
+// and the new pipelines are returned for the caller to start. The n-th segment
+// of a type in a new pipeline inherits from the n-th one in the old pipeline,
+// counting segments in branches and parallel jobs in config order.
+func Reload(pipelines []*Pipeline, config []byte) ([]*Pipeline, error) {
+	newPipelines, err := reload(pipelines, config)
+	recordReload(err)
+	return newPipelines, err
+}
+
+// Like Reload, but reads the config from a file first.
+func ReloadFile(pipelines []*Pipeline, path string) ([]*Pipeline, error) {
+	config, err := os.ReadFile(path)
+	if err != nil {
+		recordReload(err)
+		return nil, err
+	}
+	return Reload(pipelines, config)
+}
+
+func reload(pipelines []*Pipeline, config []byte) ([]*Pipeline, error) {
+	segmentReprs, err := SegmentReprsFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(segmentReprs) == 0 {
+		return nil, errors.New("the configuration does not contain any segments")
+	}
+	newPipelines := make([]*Pipeline, len(pipelines))
+	for i := range pipelines {
+		newPipelines[i], err = NewFromRepr(segmentReprs)
+		if err != nil {
+			for _, newPipeline := range newPipelines[:i] {
+				closeSegments(newPipeline.SegmentList)
+			}
+			return nil, err
+		}
+	}
+
+	for i, pipeline := range pipelines {
+		pipeline.Close()
+		newPipelines[i].inheritState(pipeline)
+	}
+	return newPipelines, nil
+}
+
+func recordReload(err error) {
+	lastReloadLock.Lock()
+	lastReloadErr = err
+	lastReloadLock.Unlock()
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+}
+
+func lastReloadError() error {
+	lastReloadLock.RLock()
+	defer lastReloadLock.RUnlock()
+	return lastReloadErr
+}
+
+func (pipeline *Pipeline) inheritState(previous *Pipeline) {
+	previousSegments := make(map[reflect.Type][]segments.Segment)
+	for _, segment := range flattenSegments(previous.SegmentList) {
+		segmentType := reflect.TypeOf(segment)
+		previousSegments[segmentType] = append(previousSegments[segmentType], segment)
+	}
+	for _, segment := range flattenSegments(pipeline.SegmentList) {
+		segmentType := reflect.TypeOf(segment)
+		candidates := previousSegments[segmentType]
+		if len(candidates) == 0 {
+			continue
+		}
+		previousSegments[segmentType] = candidates[1:]
+		if stateful, ok := segment.(segments.StatefulSegment); ok {
+			stateful.InheritState(candidates[0])
+		}
+	}
+}
+
+// Lists segments including those in branches and parallel jobs, in config
+// order.
+func flattenSegments(segmentList []segments.Segment) []segments.Segment {
+	var flattened []segments.Segment
+	for _, segment := range segmentList {
+		switch segment := segment.(type) {
+		case *segments.ParallelizedSegment:
+			flattened = append(flattened, flattenSegments(segment.Segments())...)
+			continue
+		case *branch.Branch:
+			condition, thenBranch, elseBranch := segment.Branches()
+			for _, branchPipeline := range []branch.Pipeline{condition, thenBranch, elseBranch} {
+				if branchPipeline, ok := branchPipeline.(*Pipeline); ok {
+					flattened = append(flattened, flattenSegments(branchPipeline.SegmentList)...)
+				}
+			}
+		}
+		flattened = append(flattened, segment)
+	}
+	return flattened
+}
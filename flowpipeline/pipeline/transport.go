@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// Makes Start connect segments implementing segments.BatchSegment by channels
+// holding up to capacity batches of up to size flows each, which saves a
+// channel operation per flow. All other segments keep exchanging single flows
+// over unbuffered channels, with an adapter splitting up batches for them or
+// collecting the flows they emit into batches where they meet a segment using
+// batches. Batches are never held back waiting for more flows, so they only
+// fill up under load. The In and Out channels of the Pipeline keep passing
+// single flows. A size of 0 disables batches. This must be called before
+// Start.
+func (pipeline *Pipeline) Batch(size int, capacity int) {
+	pipeline.batchSize = max(size, 0)
+	pipeline.batchCapacity = max(capacity, 0)
+}
+
+// Returns the segment as a BatchSegment if it should exchange batches.
+func (pipeline *Pipeline) batchSegment(segment segments.Segment) (segments.BatchSegment, bool) {
+	if pipeline.batchSize == 0 {
+		return nil, false
+	}
+	batchSegment, ok := segment.(segments.BatchSegment)
+	return batchSegment, ok
+}
+
+// The input or output of a segment.
+type endpoint struct {
+	batched bool
+	flows   chan *pb.EnrichedFlow   // unless batched
+	batches chan []*pb.EnrichedFlow // if batched
+}
+
+// Connects the segments according to Instrument and Batch, replacing the
+// channels set up by New.
+func (pipeline *Pipeline) wire() {
+	count := len(pipeline.SegmentList)
+	// indexed like the segment metrics, with the ends of the pipeline at 0 and count+1
+	ins, outs := make([]endpoint, count+2), make([]endpoint, count+2)
+	trackers := make([]*segmentTracker, count+2)
+	outs[0].flows = pipeline.In
+	ins[count+1].flows = pipeline.out
+	for i, segment := range pipeline.SegmentList {
+		_, batched := pipeline.batchSegment(segment)
+		ins[i+1].batched, outs[i+1].batched = batched, batched
+		if pipeline.gate != nil {
+			trackers[i+1] = newSegmentTracker(i+1, segments.SegmentName(segment))
+		}
+	}
+	for i := 1; i <= count+1; i++ {
+		pipeline.connect(&outs[i-1], &ins[i], trackers[i-1], trackers[i])
+	}
+	for i, segment := range pipeline.SegmentList {
+		if batchSegment, ok := pipeline.batchSegment(segment); ok {
+			batchSegment.RewireBatch(ins[i+1].batches, outs[i+1].batches)
+		} else {
+			segment.Rewire(ins[i+1].flows, outs[i+1].flows)
+		}
+	}
+}
+
+// Connects the output of a segment to the input of the next one, using the
+// same channel if both exchange the same kind of messages and the pipeline is
+// not instrumented, or else the stages needed in between.
+func (pipeline *Pipeline) connect(from *endpoint, to *endpoint, upstream *segmentTracker, downstream *segmentTracker) {
+	if from.batched == to.batched && pipeline.gate == nil {
+		if from.flows == nil && from.batches == nil {
+			from.flows, from.batches = to.flows, to.batches
+		}
+		pipeline.makeChannel(from, 0)
+		to.flows, to.batches = from.flows, from.batches
+		return
+	}
+	var mid chan []*pb.EnrichedFlow // between adapter and link
+	if pipeline.gate != nil && from.batched != to.batched {
+		mid = make(chan []*pb.EnrichedFlow, pipeline.batchCapacity)
+	}
+	switch {
+	case from.batched == to.batched:
+		pipeline.makeChannel(from, 0)
+		pipeline.makeChannel(to, 0)
+		if from.batched {
+			pipeline.stages = append(pipeline.stages, &link[[]*pb.EnrichedFlow]{from: from.batches, to: to.batches, gate: pipeline.gate, upstream: upstream, downstream: downstream})
+		} else {
+			pipeline.stages = append(pipeline.stages, &link[*pb.EnrichedFlow]{from: from.flows, to: to.flows, gate: pipeline.gate, upstream: upstream, downstream: downstream})
+		}
+	case to.batched:
+		// the buffer lets the segment run ahead while its previous flows are batched
+		pipeline.makeChannel(from, pipeline.batchSize)
+		pipeline.makeChannel(to, 0)
+		if mid == nil {
+			mid = to.batches
+		} else {
+			pipeline.stages = append(pipeline.stages, &link[[]*pb.EnrichedFlow]{from: mid, to: to.batches, gate: pipeline.gate, upstream: upstream, downstream: downstream})
+		}
+		pipeline.stages = append(pipeline.stages, &batcher{from: from.flows, to: mid, size: pipeline.batchSize})
+	default:
+		pipeline.makeChannel(from, 0)
+		pipeline.makeChannel(to, 0)
+		if mid == nil {
+			mid = from.batches
+		} else {
+			pipeline.stages = append(pipeline.stages, &link[[]*pb.EnrichedFlow]{from: from.batches, to: mid, gate: pipeline.gate, upstream: upstream, downstream: downstream})
+		}
+		pipeline.stages = append(pipeline.stages, &unbatcher{from: mid, to: to.flows})
+	}
+}
+
+// Creates the channel of an endpoint unless it already has one, with a buffer
+// of flowBuffer flows or the configured capacity of batches.
+func (pipeline *Pipeline) makeChannel(end *endpoint, flowBuffer int) {
+	switch {
+	case end.batched && end.batches == nil:
+		end.batches = make(chan []*pb.EnrichedFlow, pipeline.batchCapacity)
+	case !end.batched && end.flows == nil:
+		end.flows = make(chan *pb.EnrichedFlow, flowBuffer)
+	}
+}
+
+// Collects single flows into batches of up to size flows. A batch is sent as
+// soon as no further flow is available right away.
+type batcher struct {
+	from <-chan *pb.EnrichedFlow
+	to   chan<- []*pb.EnrichedFlow
+	size int
+}
+
+func (batcher *batcher) run(wg *sync.WaitGroup) {
+	defer func() {
+		close(batcher.to)
+		wg.Done()
+	}()
+	for msg := range batcher.from {
+		batch := make([]*pb.EnrichedFlow, 1, batcher.size)
+		batch[0] = msg
+	collect:
+		for len(batch) < batcher.size {
+			select {
+			case msg, ok := <-batcher.from:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, msg)
+			default:
+				break collect
+			}
+		}
+		batcher.to <- batch
+	}
+}
+
+// Splits batches into single flows.
+type unbatcher struct {
+	from <-chan []*pb.EnrichedFlow
+	to   chan<- *pb.EnrichedFlow
+}
+
+func (unbatcher *unbatcher) run(wg *sync.WaitGroup) {
+	defer func() {
+		close(unbatcher.to)
+		wg.Done()
+	}()
+	for batch := range unbatcher.from {
+		for _, msg := range batch {
+			unbatcher.to <- msg
+		}
+	}
+}
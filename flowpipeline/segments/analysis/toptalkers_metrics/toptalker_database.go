@@ -219,6 +219,7 @@ func (db *Database) Cleanup() {
 func (db *Database) StopTimers() {
 	var stopmessage struct{}
 	db.stopClockC <- stopmessage
+	db.stopCleanupC <- stopmessage
 }
 
 func (db *Database) GetAllRecords() <-chan struct {
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 	"github.com/BelWue/flowpipeline/pipeline/config"
 	"github.com/rs/zerolog/log"
 
@@ -20,7 +21,7 @@ type PrometheusCollector struct {
 }
 
 type PrometheusParams struct {
-	Endpoint     string // optional, default value is ":8080"
+	Endpoint     string // optional, default value is ":8080", or a path named after the segment on the admin server if it is enabled
 	MetricsPath  string // optional, default is "/metrics"
 	FlowdataPath string // optional, default is "/flowdata"
 }
@@ -234,8 +235,10 @@ func (e *PrometheusExporter) Initialize() {
 	e.MetaReg.MustRegister(e.dbSize)
 }
 
-// listen on given endpoint addr with Handler for metricPath and flowdataPath
-func (e *PrometheusExporter) ServeEndpoints(promParams *PrometheusParams) {
+// serve Handlers for metricPath and flowdataPath on the given endpoint, see
+// admin.ServeSegment, the returned function has to be called when the segment
+// stops
+func (e *PrometheusExporter) ServeEndpoints(promParams *PrometheusParams) func() {
 	mux := http.NewServeMux()
 	mux.Handle(promParams.MetricsPath, promhttp.HandlerFor(e.MetaReg, promhttp.HandlerOpts{}))
 	mux.Handle(promParams.FlowdataPath, promhttp.HandlerFor(e.FlowReg, promhttp.HandlerOpts{}))
@@ -244,16 +247,16 @@ func (e *PrometheusExporter) ServeEndpoints(promParams *PrometheusParams) {
 			<head><title>Flow Exporter</title></head>
 			<body>
 			<h1>Flow Exporter</h1>
-			<p><a href="` + promParams.MetricsPath + `">Metrics</p>
-			<p><a href="` + promParams.FlowdataPath + `">Flow Data</p>
+			<p><a href=".` + promParams.MetricsPath + `">Metrics</p>
+			<p><a href=".` + promParams.FlowdataPath + `">Flow Data</p>
 			</body>
 		</html>`))
 	})
-	go func() {
-		err := http.ListenAndServe(promParams.Endpoint, mux)
-		if err != nil {
-			log.Error().Err(err).Msgf("ToptalkersMetrics: Failed to start https endpoint on port %s", promParams.Endpoint)
-		}
-	}()
+	stop, err := admin.ServeSegment(promParams.Endpoint, mux)
+	if err != nil {
+		log.Error().Err(err).Msgf("ToptalkersMetrics: Failed to start https endpoint on port %s", promParams.Endpoint)
+		return func() {}
+	}
 	log.Info().Msgf("ToptalkersMetrics: Enabled metrics on %s and %s, listening at %s.", promParams.MetricsPath, promParams.FlowdataPath, promParams.Endpoint)
+	return stop
 }
@@ -3,6 +3,7 @@ package toptalkers_metrics
 import (
 	"sync"
 
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/rs/zerolog/log"
 )
@@ -24,7 +25,8 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 		return nil
 	}
 	if config["endpoint"] == "" {
-		log.Info().Msg("ToptalkersMetrics: Missing configuration parameter 'endpoint'. Using default port ':8080'")
+		newsegment.Endpoint = admin.DefaultEndpoint("/toptalkers_metrics")
+		log.Info().Msgf("ToptalkersMetrics: Missing configuration parameter 'endpoint'. Using default '%s'", newsegment.Endpoint)
 	} else {
 		newsegment.Endpoint = config["endpoint"]
 	}
@@ -43,18 +45,19 @@ func (segment ToptalkersMetrics) New(config map[string]string) segments.Segment
 }
 
 func (segment *ToptalkersMetrics) Run(wg *sync.WaitGroup) {
-	defer func() {
-		close(segment.Out)
-		wg.Done()
-	}()
-
 	var promExporter = PrometheusExporter{}
 
 	database := NewDatabase(segment.PrometheusMetricsParams, &promExporter)
 	collector := NewPrometheusCollector([]*Database{&database})
 	promExporter.Initialize()
 	promExporter.FlowReg.MustRegister(collector)
-	promExporter.ServeEndpoints(&segment.PrometheusParams)
+	stopServing := promExporter.ServeEndpoints(&segment.PrometheusParams)
+	defer func() {
+		stopServing()
+		database.StopTimers()
+		close(segment.Out)
+		wg.Done()
+	}()
 
 	go database.Clock()
 	go database.Cleanup()
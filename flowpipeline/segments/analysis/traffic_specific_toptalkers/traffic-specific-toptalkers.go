@@ -9,6 +9,7 @@ import (
 
 	"github.com/BelWue/flowfilter/parser"
 	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 	"github.com/BelWue/flowpipeline/pipeline/config"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/BelWue/flowpipeline/segments/analysis/toptalkers_metrics"
@@ -35,7 +36,8 @@ func (segment TrafficSpecificToptalkers) New(config map[string]string) segments.
 	newSegment := &TrafficSpecificToptalkers{}
 	newSegment.InitDefaultPrometheusParams()
 	if config["endpoint"] == "" {
-		log.Info().Msg("ToptalkersMetrics: Missing configuration parameter 'endpoint'. Using default port \":8080\"")
+		newSegment.Endpoint = admin.DefaultEndpoint("/traffic_specific_toptalkers")
+		log.Info().Msgf("ToptalkersMetrics: Missing configuration parameter 'endpoint'. Using default \"%s\"", newSegment.Endpoint)
 	} else {
 		newSegment.Endpoint = config["endpoint"]
 	}
@@ -99,7 +101,9 @@ func (segment *TrafficSpecificToptalkers) metricFromDefinition(definition *confi
 
 func (segment *TrafficSpecificToptalkers) Run(wg *sync.WaitGroup) {
 	var allDatabases *[]*toptalkers_metrics.Database
+	stopServing := func() {}
 	defer func() {
+		stopServing()
 		close(segment.Out)
 		for _, db := range *allDatabases {
 			db.StopTimers()
@@ -113,7 +117,7 @@ func (segment *TrafficSpecificToptalkers) Run(wg *sync.WaitGroup) {
 	allDatabases = initDatabasesAndCollector(promExporter, segment)
 
 	//start timers
-	promExporter.ServeEndpoints(&segment.PrometheusParams)
+	stopServing = promExporter.ServeEndpoints(&segment.PrometheusParams)
 	for _, db := range *allDatabases {
 		go db.Clock()
 		go db.Cleanup()
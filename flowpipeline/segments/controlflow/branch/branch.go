@@ -1,6 +1,7 @@
 package branch
 
 import (
+	"fmt"
 	"strconv"
 	"sync"
 
@@ -29,15 +30,19 @@ type Branch struct {
 }
 
 func (segment Branch) New(config map[string]string) segments.Segment {
+	return segments.NewFromConstructor("Branch", segment, config)
+}
+
+func (segment Branch) Construct(config map[string]string) (segments.Segment, error) {
 	bypassMessages := false
 	if config["bypass-messages"] != "" {
 		b, err := strconv.ParseBool(config["bypass-messages"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Branch: Failed to parse bypass-messages config option")
+			return nil, fmt.Errorf("failed to parse bypass-messages config option: %w", err)
 		}
 		bypassMessages = b
 	}
-	return &Branch{bypassMessages: bypassMessages}
+	return &Branch{bypassMessages: bypassMessages}, nil
 }
 
 func (segment *Branch) ImportBranches(condition interface{}, then_branch interface{}, else_branch interface{}) {
@@ -46,6 +51,11 @@ func (segment *Branch) ImportBranches(condition interface{}, then_branch interfa
 	segment.else_branch = else_branch.(Pipeline)
 }
 
+// Returns the condition, then and else pipelines imported by ImportBranches.
+func (segment *Branch) Branches() (condition Pipeline, then_branch Pipeline, else_branch Pipeline) {
+	return segment.condition, segment.then_branch, segment.else_branch
+}
+
 func (segment *Branch) Run(wg *sync.WaitGroup) {
 	if segment.condition == nil || segment.then_branch == nil || segment.else_branch == nil {
 		log.Error().Msg("Branch: Uninitialized branches. This is expected during standalone testing of this package. The actual test is done as part of the pipeline package, as this segment embeds further pipelines.")
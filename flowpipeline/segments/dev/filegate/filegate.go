@@ -1,5 +1,8 @@
-// Serves as a template for new segments and forwards flows, otherwise does
-// nothing.
+// Holds back flows while a gate file exists, otherwise forwards them.
+//
+// Deprecated: start flowpipeline with the -admin flag and pause pipelines
+// using POST /pipelines/{index}/pause instead, which does not need a segment
+// in the config.
 package filegate
 
 import (
@@ -19,17 +22,22 @@ type Filegate struct {
 }
 
 // Every Segment must implement a New method, even if there isn't any config
-// it is interested in.
+// it is interested in. Segments implementing Construct can use it for New.
 func (segment *Filegate) New(config map[string]string) segments.Segment {
-	var ()
+	return segments.NewFromConstructor("Filegate", segment, config)
+}
+
+// Optionally, Segments implement Construct to return configuration errors.
+func (segment *Filegate) Construct(config map[string]string) (segments.Segment, error) {
+	newsegment := &Filegate{}
 	if config["filename"] != "" {
-		segment.filename = config["filename"]
-		log.Info().Msgf("Filegate: gate file is %s", segment.filename)
+		newsegment.filename = config["filename"]
+		log.Info().Msgf("Filegate: gate file is %s", newsegment.filename)
 	} else {
-		log.Fatal().Msgf("Filegate: No filename config option")
+		return nil, errors.New("no filename config option")
 	}
 	// do config stuff here, add it to fields maybe
-	return segment
+	return newsegment, nil
 }
 
 func checkFileExists(filename string) bool {
@@ -4,6 +4,7 @@ package clickhouse_segment
 
 import (
 	"database/sql"
+	"fmt"
 	"math"
 	"net"
 	"strconv"
@@ -24,6 +25,7 @@ type Clickhouse struct {
 	db              *sql.DB
 	createStatement string
 	insertStatement string
+	lost            *segments.LostFlows
 
 	DSN       string // required
 	Preset    string // optional, what schema to use, currently only the option and default is "flowhouse"
@@ -129,13 +131,59 @@ func (segment *Clickhouse) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
+	segment.open()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+	for msg := range segment.In {
+		unsaved = segment.save(append(unsaved, msg))
+		segment.Out <- msg
+	}
+	if err := segment.bulkInsert(unsaved); err != nil {
+		log.Error().Err(err).Msg("Clickhouse: Bulk insert of the final batch failed")
+	}
+}
+
+// Like Run, but for pipelines using the batched transport, see
+// segments.BatchSegment.
+func (segment *Clickhouse) RunBatch(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.BatchOut)
+		wg.Done()
+	}()
+	segment.open()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+	for batch := range segment.BatchIn {
+		unsaved = segment.save(append(unsaved, batch...))
+		segment.BatchOut <- batch
+	}
+	if err := segment.bulkInsert(unsaved); err != nil {
+		log.Error().Err(err).Msg("Clickhouse: Bulk insert of the final batch failed")
+	}
+}
 
+// Inserts the unsaved flows once there are at least BatchSize of them, and
+// returns those still unsaved.
+func (segment *Clickhouse) save(unsaved []*pb.EnrichedFlow) []*pb.EnrichedFlow {
+	if len(unsaved) < segment.BatchSize {
+		return unsaved
+	}
+	err := segment.bulkInsert(unsaved)
+	if err != nil {
+		log.Error().Err(err).Msg("Clickhouse: Bulk insert failed")
+	}
+	return []*pb.EnrichedFlow{}
+}
+
+// Opens the database and creates the table if needed.
+func (segment *Clickhouse) open() {
 	var err error
 	segment.db, err = sql.Open("clickhouse", segment.DSN)
 	if err != nil {
 		log.Panic().Err(err).Msg("Clickhouse: Could not open database with error")
 	}
-	defer segment.db.Close()
 
 	tx, err := segment.db.Begin()
 	if err != nil {
@@ -147,20 +195,15 @@ func (segment *Clickhouse) Run(wg *sync.WaitGroup) {
 	}
 	tx.Commit()
 
-	var unsaved []*pb.EnrichedFlow
+	segment.lost = &segments.LostFlows{}
+}
 
-	for msg := range segment.In {
-		unsaved = append(unsaved, msg)
-		if len(unsaved) >= segment.BatchSize {
-			err := segment.bulkInsert(unsaved)
-			if err != nil {
-				log.Error().Err(err).Msg("Clickhouse: Bulk insert failed")
-			}
-			unsaved = []*pb.EnrichedFlow{}
-		}
-		segment.Out <- msg
+// Reports flows which could not be inserted, see segments.WritingSegment.
+func (segment *Clickhouse) WriteError() error {
+	if err := segment.lost.Err(); err != nil {
+		return fmt.Errorf("clickhouse: %w", err)
 	}
-	segment.bulkInsert(unsaved)
+	return nil
 }
 
 func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) error {
@@ -169,8 +212,11 @@ func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) e
 	}
 	tx, err := segment.db.Begin()
 	if err != nil {
-		log.Error().Err(err).Msgf("Clickhouse: Error starting transaction for current batch of %d flows", len(unsavedFlows))
+		segment.lost.Add(len(unsavedFlows), err)
+		return fmt.Errorf("error starting transaction for current batch of %d flows: %w", len(unsavedFlows), err)
 	}
+	var failed int
+	var insertErr error
 	for _, msg := range unsavedFlows {
 		var srcPfx, dstPfx net.IP
 		if msg.IsIPv6() {
@@ -204,10 +250,20 @@ func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) e
 		}
 		_, err := tx.Exec(segment.insertStatement, valueArgs...)
 		if err != nil {
-			log.Error().Err(err).Msg("Clickhouse: Error inserting flow into transaction")
+			failed += 1
+			if insertErr == nil {
+				insertErr = err
+			}
 		}
 	}
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		segment.lost.Add(len(unsavedFlows), err)
+		return fmt.Errorf("error committing batch of %d flows: %w", len(unsavedFlows), err)
+	}
+	if failed > 0 {
+		segment.lost.Add(failed, insertErr)
+		return fmt.Errorf("error inserting %d of %d flows: %w", failed, len(unsavedFlows), insertErr)
+	}
 	return nil
 }
 
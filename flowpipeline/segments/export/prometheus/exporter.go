@@ -8,6 +8,8 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 )
 
 // Exporter provides export features to Prometheus
@@ -80,8 +82,10 @@ func (e *Exporter) ResetCounter() {
 	e.MetaReg.MustRegister(e.kafkaMessageCount)
 }
 
-// listen on given endpoint addr with Handler for metricPath and flowdataPath
-func (e *Exporter) ServeEndpoints(segment *Prometheus) {
+// serve Handlers for metricPath and flowdataPath on the given endpoint, see
+// admin.ServeSegment, the returned function has to be called when the segment
+// stops
+func (e *Exporter) ServeEndpoints(segment *Prometheus) func() {
 	mux := http.NewServeMux()
 	mux.Handle(segment.MetricsPath, promhttp.HandlerFor(e.MetaReg, promhttp.HandlerOpts{}))
 	mux.Handle(segment.FlowdataPath, promhttp.HandlerFor(e.FlowReg, promhttp.HandlerOpts{}))
@@ -90,18 +94,18 @@ func (e *Exporter) ServeEndpoints(segment *Prometheus) {
 			<head><title>Flow Exporter</title></head>
 			<body>
 			<h1>Flow Exporter</h1>
-			<p><a href="` + segment.MetricsPath + `">Metrics</p>
-			<p><a href="` + segment.FlowdataPath + `">Flow Data</p>
+			<p><a href=".` + segment.MetricsPath + `">Metrics</p>
+			<p><a href=".` + segment.FlowdataPath + `">Flow Data</p>
 			</body>
 		</html>`))
 	})
-	go func() {
-		err := http.ListenAndServe(segment.Endpoint, mux)
-		if err != nil {
-			log.Error().Err(err).Msgf("Prometheus Exporter: Failed to start https endpoint on port %s", segment.Endpoint)
-		}
-	}()
+	stop, err := admin.ServeSegment(segment.Endpoint, mux)
+	if err != nil {
+		log.Error().Err(err).Msgf("Prometheus Exporter: Failed to start https endpoint on port %s", segment.Endpoint)
+		return func() {}
+	}
 	log.Info().Msgf("Prometheus Exporter: Enabled metrics on %s and %s, listening at %s.", segment.MetricsPath, segment.FlowdataPath, segment.Endpoint)
+	return stop
 }
 
 func (e *Exporter) Increment(bytes uint64, packets uint64, labelset prometheus.Labels) {
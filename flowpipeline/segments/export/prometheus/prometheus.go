@@ -3,6 +3,9 @@
 // The endoint field can be configured:
 // <host>:8080/flowdata
 // <host>:8080/metrics
+// or, if the admin server is enabled, by default:
+// <admin>/prometheus/flowdata
+// <admin>/prometheus/metrics
 // The labels to be exported can be set in the configuration.
 // Default labels are:
 //
@@ -28,13 +31,14 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/go-co-op/gocron/v2"
 )
 
 type Prometheus struct {
 	segments.BaseSegment
-	Endpoint          string         // optional, default value is ":8080"
+	Endpoint          string         // optional, default value is ":8080", or "/prometheus" on the admin server if it is enabled
 	MetricsPath       string         // optional, default is "/metrics"
 	FlowdataPath      string         // optional, default is "/flowdata"
 	Labels            []string       // optional, list of labels to be exported
@@ -46,9 +50,9 @@ type Prometheus struct {
 }
 
 func (segment Prometheus) New(config map[string]string) segments.Segment {
-	var endpoint string = ":8080"
+	var endpoint string = admin.DefaultEndpoint("/prometheus")
 	if config["endpoint"] == "" {
-		log.Info().Msg("Prometheus: Missing configuration parameter 'endpoint'. Using default port ':8080'")
+		log.Info().Msgf("Prometheus: Missing configuration parameter 'endpoint'. Using default '%s'", endpoint)
 	} else {
 		endpoint = config["endpoint"]
 	}
@@ -121,13 +125,17 @@ func (segment Prometheus) New(config map[string]string) segments.Segment {
 }
 
 func (segment *Prometheus) Run(wg *sync.WaitGroup) {
+	var stopServing func()
 	defer func() {
+		if stopServing != nil {
+			stopServing()
+		}
 		close(segment.Out)
 		wg.Done()
 	}()
 
 	segment.PromExporter = &Exporter{}
-	segment.initializeExporter(segment.PromExporter)
+	stopServing = segment.initializeExporter(segment.PromExporter)
 	if segment.VacuumInterval != nil {
 		segment.AddVacuumCronJob(segment.PromExporter)
 	}
@@ -167,9 +175,9 @@ func (segment *Prometheus) Run(wg *sync.WaitGroup) {
 	}
 }
 
-func (segment *Prometheus) initializeExporter(exporter *Exporter) {
+func (segment *Prometheus) initializeExporter(exporter *Exporter) func() {
 	exporter.Initialize(segment.Labels)
-	exporter.ServeEndpoints(segment)
+	return exporter.ServeEndpoints(segment)
 }
 
 func (segment *Prometheus) AddVacuumCronJob(promExporter *Exporter) {
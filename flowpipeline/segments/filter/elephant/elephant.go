@@ -22,6 +22,9 @@ type Elephant struct {
 	Exact      bool // optional, default is false, determines whether to use percentiles that are exact or generated using the P-square estimation algorithm
 	Window     int  // optional, default is 300, sets the number of seconds used as a sliding window size
 	RampupTime int  // optional, default is 0, sets the time to wait for analyzing flows. All flows within this Timerange are dropped.
+
+	window    *rolling.TimePolicy
+	rampupEnd time.Time
 }
 
 func (segment Elephant) New(config map[string]string) segments.Segment {
@@ -115,13 +118,12 @@ func (segment *Elephant) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	var inRampup bool
-	var rampupEnd time.Time
-	if segment.RampupTime > 0 {
-		inRampup = true
-		rampupEnd = time.Now().Add(time.Duration(segment.RampupTime) * time.Second)
+	if segment.window == nil {
+		segment.window = rolling.NewTimePolicy(rolling.NewWindow(segment.Window), time.Second)
+		segment.rampupEnd = time.Now().Add(time.Duration(segment.RampupTime) * time.Second)
 	}
-	var window = rolling.NewTimePolicy(rolling.NewWindow(segment.Window), time.Second)
+	window, rampupEnd := segment.window, segment.rampupEnd
+	inRampup := time.Now().Before(rampupEnd)
 	for msg := range segment.In {
 		// always determine a flow's aspect to append to the window
 		var aspect float64
@@ -176,6 +178,15 @@ func (segment *Elephant) Run(wg *sync.WaitGroup) {
 	}
 }
 
+// Continues with the window of a previous elephant segment with the same
+// window size and aspect after a config reload, including its ramp up.
+func (segment *Elephant) InheritState(previous segments.Segment) {
+	if previous, ok := previous.(*Elephant); ok && previous.window != nil && previous.Window == segment.Window && previous.Aspect == segment.Aspect {
+		segment.window = previous.window
+		segment.rampupEnd = previous.rampupEnd
+	}
+}
+
 func init() {
 	segment := &Elephant{}
 	segments.RegisterSegment("elephant", segment)
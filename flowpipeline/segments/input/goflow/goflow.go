@@ -43,6 +43,10 @@ type Goflow struct {
 	QueueSize  int       //default is 1000000
 	NumSockets int       //default is 1
 	goflow_in  chan *pb.EnrichedFlow
+
+	receivers     []*utils.UDPReceiver
+	receiversLock *sync.Mutex
+	stopped       bool // guarded by receiversLock, set once Run stops the receivers
 }
 
 func (segment Goflow) New(config map[string]string) segments.Segment {
@@ -94,8 +98,9 @@ func (segment Goflow) New(config map[string]string) segments.Segment {
 	}
 
 	return &Goflow{
-		Listen:  listenAddressesSlice,
-		Workers: workers,
+		Listen:        listenAddressesSlice,
+		Workers:       workers,
+		receiversLock: &sync.Mutex{},
 	}
 }
 
@@ -119,6 +124,7 @@ func (segment *Goflow) Run(wg *sync.WaitGroup) {
 			segment.Out <- msg
 		case msg, ok := <-segment.In:
 			if !ok {
+				segment.stopReceivers()
 				return
 			}
 			segment.Out <- msg
@@ -126,6 +132,45 @@ func (segment *Goflow) Run(wg *sync.WaitGroup) {
 	}
 }
 
+// Stops all goflow receivers, releasing their ports for a reloaded pipeline,
+// and forwards the flows they are still decoding meanwhile.
+func (segment *Goflow) stopReceivers() {
+	segment.receiversLock.Lock()
+	segment.stopped = true
+	receivers := segment.receivers
+	segment.receiversLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, recv := range receivers {
+			recv.Stop()
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case msg, ok := <-segment.goflow_in:
+			if !ok {
+				segment.goflow_in = nil
+				continue
+			}
+			segment.Out <- msg
+		case <-done:
+			return
+		}
+	}
+}
+
+func (segment *Goflow) addReceiver(recv *utils.UDPReceiver) {
+	segment.receiversLock.Lock()
+	defer segment.receiversLock.Unlock()
+	if segment.stopped {
+		go recv.Stop()
+		return
+	}
+	segment.receivers = append(segment.receivers, recv)
+}
+
 type channelDriver struct {
 	out chan *pb.EnrichedFlow
 }
@@ -234,6 +279,7 @@ func (segment *Goflow) startGoFlow(transport transport.TransportInterface) {
 			if err != nil {
 				log.Fatal().Err(err).Msg("Goflow: Failed starting goflow receiver")
 			}
+			segment.addReceiver(recv)
 
 		}(listenAddrUrl)
 	}
@@ -4,6 +4,7 @@ package replay
 import (
 	"database/sql"
 	"fmt"
+	"net"
 	"reflect"
 	"strconv"
 	"strings"
@@ -92,30 +93,76 @@ func (segment *Replay) Run(wg *sync.WaitGroup) {
 }
 
 func readFromDB(db *sql.DB) ([]*pb.EnrichedFlow, error) {
-	rows, err := db.Query("SELECT * FROM flows")
+	columns, err := FlowColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	flows := make([]*pb.EnrichedFlow, 0)
+	err = ScanFlows(db, fmt.Sprintf("SELECT %s FROM flows", strings.Join(columns, ",")), nil, func(flow *pb.EnrichedFlow) error {
+		flows = append(flows, flow)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return flows, nil
+}
+
+// FlowColumns returns the columns of the flows table in a database created by
+// the `sqlite` segment which hold a field of EnrichedFlow. Depending on its
+// 'fields' parameter and version, the `sqlite` segment stores a subset of
+// them.
+func FlowColumns(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('flows')")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	flows := make([]*pb.EnrichedFlow, 0)
+	t := reflect.TypeOf(pb.EnrichedFlow{})
+	var columns []string
 	for rows.Next() {
-		flow := &pb.EnrichedFlow{}
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if field, ok := t.FieldByName(name); ok && field.IsExported() {
+			columns = append(columns, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no table 'flows' with flow fields")
+	}
+	return columns, nil
+}
 
-		v := reflect.ValueOf(flow).Elem()
-		t := reflect.TypeOf(pb.EnrichedFlow{})
+// ScanFlows runs query against a database created by the `sqlite` segment and
+// calls handle for every resulting flow until it returns an error. Columns are
+// assigned to the EnrichedFlow fields of the same name, fields without a
+// column are left unset and other columns are ignored.
+func ScanFlows(db *sql.DB, query string, args []any, handle func(*pb.EnrichedFlow) error) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-		exportedFields := make([]string, 0, v.NumField())
-		for _, field := range reflect.VisibleFields(t) {
-			if !field.IsExported() {
-				continue
-			}
-			exportedFields = append(exportedFields, field.Name)
-		}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		flow := &pb.EnrichedFlow{}
+		v := reflect.ValueOf(flow).Elem()
 
-		fieldPointers := make([]any, len(exportedFields))
-		var typ, bgpCommunities, asPath, mplsTtl, mplsLabel, mplsIp, layerStack, layerSize, ipv6RoutingHeaderAddresses, srcAddrAnon, dstAddrAnon, samplerAddrAnon, nextHopAnon, validationStatus, normalized, remoteAddr, srcAsPath, dstAsPath string
-		for i, fieldName := range exportedFields {
+		fieldPointers := make([]any, len(columns))
+		var typ, bgpCommunities, asPath, mplsTtl, mplsLabel, mplsIp, layerStack, layerSize, ipv6RoutingHeaderAddresses, srcAddrAnon, dstAddrAnon, samplerAddrAnon, nextHopAnon, validationStatus, normalized, remoteAddr, srcAsPath, dstAsPath, eventCategories, blacklists, matchedSide string
+		addrs := make(map[string]*string) // address fields, stored in their text form
+		for i, fieldName := range columns {
 			switch fieldName {
 			case "Type":
 				fieldPointers[i] = &typ
@@ -153,13 +200,26 @@ func readFromDB(db *sql.DB) ([]*pb.EnrichedFlow, error) {
 				fieldPointers[i] = &srcAsPath
 			case "DstAsPath":
 				fieldPointers[i] = &dstAsPath
+			case "EventCategories":
+				fieldPointers[i] = &eventCategories
+			case "Blacklists":
+				fieldPointers[i] = &blacklists
+			case "MatchedSide":
+				fieldPointers[i] = &matchedSide
+			case "SamplerAddress", "SrcAddr", "DstAddr", "NextHop", "BgpNextHop", "MplsLabelIp":
+				addrs[fieldName] = new(string)
+				fieldPointers[i] = addrs[fieldName]
 			default:
-				fieldPointers[i] = v.FieldByName(fieldName).Addr().Interface()
+				if field, ok := v.Type().FieldByName(fieldName); ok && field.IsExported() {
+					fieldPointers[i] = v.FieldByIndex(field.Index).Addr().Interface()
+				} else {
+					fieldPointers[i] = new(any) // not a flow field
+				}
 			}
 		}
 
 		if err := rows.Scan(fieldPointers...); err != nil {
-			log.Error().Err(err).Msg("Failed to scan row from database. Probably because the database does only contain a subset of all columns.")
+			log.Error().Err(err).Msg("Failed to scan row from database.")
 			continue
 		}
 
@@ -182,16 +242,23 @@ func readFromDB(db *sql.DB) ([]*pb.EnrichedFlow, error) {
 		flow.RemoteAddr = pb.EnrichedFlow_RemoteAddrType(pb.EnrichedFlow_RemoteAddrType_value[remoteAddr])
 		flow.SrcAsPath, err = parseUint32Slice(srcAsPath)
 		flow.DstAsPath, err = parseUint32Slice(dstAsPath)
+		flow.EventCategories, err = parseStringSlice(eventCategories)
+		flow.Blacklists, err = parseStringSlice(blacklists)
+		flow.MatchedSide = pb.EnrichedFlow_MatchedSideType(pb.EnrichedFlow_MatchedSideType_value[matchedSide])
+		for fieldName, addr := range addrs {
+			v.FieldByName(fieldName).SetBytes(parseAddr(*addr))
+		}
 
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to parse row data from database.")
 			continue
 		}
 
-		flows = append(flows, flow)
+		if err := handle(flow); err != nil {
+			return err
+		}
 	}
-
-	return flows, nil
+	return rows.Err()
 }
 
 func replay(flows []*pb.EnrichedFlow, respectTiming bool, out chan *pb.EnrichedFlow) {
@@ -219,6 +286,9 @@ func init() {
 }
 
 func parseSlice[T any](s string, elementHandler func(string) (T, error)) ([]T, error) {
+	if s == "" {
+		return nil, nil // the column is missing
+	}
 	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
 		return nil, fmt.Errorf("invalid format: string does not have surrounding brackets")
 	}
@@ -248,6 +318,22 @@ func parseUint32Slice(s string) ([]uint32, error) {
 	})
 }
 
+func parseStringSlice(s string) ([]string, error) {
+	return parseSlice(s, func(elem string) (string, error) {
+		return elem, nil
+	})
+}
+
+// parseAddr converts an address in text form back into its 4 or 16 byte
+// form, empty or invalid addresses result in nil.
+func parseAddr(s string) []byte {
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 func parseByteSlices(s string) ([][]byte, error) {
 	return parseSlice(s, func(elemOuter string) ([]byte, error) {
 		return parseSlice(elemOuter, func(elemInner string) (byte, error) {
@@ -1,25 +1,305 @@
 package matching
 
 import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 )
 
+// Alert turns flows tagged by the matching segment into alert events. Flows
+// for the same tag, indicator and local host are aggregated within Window, so
+// that every such combination is alerted once when first seen and once more
+// with the totals when the window ends. All flows are passed on unchanged.
 type Alert struct {
 	segments.BaseSegment
+	Window    time.Duration // optional, default is 5m, time to aggregate flows for the same indicator and local host
+	RateLimit int           // optional, default is 0 which means unlimited, maximum number of alerts per minute
+	Tids      []uint32      // optional, default is all tagged flows, the tag IDs to alert on
+	Sinks     []string      // optional, default is "stdout", where to deliver alerts, see AlertSink
+
+	sinks   []AlertSink
+	started *atomic.Bool
+}
+
+// An AlertEvent describes all flows between an indicator and a local host
+// seen during one window.
+type AlertEvent struct {
+	Status     string    `json:"status"` // "new" when first seen, "update" with the totals at the end of the window
+	Tid        uint32    `json:"tid"`
+	Note       string    `json:"note,omitempty"`
+	Indicator  string    `json:"indicator"` // the matched list prefix, or the remote address if unknown
+	RemoteAddr string    `json:"remote_addr"`
+	LocalAddr  string    `json:"local_addr"`
+	RepScore   float64   `json:"rep_score,omitempty"`
+	Severity   string    `json:"severity,omitempty"` // set for flows tagged by the watchlist segment
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Flows      uint64    `json:"flows"`
+	Bytes      uint64    `json:"bytes"`
+	Packets    uint64    `json:"packets"`
+}
+
+type alertKey struct {
+	tid       uint32
+	indicator string
+	local     string
 }
 
-// func (segment Alert) New(config map[string]string) segments.Segment {
-// 	return &Alert{}
-// }
+type alertState struct {
+	event     AlertEvent
+	expires   time.Time
+	sentFlows uint64 // number of flows covered by the last alert sent
+}
 
-// func (segment Alert) Run(wg *sync.WaitGroup) {
-// 	defer func() {
-// 		close(segment.Out)
-// 		wg.Done()
-// 	}()
-// }
+// New implements segments.Segment.
+func (segment Alert) New(config map[string]string) segments.Segment {
+	newsegment := &Alert{
+		Window:  5 * time.Minute,
+		Sinks:   []string{"stdout"},
+		started: &atomic.Bool{},
+	}
+	if config["window"] != "" {
+		window, err := time.ParseDuration(config["window"])
+		if err != nil || window <= 0 {
+			log.Error().Msg("Alert: Could not parse 'window' parameter, must be a positive duration such as '5m'.")
+			return nil
+		}
+		newsegment.Window = window
+	} else {
+		log.Info().Msg("Alert: 'window' set to default '5m'.")
+	}
+	if config["rate_limit"] != "" {
+		rateLimit, err := strconv.Atoi(config["rate_limit"])
+		if err != nil || rateLimit < 0 {
+			log.Error().Msg("Alert: Could not parse 'rate_limit' parameter, must be a positive integer or 0.")
+			return nil
+		}
+		newsegment.RateLimit = rateLimit
+	}
+	if config["tids"] != "" {
+		for _, field := range strings.Split(config["tids"], ",") {
+			tid, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+			if err != nil {
+				log.Error().Msgf("Alert: Could not parse tag ID '%s' in 'tids' parameter.", field)
+				return nil
+			}
+			newsegment.Tids = append(newsegment.Tids, uint32(tid))
+		}
+	}
+	if config["sinks"] != "" {
+		newsegment.Sinks = nil
+		for _, name := range strings.Split(config["sinks"], ",") {
+			newsegment.Sinks = append(newsegment.Sinks, strings.TrimSpace(name))
+		}
+	} else {
+		log.Info().Msg("Alert: 'sinks' set to default 'stdout'.")
+	}
+	for _, name := range newsegment.Sinks {
+		sink, err := newAlertSink(name, config)
+		if err != nil {
+			log.Error().Err(err).Msgf("Alert: Could not set up sink '%s': ", name)
+			for _, sink := range newsegment.sinks {
+				sink.Close()
+			}
+			return nil
+		}
+		newsegment.sinks = append(newsegment.sinks, sink)
+	}
+	return newsegment
+}
+
+// Close implements segments.Segment. It closes the sinks of a segment which
+// has been constructed but is never run, such as when a reload fails.
+func (segment *Alert) Close() {
+	if segment.started.Swap(true) {
+		return
+	}
+	for _, sink := range segment.sinks {
+		if err := sink.Close(); err != nil {
+			log.Warn().Err(err).Msg("Alert: Error closing sink: ")
+		}
+	}
+}
+
+// Run implements segments.Segment.
+func (segment *Alert) Run(wg *sync.WaitGroup) {
+	segment.started.Store(true)
+	delivery := newAlertDelivery(segment.sinks)
+	defer func() {
+		delivery.close()
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	tids := make(map[uint32]bool)
+	for _, tid := range segment.Tids {
+		tids[tid] = true
+	}
+	states := make(map[alertKey]*alertState)
+	limiter := &alertLimiter{limit: segment.RateLimit}
+	send := func(state *alertState, status string) {
+		if !limiter.allow(time.Now()) {
+			return
+		}
+		state.event.Status = status
+		state.sentFlows = state.event.Flows
+		delivery.send(state.event)
+	}
+	// expire sends the totals of all windows ending before now
+	expire := func(now time.Time) {
+		for key, state := range states {
+			if now.Before(state.expires) {
+				continue
+			}
+			if state.event.Flows > state.sentFlows {
+				if state.sentFlows == 0 {
+					send(state, "new") // the first alert was rate limited
+				} else {
+					send(state, "update")
+				}
+			}
+			delete(states, key)
+		}
+	}
+
+	tick := segment.Window / 10
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			expire(now)
+		case msg, ok := <-segment.In:
+			if !ok {
+				expire(time.Now().Add(segment.Window)) // flush everything
+				return
+			}
+			if msg.Inlist && (len(tids) == 0 || tids[msg.Tid]) {
+				key, event := alertEventFromFlow(msg)
+				if state, ok := states[key]; ok {
+					state.event.aggregate(event)
+				} else {
+					state := &alertState{event: event, expires: time.Now().Add(segment.Window)}
+					states[key] = state
+					send(state, "new")
+				}
+			}
+			segment.Out <- msg
+		}
+	}
+}
 
-// func init() {
-// 	segment := &Alert{}
-// 	segments.RegisterSegment("alert", segment)
-// }
+// alertEventFromFlow returns the dedup key and a single flow event for a
+// tagged flow. The remote side is taken from the RemoteAddr field if set,
+// otherwise it is the side given by MatchedSide, defaulting to the source.
+func alertEventFromFlow(msg *pb.EnrichedFlow) (alertKey, AlertEvent) {
+	src, dst := flowAddresses(msg)
+	remote, local := src, dst
+	switch msg.GetRemoteAddr() {
+	case pb.EnrichedFlow_Src:
+	case pb.EnrichedFlow_Dst:
+		remote, local = dst, src
+	default:
+		if msg.GetMatchedSide() == pb.EnrichedFlow_MatchedDst {
+			remote, local = dst, src
+		}
+	}
+	indicator := msg.GetMatchedPrefix()
+	if indicator == "" {
+		indicator = remote.String()
+	}
+
+	start, end := flowTime(msg.GetTimeFlowStartNs()), flowEndTime(msg)
+	if start.IsZero() {
+		start = end
+	}
+	event := AlertEvent{
+		Tid:        msg.GetTid(),
+		Note:       msg.GetNote(),
+		Indicator:  indicator,
+		RemoteAddr: remote.String(),
+		LocalAddr:  local.String(),
+		RepScore:   msg.GetRepScore(),
+		Severity:   msg.GetSeverity(),
+		FirstSeen:  start,
+		LastSeen:   end,
+		Flows:      1,
+		Bytes:      msg.GetBytes(),
+		Packets:    msg.GetPackets(),
+	}
+	return alertKey{event.Tid, indicator, event.LocalAddr}, event
+}
+
+// aggregate adds the flows of other to the event.
+func (event *AlertEvent) aggregate(other AlertEvent) {
+	if other.FirstSeen.Before(event.FirstSeen) {
+		event.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(event.LastSeen) {
+		event.LastSeen = other.LastSeen
+	}
+	event.Flows += other.Flows
+	event.Bytes += other.Bytes
+	event.Packets += other.Packets
+}
+
+// flowEndTime returns the end of a flow, falling back to the time it was
+// received and the current time.
+func flowEndTime(msg *pb.EnrichedFlow) time.Time {
+	end := flowTime(msg.GetTimeFlowEndNs())
+	if end.IsZero() {
+		end = flowTime(msg.GetTimeReceivedNs())
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end
+}
+
+func flowTime(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns)).UTC()
+}
+
+// alertLimiter allows up to limit alerts per minute, 0 means unlimited.
+type alertLimiter struct {
+	limit      int
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func (limiter *alertLimiter) allow(now time.Time) bool {
+	if limiter.limit == 0 {
+		return true
+	}
+	if now.Sub(limiter.start) >= time.Minute {
+		if limiter.suppressed > 0 {
+			log.Warn().Msgf("Alert: Suppressed %d alerts exceeding the rate limit of %d per minute.", limiter.suppressed, limiter.limit)
+		}
+		limiter.start, limiter.count, limiter.suppressed = now, 0, 0
+	}
+	if limiter.count >= limiter.limit {
+		limiter.suppressed += 1
+		return false
+	}
+	limiter.count += 1
+	return true
+}
+
+func init() {
+	segment := &Alert{}
+	segments.RegisterSegment("alert", segment)
+}
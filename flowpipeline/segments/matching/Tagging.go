@@ -12,6 +12,10 @@ import (
 const (
 	// Tag ID placed into EnrichedFlow.Tid. Use this in flowfilter: `tid 65001`.
 	TagIDBadIP uint32 = 65001
+
+	// Tag ID placed into EnrichedFlow.Tid for flows whose host names match a
+	// domain indicator. Use this in flowfilter: `tid 65010`.
+	TagIDBadDomain uint32 = 65010
 )
 
 // TagAsBadIP annotates the given flow as matched against a bad IP list.
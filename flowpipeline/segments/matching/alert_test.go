@@ -0,0 +1,227 @@
+package matching
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// runAlert runs flows through an alert segment and returns the alerts written
+// to its jsonl sink.
+func runAlert(t *testing.T, config map[string]string, flows ...*pb.EnrichedFlow) []AlertEvent {
+	filename := filepath.Join(t.TempDir(), "alerts.jsonl")
+	config["sinks"] = "jsonl"
+	config["filename"] = filename
+	segment := Alert{}.New(config)
+	if segment == nil {
+		t.Fatal("[error] Segment Alert could not be initialized.")
+	}
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for _, flow := range flows {
+		in <- flow
+		if result := <-out; result != flow {
+			t.Error("[error] Segment Alert did not pass on a flow unchanged.")
+		}
+	}
+	close(in)
+	<-out
+	wg.Wait()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var events []AlertEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AlertEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("[error] Segment Alert wrote invalid JSON: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func taggedFlow(src string, dst string, bytes uint64, start int64) *pb.EnrichedFlow {
+	return &pb.EnrichedFlow{
+		SrcAddr:         net.ParseIP(src).To4(),
+		DstAddr:         net.ParseIP(dst).To4(),
+		Tid:             TagIDBadIP,
+		Inlist:          true,
+		Note:            "bad_ip",
+		MatchedPrefix:   "203.0.113.0/24",
+		MatchedSide:     pb.EnrichedFlow_MatchedSrc,
+		Bytes:           bytes,
+		Packets:         1,
+		TimeFlowStartNs: uint64(start),
+		TimeFlowEndNs:   uint64(start + 1e9),
+	}
+}
+
+// Alert Segment test, flows per indicator and local host are aggregated
+func TestSegment_Alert_dedup(t *testing.T) {
+	reverse := taggedFlow("192.0.2.1", "203.0.113.2", 200, 5e9) // other direction, same local host
+	reverse.MatchedSide = pb.EnrichedFlow_MatchedDst
+	events := runAlert(t, map[string]string{},
+		taggedFlow("203.0.113.1", "192.0.2.1", 100, 10e9),
+		reverse,
+		taggedFlow("203.0.113.1", "192.0.2.2", 300, 20e9),
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.1").To4(), DstAddr: net.ParseIP("192.0.2.3").To4()},
+	)
+	if len(events) != 3 {
+		t.Fatalf("[error] Segment Alert sent %d alerts, should be 3: %+v", len(events), events)
+	}
+	if events[0].Status != "new" || events[0].LocalAddr != "192.0.2.1" || events[0].Flows != 1 {
+		t.Errorf("[error] Segment Alert sent a wrong first alert: %+v", events[0])
+	}
+	if events[1].Status != "new" || events[1].LocalAddr != "192.0.2.2" {
+		t.Errorf("[error] Segment Alert sent a wrong alert for a second local host: %+v", events[1])
+	}
+	update := events[2]
+	if update.Status != "update" || update.LocalAddr != "192.0.2.1" || update.Flows != 2 || update.Bytes != 300 || update.Packets != 2 {
+		t.Errorf("[error] Segment Alert did not aggregate flows: %+v", update)
+	}
+	if !update.FirstSeen.Equal(time.Unix(5, 0)) || !update.LastSeen.Equal(time.Unix(11, 0)) {
+		t.Errorf("[error] Segment Alert has wrong first and last seen times: %v, %v", update.FirstSeen, update.LastSeen)
+	}
+}
+
+// Alert Segment test, windows end while running
+func TestSegment_Alert_window(t *testing.T) {
+	flow := taggedFlow("203.0.113.1", "192.0.2.1", 100, 10e9)
+	filename := filepath.Join(t.TempDir(), "alerts.jsonl")
+	segment := Alert{}.New(map[string]string{"window": "50ms", "sinks": "jsonl", "filename": filename})
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for i := 0; i < 2; i++ {
+		in <- flow
+		<-out
+		time.Sleep(300 * time.Millisecond)
+	}
+	close(in)
+	<-out
+	wg.Wait()
+
+	data, _ := os.ReadFile(filename)
+	var lines int
+	for _, b := range data {
+		if b == '\n' {
+			lines += 1
+		}
+	}
+	if lines != 2 {
+		t.Errorf("[error] Segment Alert sent %d alerts for flows in separate windows, should be 2.", lines)
+	}
+}
+
+// Alert Segment test, rate limiting and tag selection
+func TestSegment_Alert_rateLimit(t *testing.T) {
+	var flows []*pb.EnrichedFlow
+	for _, local := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		flows = append(flows, taggedFlow("203.0.113.1", local, 100, 10e9))
+	}
+	if events := runAlert(t, map[string]string{"rate_limit": "2"}, flows...); len(events) != 2 {
+		t.Errorf("[error] Segment Alert sent %d alerts with a rate limit of 2.", len(events))
+	}
+	if events := runAlert(t, map[string]string{"tids": "65002"}, flows...); len(events) != 0 {
+		t.Errorf("[error] Segment Alert sent %d alerts for tags not in 'tids'.", len(events))
+	}
+}
+
+// Alert Segment test, webhook sink
+func TestSegment_Alert_webhook(t *testing.T) {
+	received := make(chan AlertEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var event AlertEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Errorf("[error] Segment Alert posted invalid JSON: %v", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	segments.TestSegment("alert", map[string]string{"sinks": "webhook", "webhook_url": server.URL},
+		taggedFlow("203.0.113.1", "192.0.2.1", 100, 10e9))
+	select {
+	case event := <-received:
+		if event.Indicator != "203.0.113.0/24" || event.RemoteAddr != "203.0.113.1" {
+			t.Errorf("[error] Segment Alert posted a wrong alert: %+v", event)
+		}
+	default:
+		t.Error("[error] Segment Alert did not post to the webhook.")
+	}
+}
+
+// Alert Segment test, invalid sink configurations are rejected
+func TestSegment_Alert_invalidSinks(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"sinks": "carrier-pigeon"},
+		{"sinks": "jsonl"},
+		{"sinks": "jsonl", "filename": "/nonexistent/alerts.jsonl"},
+		{"sinks": "webhook", "webhook_url": "ftp://example.com"},
+		{"window": "-1s"},
+	} {
+		if segment := (Alert{}).New(config); segment != nil {
+			t.Errorf("[error] Segment Alert accepts invalid config %v.", config)
+		}
+	}
+}
+
+// counts sinks which have been created but not closed
+type openSink struct{}
+
+var openSinks atomic.Int64
+
+func (sink *openSink) Send(event AlertEvent) error {
+	return nil
+}
+
+func (sink *openSink) Close() error {
+	openSinks.Add(-1)
+	return nil
+}
+
+func init() {
+	RegisterAlertSink("opencounter", func(config map[string]string) (AlertSink, error) {
+		openSinks.Add(1)
+		return &openSink{}, nil
+	})
+}
+
+// Alert Segment test, files are created once alerts are sent and sinks are
+// closed if the segment never runs
+func TestSegment_Alert_closeWithoutRun(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "alerts.jsonl")
+	segment := Alert{}.New(map[string]string{"sinks": "jsonl,opencounter", "filename": filename})
+	if _, err := os.Stat(filename); err == nil {
+		t.Error("[error] Segment Alert created its file when constructed.")
+	}
+	segment.Close()
+	segment.Close()
+	if open := openSinks.Load(); open != 0 {
+		t.Errorf("[error] Segment Alert left %d sinks open.", open)
+	}
+}
@@ -0,0 +1,221 @@
+package matching
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// An AlertSink delivers alert events somewhere. Send is never called
+// concurrently for the same sink.
+type AlertSink interface {
+	Send(event AlertEvent) error
+	Close() error
+}
+
+// Sinks which open files or connections can implement this to do so once the
+// segment runs rather than when it is constructed, such as for a config check.
+type alertSinkOpener interface {
+	open() error
+}
+
+var (
+	alertSinks     = make(map[string]func(config map[string]string) (AlertSink, error))
+	alertSinksLock = &sync.RWMutex{}
+)
+
+// RegisterAlertSink makes a sink available to the alert segment's 'sinks'
+// parameter. The constructor receives the segment's config.
+func RegisterAlertSink(name string, new func(config map[string]string) (AlertSink, error)) {
+	alertSinksLock.Lock()
+	defer alertSinksLock.Unlock()
+	if _, ok := alertSinks[name]; ok {
+		log.Fatal().Msgf("Alert: Tried to register conflicting sink name '%s'.", name)
+	}
+	alertSinks[name] = new
+}
+
+func newAlertSink(name string, config map[string]string) (AlertSink, error) {
+	alertSinksLock.RLock()
+	new, ok := alertSinks[name]
+	alertSinksLock.RUnlock()
+	if !ok {
+		var names []string
+		alertSinksLock.RLock()
+		for name := range alertSinks {
+			names = append(names, name)
+		}
+		alertSinksLock.RUnlock()
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown sink, must be one of '%s'", strings.Join(names, "', '"))
+	}
+	return new(config)
+}
+
+// alertDelivery hands events to the sinks in the background, so that slow
+// sinks do not hold up flows. Events are dropped if the sinks fall behind.
+type alertDelivery struct {
+	sinks   []AlertSink
+	events  chan AlertEvent
+	done    chan struct{}
+	dropped int
+}
+
+func newAlertDelivery(sinks []AlertSink) *alertDelivery {
+	delivery := &alertDelivery{
+		sinks:  sinks,
+		events: make(chan AlertEvent, 1024),
+		done:   make(chan struct{}),
+	}
+	for _, sink := range sinks {
+		if opener, ok := sink.(alertSinkOpener); ok {
+			if err := opener.open(); err != nil {
+				log.Error().Err(err).Msg("Alert: Could not open sink: ")
+			}
+		}
+	}
+	go func() {
+		defer close(delivery.done)
+		for event := range delivery.events {
+			for _, sink := range delivery.sinks {
+				if err := sink.Send(event); err != nil {
+					log.Error().Err(err).Msg("Alert: Failed delivering alert: ")
+				}
+			}
+		}
+	}()
+	return delivery
+}
+
+func (delivery *alertDelivery) send(event AlertEvent) {
+	select {
+	case delivery.events <- event:
+	default:
+		delivery.dropped += 1
+		if delivery.dropped == 1 || delivery.dropped%1000 == 0 {
+			log.Warn().Msgf("Alert: Sinks are falling behind, dropped %d alerts so far.", delivery.dropped)
+		}
+	}
+}
+
+// close delivers all queued events and closes the sinks.
+func (delivery *alertDelivery) close() {
+	close(delivery.events)
+	<-delivery.done
+	for _, sink := range delivery.sinks {
+		if err := sink.Close(); err != nil {
+			log.Warn().Err(err).Msg("Alert: Error closing sink: ")
+		}
+	}
+}
+
+// jsonlSink writes one JSON object per line to a writer, or to a file opened
+// once the segment runs.
+type jsonlSink struct {
+	writer   *bufio.Writer
+	closer   io.Closer
+	filename string // if writer is nil
+}
+
+func (sink *jsonlSink) open() error {
+	if sink.writer != nil {
+		return nil
+	}
+	file, err := os.OpenFile(sink.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	sink.writer, sink.closer = bufio.NewWriter(file), file
+	return nil
+}
+
+func (sink *jsonlSink) Send(event AlertEvent) error {
+	if err := sink.open(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := sink.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return sink.writer.Flush()
+}
+
+func (sink *jsonlSink) Close() error {
+	if sink.closer == nil {
+		return nil
+	}
+	return sink.closer.Close()
+}
+
+// webhookSink posts every event as JSON to a URL.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (sink *webhookSink) Send(event AlertEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+func (sink *webhookSink) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterAlertSink("stdout", func(config map[string]string) (AlertSink, error) {
+		return &jsonlSink{writer: bufio.NewWriter(os.Stdout)}, nil
+	})
+	RegisterAlertSink("jsonl", func(config map[string]string) (AlertSink, error) {
+		if config["filename"] == "" {
+			return nil, errors.New("parameter 'filename' is required")
+		}
+		filename := segments.ContainerVolumePrefix + config["filename"]
+		if err := segments.CheckWritableFile(filename); err != nil {
+			return nil, err
+		}
+		return &jsonlSink{filename: filename}, nil
+	})
+	RegisterAlertSink("webhook", func(config map[string]string) (AlertSink, error) {
+		webhookUrl, err := url.Parse(config["webhook_url"])
+		if err != nil || !(webhookUrl.Scheme == "http" || webhookUrl.Scheme == "https") {
+			return nil, errors.New("parameter 'webhook_url' is required and must be an 'http://' or 'https://' URL")
+		}
+		timeout := 10 * time.Second
+		if config["webhook_timeout"] != "" {
+			if timeout, err = time.ParseDuration(config["webhook_timeout"]); err != nil || timeout <= 0 {
+				return nil, errors.New("parameter 'webhook_timeout' must be a positive duration")
+			}
+		}
+		return &webhookSink{url: webhookUrl.String(), client: &http.Client{Timeout: timeout}}, nil
+	})
+}
@@ -1,3 +0,0 @@
-package matching
-
-//ALGORITHM TO TEST GOES IN HERE.
@@ -0,0 +1,248 @@
+package matching
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// An allowlist suppresses matches which are known to be false positives, such
+// as research scanners or the organization's own scanners. It consists of the
+// rules read from a file, see readAllowRules, and of rules for the tags given
+// in 'allow_tags'. While the segment runs, the file is checked for changes
+// every interval.
+type allowlist struct {
+	path     string
+	interval time.Duration                // 0 disables checking the file for changes
+	tags     []*allowRule                 // from 'allow_tags'
+	rules    atomic.Pointer[[]*allowRule] // from path, replaced on reloads
+
+	modTime time.Time
+	size    int64
+	stop    chan struct{} // closed to stop checking for changes
+}
+
+// An allowRule suppresses matches of an address or prefix, of indicators with
+// a tag, or of flows with a local host within a prefix.
+type allowRule struct {
+	text    string       // the rule as written, e.g. "tag:whitelist"
+	prefix  netip.Prefix // for address and local rules
+	local   bool         // whether prefix applies to the local host instead of the matched address
+	tag     string       // for tag rules
+	expires time.Time    // zero if the rule does not expire
+	reason  string
+}
+
+// label identifies the rule in logs and metrics.
+func (rule *allowRule) label() string {
+	if rule.reason != "" {
+		return rule.reason
+	}
+	return rule.text
+}
+
+// newAllowlist reads the allowlist at path, if any, and adds rules for tags.
+func newAllowlist(path string, tags []string, interval time.Duration) (*allowlist, error) {
+	allow := &allowlist{path: path, interval: interval}
+	for _, tag := range tags {
+		allow.tags = append(allow.tags, &allowRule{text: "tag:" + tag, tag: tag, reason: "allow_tags"})
+	}
+	if path != "" {
+		if err := allow.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return allow, nil
+}
+
+// reload reads the file, keeping the previous rules on errors.
+func (allow *allowlist) reload() error {
+	info, err := os.Stat(allow.path)
+	if err != nil {
+		return err
+	}
+	allow.modTime, allow.size = info.ModTime(), info.Size()
+	file, err := os.Open(allow.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rules, err := readAllowRules(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", allow.path, err)
+	}
+	allow.rules.Store(&rules)
+	var expired int
+	for _, rule := range rules {
+		if !rule.expires.IsZero() && time.Now().After(rule.expires) {
+			expired += 1
+		}
+	}
+	log.Info().Msgf("Matching: Loaded %d allowlist rules from %s, %d of which have expired.", len(rules), allow.path, expired)
+	return nil
+}
+
+// readAllowRules reads one rule per line, empty lines and lines starting with
+// '#' are ignored. A rule is an address, prefix or range as accepted by
+// parsePrefixes, 'tag:' followed by an indicator tag, or 'local:' followed by
+// a prefix containing local hosts. It may be followed by 'expires=' and a date
+// or RFC 3339 time, and 'reason=' and a free text extending to the end of the
+// line, e.g.:
+//
+//	192.0.2.0/24 expires=2025-12-31 reason=pentest by ACME
+//	tag:researchscanners reason=known research scanners
+//	local:198.51.100.10 reason=our vulnerability scanner
+func readAllowRules(r io.Reader) ([]*allowRule, error) {
+	var rules []*allowRule
+	scanner := bufio.NewScanner(r)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line, reason, _ := strings.Cut(line, "reason=")
+		rule := allowRule{reason: strings.Trim(strings.TrimSpace(reason), `"`)}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing rule before 'reason='", lineno)
+		}
+		rule.text = fields[0]
+		for _, field := range fields[1:] {
+			value, found := strings.CutPrefix(field, "expires=")
+			if !found {
+				return nil, fmt.Errorf("line %d: unexpected '%s', reasons have to be given as 'reason=...'", lineno, field)
+			}
+			expires, err := parseExpiry(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			rule.expires = expires
+		}
+
+		if tag, isTag := strings.CutPrefix(rule.text, "tag:"); isTag {
+			if tag == "" {
+				return nil, fmt.Errorf("line %d: empty tag", lineno)
+			}
+			rule.tag = tag
+			rules = append(rules, &rule)
+			continue
+		}
+		entry, isLocal := strings.CutPrefix(rule.text, "local:")
+		prefixes, err := parsePrefixes(entry, false)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		for _, prefix := range prefixes {
+			rule := rule
+			rule.prefix, rule.local = prefix, isLocal
+			rules = append(rules, &rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseExpiry accepts a date, which expires at the end of that day in UTC, or
+// an RFC 3339 time.
+func parseExpiry(value string) (time.Time, error) {
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date.Add(24 * time.Hour), nil
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry '%s', must be a date such as 2025-12-31 or an RFC 3339 time", value)
+	}
+	return expires, nil
+}
+
+// suppresses returns the first rule suppressing a match of indicator for
+// addr, or nil if there is none. local is the address on the other side of
+// the flow.
+func (allow *allowlist) suppresses(indicator *Indicator, addr net.IP, local net.IP, now time.Time) *allowRule {
+	if allow == nil {
+		return nil
+	}
+	var rules []*allowRule
+	if loaded := allow.rules.Load(); loaded != nil {
+		rules = *loaded
+	}
+	matchedAddr, _ := netip.AddrFromSlice(addr)
+	localAddr, _ := netip.AddrFromSlice(local)
+	matchedAddr, localAddr = matchedAddr.Unmap(), localAddr.Unmap()
+	for _, rules := range [][]*allowRule{allow.tags, rules} {
+		for _, rule := range rules {
+			if !rule.expires.IsZero() && now.After(rule.expires) {
+				continue
+			}
+			switch {
+			case rule.tag != "":
+				for _, tag := range indicator.Tags {
+					if tag == rule.tag {
+						return rule
+					}
+				}
+			case rule.local:
+				if rule.prefix.Contains(localAddr) {
+					return rule
+				}
+			default:
+				if rule.prefix.Contains(matchedAddr) {
+					return rule
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// start checks the file for changes every interval until done is called.
+func (allow *allowlist) start() {
+	if allow == nil || allow.path == "" || allow.interval == 0 {
+		return
+	}
+	allow.stop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(allow.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				allow.checkForChanges()
+			case <-stop:
+				return
+			}
+		}
+	}(allow.stop)
+}
+
+// done stops checking the file for changes.
+func (allow *allowlist) done() {
+	if allow != nil && allow.stop != nil {
+		close(allow.stop)
+		allow.stop = nil
+	}
+}
+
+// checkForChanges reloads the file if it changed.
+func (allow *allowlist) checkForChanges() {
+	info, err := os.Stat(allow.path)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Matching: Could not check %s for changes: ", allow.path)
+		return
+	}
+	if info.ModTime().Equal(allow.modTime) && info.Size() == allow.size {
+		return
+	}
+	if err := allow.reload(); err != nil {
+		log.Error().Err(err).Msgf("Matching: Failed reloading allowlist %s, keeping the previous version: ", allow.path)
+	}
+}
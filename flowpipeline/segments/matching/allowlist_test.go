@@ -0,0 +1,178 @@
+package matching
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+const testAllowlist = `# test allowlist
+203.0.113.128/25 reason=pentest by ACME
+198.51.100.7 expires=2000-01-01 reason=expired
+local:192.0.2.100 reason="our scanner"
+`
+
+func writeTestAllowlist(t testing.TB, content string) string {
+	path := filepath.Join(t.TempDir(), "allowlist.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadAllowRules(t *testing.T) {
+	rules, err := readAllowRules(strings.NewReader(testAllowlist + "tag:researchscanners\n192.0.2.1-192.0.2.2 expires=2030-01-01T12:00:00Z\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 6 {
+		t.Fatalf("[error] Read %d rules, should be 6.", len(rules))
+	}
+	if rules[0].prefix.String() != "203.0.113.128/25" || rules[0].reason != "pentest by ACME" || rules[0].local {
+		t.Errorf("[error] Read unexpected prefix rule %+v.", rules[0])
+	}
+	if !rules[1].expires.Equal(time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("[error] Rule expires at %s, should be the end of the given day.", rules[1].expires)
+	}
+	if !rules[2].local || rules[2].reason != "our scanner" {
+		t.Errorf("[error] Read unexpected local rule %+v.", rules[2])
+	}
+	if rules[3].tag != "researchscanners" || rules[3].label() != "tag:researchscanners" {
+		t.Errorf("[error] Read unexpected tag rule %+v.", rules[3])
+	}
+	if rules[4].prefix.String() != "192.0.2.1/32" || rules[5].prefix.String() != "192.0.2.2/32" {
+		t.Errorf("[error] Read unexpected range rules %s and %s.", rules[4].prefix, rules[5].prefix)
+	}
+
+	for _, invalid := range []string{"192.0.2.300", "tag:", "192.0.2.1 expires=tomorrow", "192.0.2.1 because", "reason=nothing"} {
+		if _, err := readAllowRules(strings.NewReader(invalid)); err == nil {
+			t.Errorf("[error] Accepted invalid rule '%s'.", invalid)
+		}
+	}
+}
+
+// Matching Segment test, allowlisted matches are not tagged
+func TestSegment_Matching_allowlist(t *testing.T) {
+	config := map[string]string{
+		"ip_list_path":   writeTestList(t, testList),
+		"allowlist_path": writeTestAllowlist(t, testAllowlist),
+	}
+	for _, test := range []struct {
+		src, dst string
+		inlist   bool
+		side     pb.EnrichedFlow_MatchedSideType
+	}{
+		{"203.0.113.200", "192.0.2.1", false, pb.EnrichedFlow_NotMatched},   // allowed prefix
+		{"203.0.113.1", "192.0.2.1", true, pb.EnrichedFlow_MatchedSrc},      // outside the allowed prefix
+		{"203.0.113.200", "198.51.100.7", true, pb.EnrichedFlow_MatchedDst}, // the other side is still tagged
+		{"192.0.2.1", "198.51.100.7", true, pb.EnrichedFlow_MatchedDst},     // expired rule
+		{"192.0.2.100", "198.51.100.7", false, pb.EnrichedFlow_NotMatched},  // allowed local host
+	} {
+		result := segments.TestSegment("matching", config,
+			&pb.EnrichedFlow{SrcAddr: net.ParseIP(test.src).To4(), DstAddr: net.ParseIP(test.dst).To4()})
+		if result.Inlist != test.inlist || result.MatchedSide != test.side {
+			t.Errorf("[error] Segment Matching reports inlist %t side %s for %s -> %s, should be %t %s.",
+				result.Inlist, result.MatchedSide, test.src, test.dst, test.inlist, test.side)
+		}
+	}
+}
+
+// Matching Segment test, indicators with allowed tags are not tagged
+func TestSegment_Matching_allowTags(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": "match.csv", "format": "nerd-csv", "allow_tags": "whitelist, researchscanners"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("64.62.197.112").To4()})
+	if result.Inlist {
+		t.Error("[error] Segment Matching is tagging an indicator with an allowed tag.")
+	}
+	result = segments.TestSegment("matching", map[string]string{"ip_list_path": "match.csv", "format": "nerd-csv", "allow_tags": "researchscanner"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("64.62.197.112").To4()})
+	if !result.Inlist {
+		t.Error("[error] Segment Matching is not tagging an indicator without allowed tags.")
+	}
+}
+
+// Matching Segment test, suppressed matches are counted by reason
+func TestSegment_Matching_suppressedMetrics(t *testing.T) {
+	segment := MatchingSegment{}.New(map[string]string{
+		"ip_list_path":   writeTestList(t, testList),
+		"allowlist_path": writeTestAllowlist(t, testAllowlist),
+		"endpoint":       "127.0.0.1:0",
+	})
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for _, src := range []string{"203.0.113.200", "203.0.113.201", "203.0.113.1"} {
+		in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP(src).To4(), DstAddr: net.ParseIP("192.0.2.1").To4()}
+		<-out
+	}
+	exportersLock.Lock()
+	exporter := exporters["127.0.0.1:0"]
+	exportersLock.Unlock()
+	metrics := gatherMetrics(t, exporter)
+	close(in)
+	wg.Wait()
+
+	if value := metrics[`matching_suppressed_total{list="bad_ip",reason="pentest by ACME"}`]; value != 2 {
+		t.Errorf("[error] Segment Matching counted %f suppressed flows, should be 2.", value)
+	}
+	if value := metrics[`matching_hits_total{list="bad_ip",side="src"}`]; value != 1 {
+		t.Errorf("[error] Segment Matching counted %f hits, should be 1.", value)
+	}
+}
+
+// Matching Segment test, suppressed matches are counted without metrics
+func TestSegment_Matching_suppressedCount(t *testing.T) {
+	segment := MatchingSegment{}.New(map[string]string{
+		"ip_list_path":   writeTestList(t, testList),
+		"allowlist_path": writeTestAllowlist(t, testAllowlist),
+	}).(*MatchingSegment)
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for _, src := range []string{"203.0.113.200", "203.0.113.201", "203.0.113.1"} {
+		in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP(src).To4(), DstAddr: net.ParseIP("192.0.2.1").To4()}
+		<-out
+	}
+	close(in)
+	wg.Wait()
+	if suppressed := segment.Lists[0].suppressed.Load(); suppressed != 2 {
+		t.Errorf("[error] Segment Matching counted %d suppressed flows, should be 2.", suppressed)
+	}
+}
+
+// Matching Segment test, changes to the allowlist are picked up
+func TestSegment_Matching_allowlistReload(t *testing.T) {
+	path := writeTestAllowlist(t, "")
+	allow, err := newAllowlist(path, nil, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indicator := &Indicator{Prefix: "198.51.100.7/32"}
+	addr, local := net.ParseIP("198.51.100.7"), net.ParseIP("192.0.2.1")
+	if allow.suppresses(indicator, addr, local, time.Now()) != nil {
+		t.Fatal("[error] Empty allowlist suppresses a match.")
+	}
+	allow.start()
+	defer allow.done()
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for allow.suppresses(indicator, addr, local, time.Now()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("[error] Allowlist did not pick up a new rule.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,157 @@
+package matching
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// A MatcherEvaluation reports how a matcher performed on a labelled set of
+// flows, see EvaluateMatchers.
+type MatcherEvaluation struct {
+	Matcher        string
+	TruePositives  int
+	FalsePositives int
+	FalseNegatives int
+	TrueNegatives  int
+	Precision      float64       // share of matched flows labelled as matching, 1 if none matched
+	Recall         float64       // share of flows labelled as matching which matched, 1 if none are labelled
+	Throughput     float64       // flows matched per second, looking up both addresses
+	Bytes          uint64        // heap in use by the list read with this matcher, including the sorted tables all lists keep
+	BuildTime      time.Duration // time to read the list and build the matcher
+}
+
+// String formats the evaluation as a single line.
+func (e MatcherEvaluation) String() string {
+	return fmt.Sprintf("%-10s precision %.4f recall %.4f (tp %d fp %d fn %d tn %d) %.0f flows/s %d bytes built in %s",
+		e.Matcher, e.Precision, e.Recall, e.TruePositives, e.FalsePositives, e.FalseNegatives, e.TrueNegatives,
+		e.Throughput, e.Bytes, e.BuildTime.Round(time.Millisecond))
+}
+
+// EvaluateMatchers reads the list at path with each of the named matchers
+// and runs flows through it. A flow counts as matched if its source or
+// destination address matches, respecting port constraints, and labels give
+// whether it should. Throughput is measured by repeating the flows for at
+// least minDuration.
+func EvaluateMatchers(path string, options ListOptions, names []string, flows []*pb.EnrichedFlow, labels []bool, minDuration time.Duration) ([]MatcherEvaluation, error) {
+	if len(flows) != len(labels) {
+		return nil, fmt.Errorf("got %d flows, but %d labels", len(flows), len(labels))
+	}
+	var evaluations []MatcherEvaluation
+	for _, name := range names {
+		options.Matcher = name
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		set, err := readIndicatorList(path, options)
+		if err != nil {
+			return nil, fmt.Errorf("matcher %s: %w", name, err)
+		}
+		e := MatcherEvaluation{Matcher: name, BuildTime: time.Since(start)}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if after.HeapAlloc > before.HeapAlloc {
+			e.Bytes = after.HeapAlloc - before.HeapAlloc
+		}
+
+		for i, flow := range flows {
+			switch matched := matchesFlow(set, flow); {
+			case matched && labels[i]:
+				e.TruePositives += 1
+			case matched:
+				e.FalsePositives += 1
+			case labels[i]:
+				e.FalseNegatives += 1
+			default:
+				e.TrueNegatives += 1
+			}
+		}
+		e.Precision, e.Recall = 1, 1
+		if e.TruePositives+e.FalsePositives > 0 {
+			e.Precision = float64(e.TruePositives) / float64(e.TruePositives+e.FalsePositives)
+		}
+		if e.TruePositives+e.FalseNegatives > 0 {
+			e.Recall = float64(e.TruePositives) / float64(e.TruePositives+e.FalseNegatives)
+		}
+
+		if len(flows) > 0 {
+			var count int
+			start = time.Now()
+			for count == 0 || time.Since(start) < minDuration {
+				for _, flow := range flows {
+					matchesFlow(set, flow)
+				}
+				count += len(flows)
+			}
+			e.Throughput = float64(count) / time.Since(start).Seconds()
+		}
+		runtime.KeepAlive(set)
+		evaluations = append(evaluations, e)
+	}
+	return evaluations, nil
+}
+
+func matchesFlow(set *IndicatorSet, flow *pb.EnrichedFlow) bool {
+	src, dst := flowAddresses(flow)
+	return set.LookupFlow(src, flow) != nil || set.LookupFlow(dst, flow) != nil
+}
+
+// ReadLabelledFlows reads flows in the format of the json and stdin
+// segments, one per line, and the labels for them from a file with one
+// boolean per line, in the same order. Empty lines and lines starting with
+// '#' are ignored in the labels file.
+func ReadLabelledFlows(flowsPath string, labelsPath string) ([]*pb.EnrichedFlow, []bool, error) {
+	var flows []*pb.EnrichedFlow
+	data, err := os.ReadFile(flowsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		flow := &pb.EnrichedFlow{}
+		if err := protojson.Unmarshal(line, flow); err != nil {
+			return nil, nil, fmt.Errorf("%s line %d: %w", flowsPath, i+1, err)
+		}
+		flows = append(flows, flow)
+	}
+
+	file, err := os.Open(labelsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	var labels []bool
+	scanner := bufio.NewScanner(file)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		label, err := strconv.ParseBool(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s line %d: %w", labelsPath, lineno, err)
+		}
+		labels = append(labels, label)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(flows) != len(labels) {
+		return nil, nil, fmt.Errorf("got %d flows, but %d labels", len(flows), len(labels))
+	}
+	return flows, labels, nil
+}
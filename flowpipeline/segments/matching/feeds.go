@@ -0,0 +1,247 @@
+package matching
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	feeds     = make(map[string]*feedUpdater)
+	feedsLock = &sync.Mutex{}
+)
+
+// A feedUpdater periodically downloads an indicator list and replaces its
+// destination file once the download has been validated. Requests are
+// conditional, unchanged feeds are not transferred again. On any failure the
+// previous destination file is left in place.
+type feedUpdater struct {
+	Source      *url.URL      // http, https or file URL
+	Destination string        // local path to write the list to
+	Interval    time.Duration // how often to check the source for changes
+	MinLines    int           // minimum number of non-empty, non-comment lines
+	HeaderLines int           // number of such lines at the start which are not counted, such as a CSV header
+	Validate    func(path string) error
+
+	client       *http.Client
+	etag         string // validators of the last successful download
+	lastModified string
+
+	users int           // number of running segments, guarded by feedsLock
+	stop  chan struct{} // closed once the last user is done
+}
+
+// The number of header lines of list formats which have them.
+var feedHeaderLines = map[string]int{"nerd-csv": 1}
+
+// newFeedUpdater checks source and returns a feedUpdater writing to
+// destination. Validate may be nil, in which case only MinLines is checked.
+func newFeedUpdater(source string, destination string, interval time.Duration, minLines int, validate func(path string) error) (*feedUpdater, error) {
+	sourceUrl, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	switch sourceUrl.Scheme {
+	case "http", "https", "file":
+	default:
+		return nil, fmt.Errorf("unsupported scheme in '%s', must be one of 'http://', 'https://' or 'file://'", source)
+	}
+	if interval <= 0 {
+		return nil, errors.New("update interval must be positive")
+	}
+	return &feedUpdater{
+		Source:      sourceUrl,
+		Destination: destination,
+		Interval:    interval,
+		MinLines:    minLines,
+		Validate:    validate,
+		client:      &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// startFeed registers a running segment for the destination of feed and
+// starts updating with the first one. If the destination is already being
+// updated, the running feedUpdater is returned instead of feed. Every call
+// must be matched by a call to done on the result.
+func startFeed(feed *feedUpdater) *feedUpdater {
+	feedsLock.Lock()
+	defer feedsLock.Unlock()
+	if existing, ok := feeds[feed.Destination]; ok {
+		if existing.Source.String() != feed.Source.String() {
+			log.Warn().Msgf("Matching: %s is already updated from %s, ignoring %s.", feed.Destination, existing.Source, feed.Source)
+		}
+		feed = existing
+	} else {
+		feeds[feed.Destination] = feed
+	}
+	feed.users += 1
+	if feed.users == 1 {
+		feed.stop = make(chan struct{})
+		go feed.run(feed.stop)
+	}
+	return feed
+}
+
+// done unregisters a running segment and stops updating once the last one is
+// done.
+func (feed *feedUpdater) done() {
+	feedsLock.Lock()
+	defer feedsLock.Unlock()
+	feed.users -= 1
+	if feed.users > 0 {
+		return
+	}
+	close(feed.stop)
+	delete(feeds, feed.Destination)
+}
+
+// run checks the source for a new version right away and then once every
+// Interval, and makes the lists read from the destination read it again
+// after replacing it.
+func (feed *feedUpdater) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(feed.Interval)
+	defer ticker.Stop()
+	for {
+		if updated, err := feed.Update(); err != nil {
+			log.Error().Err(err).Msgf("Matching: Failed updating %s from %s, keeping the previous version: ", feed.Destination, feed.Source)
+		} else if updated {
+			refreshLists(feed.Destination)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Update fetches the source once and replaces the destination file if the
+// source changed and the download passes validation. It reports whether the
+// destination was replaced.
+func (feed *feedUpdater) Update() (bool, error) {
+	body, etag, lastModified, err := feed.open()
+	if err != nil {
+		return false, err
+	}
+	if body == nil {
+		log.Debug().Msgf("Matching: %s is unchanged.", feed.Source)
+		return false, nil
+	}
+	defer body.Close()
+
+	dir := filepath.Dir(feed.Destination)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(feed.Destination)+".*")
+	if err != nil {
+		return false, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // fails harmlessly once renamed
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := feed.check(tmpPath); err != nil {
+		return false, fmt.Errorf("validating download: %w", err)
+	}
+	if err := os.Rename(tmpPath, feed.Destination); err != nil {
+		return false, err
+	}
+	feed.etag, feed.lastModified = etag, lastModified
+	log.Info().Msgf("Matching: Updated %s from %s.", feed.Destination, feed.Source)
+	return true, nil
+}
+
+// open returns the contents of the source along with its validators, or a
+// nil body if the source did not change since the last successful download.
+func (feed *feedUpdater) open() (io.ReadCloser, string, string, error) {
+	if feed.Source.Scheme == "file" {
+		info, err := os.Stat(feed.Source.Path)
+		if err != nil {
+			return nil, "", "", err
+		}
+		lastModified := info.ModTime().UTC().Format(time.RFC3339Nano)
+		if lastModified == feed.lastModified {
+			return nil, "", "", nil
+		}
+		f, err := os.Open(feed.Source.Path)
+		return f, "", lastModified, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, feed.Source.String(), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if feed.etag != "" {
+		req.Header.Set("If-None-Match", feed.etag)
+	}
+	if feed.lastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.lastModified)
+	} else if info, err := os.Stat(feed.Destination); err == nil {
+		// fall back to our own copy's age after restarts
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := feed.client.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, "", "", nil
+	default:
+		resp.Body.Close()
+		return nil, "", "", fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+}
+
+// check validates a downloaded list before it replaces the destination.
+func (feed *feedUpdater) check(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var lines, headers int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if headers < feed.HeaderLines {
+			headers += 1
+			continue
+		}
+		lines += 1
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if lines < feed.MinLines {
+		return fmt.Errorf("got %d lines, expected at least %d", lines, feed.MinLines)
+	}
+	if feed.Validate != nil {
+		return feed.Validate(path)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package matching
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFeedUpdater_conditional(t *testing.T) {
+	var requests, transfers int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		transfers += 1
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("# feed\n192.0.2.1\n198.51.100.0/24\n"))
+	}))
+	defer server.Close()
+
+	destination := filepath.Join(t.TempDir(), "list.txt")
+	feed, err := newFeedUpdater(server.URL, destination, time.Hour, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := feed.Update(); !updated || err != nil {
+		t.Fatalf("[error] FeedUpdater did not download the feed: %v", err)
+	}
+	if updated, err := feed.Update(); updated || err != nil {
+		t.Fatalf("[error] FeedUpdater replaced the list although the feed is unchanged: %v", err)
+	}
+	if requests != 2 || transfers != 1 {
+		t.Errorf("[error] FeedUpdater made %d requests with %d transfers, should be 2 and 1.", requests, transfers)
+	}
+	content, _ := os.ReadFile(destination)
+	if string(content) != "# feed\n192.0.2.1\n198.51.100.0/24\n" {
+		t.Errorf("[error] FeedUpdater wrote unexpected content: %q", content)
+	}
+}
+
+func TestFeedUpdater_keepLastGood(t *testing.T) {
+	var body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	destination := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(destination, []byte("192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := newFeedUpdater(server.URL, destination, time.Hour, 2, func(path string) error {
+		_, err := readIndicatorList(path, ListOptions{})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, "# truncated\n192.0.2.2\n"},                // too short
+		{http.StatusOK, "192.0.2.2\n<html>rate limited</html>\n"},  // does not parse
+		{http.StatusInternalServerError, "192.0.2.2\n192.0.2.3\n"}, // server error
+	} {
+		status, body = bad.status, bad.body
+		if updated, err := feed.Update(); updated || err == nil {
+			t.Errorf("[error] FeedUpdater accepted an invalid download: %q", bad.body)
+		}
+		content, _ := os.ReadFile(destination)
+		if string(content) != "192.0.2.1\n" {
+			t.Errorf("[error] FeedUpdater did not keep the last good list, got %q", content)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Dir(destination))
+	if len(entries) != 1 {
+		t.Errorf("[error] FeedUpdater left %d files behind, should be 1.", len(entries))
+	}
+}
+
+func TestFeedUpdater_file(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.txt")
+	destination := filepath.Join(dir, "list.txt")
+	if err := os.WriteFile(source, []byte("192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := newFeedUpdater("file://"+source, destination, time.Hour, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := feed.Update(); !updated || err != nil {
+		t.Fatalf("[error] FeedUpdater did not copy the file source: %v", err)
+	}
+	if updated, _ := feed.Update(); updated {
+		t.Error("[error] FeedUpdater copied an unchanged file source again.")
+	}
+	content, _ := os.ReadFile(destination)
+	if string(content) != "192.0.2.1\n" {
+		t.Errorf("[error] FeedUpdater wrote unexpected content: %q", content)
+	}
+}
+
+func TestFeedUpdater_invalidSource(t *testing.T) {
+	if _, err := newFeedUpdater("ftp://example.com/list.txt", "list.txt", time.Hour, 1, nil); err == nil {
+		t.Error("[error] FeedUpdater accepts unsupported schemes.")
+	}
+}
+
+func TestFeedUpdater_headerLines(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.csv")
+	destination := filepath.Join(dir, "list.csv")
+	if err := os.WriteFile(source, []byte("ip,rep\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := newFeedUpdater("file://"+source, destination, time.Hour, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed.HeaderLines = feedHeaderLines["nerd-csv"]
+	if updated, err := feed.Update(); updated || err == nil {
+		t.Error("[error] FeedUpdater counts the header line towards the minimum number of lines.")
+	}
+	if err := os.WriteFile(source, []byte("ip,rep\n192.0.2.1,0.5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := feed.Update(); !updated || err != nil {
+		t.Errorf("[error] FeedUpdater rejected a feed with a header and a data line: %v", err)
+	}
+}
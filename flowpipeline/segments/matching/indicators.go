@@ -0,0 +1,478 @@
+package matching
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// An Indicator is a single entry of an indicator list as it is stored in an
+// IndicatorSet. List entries covering a range of addresses result in one
+// Indicator per prefix of that range.
+type Indicator struct {
+	Prefix string // canonical CIDR notation, e.g. 203.0.113.0/24, empty for domain indicators
+	Domain string // the domain entry of domain indicators, e.g. bad.example or *.bad.example
+
+	// The fields below are only set by list formats providing them, such
+	// as nerd-csv, misp-json or stix2.
+	Score      float64   // reputation score, higher is worse
+	Categories []string  // event categories this indicator was reported for
+	Blacklists []string  // names of the source blacklists listing this indicator
+	Tags       []string  // free-form tags assigned by the list provider
+	ASNs       []uint32  // autonomous systems announcing this indicator
+	LastEvent  time.Time // time of the most recent event reported for this indicator
+
+	// Ports restricts matches to flows satisfying any of these constraints,
+	// if set. Only the plain format provides them.
+	Ports []PortConstraint
+}
+
+// A PortConstraint restricts an indicator to flows of a protocol and,
+// optionally, to flows with a source or destination port in a range.
+type PortConstraint struct {
+	Proto    uint32 // IP protocol number, e.g. 6 for TCP
+	FromPort uint32 // 0 if any port is allowed
+	ToPort   uint32
+}
+
+// Names accepted for IP protocol numbers in port constraints.
+var protoNames = map[string]uint32{"icmp": 1, "tcp": 6, "udp": 17, "gre": 47, "esp": 50, "icmpv6": 58, "sctp": 132}
+
+// String returns the constraint in list syntax, e.g. "tcp/22".
+func (c PortConstraint) String() string {
+	proto := strconv.FormatUint(uint64(c.Proto), 10)
+	for name, number := range protoNames {
+		if number == c.Proto {
+			proto = name
+		}
+	}
+	switch {
+	case c.FromPort == 0:
+		return proto
+	case c.FromPort == c.ToPort:
+		return fmt.Sprintf("%s/%d", proto, c.FromPort)
+	}
+	return fmt.Sprintf("%s/%d-%d", proto, c.FromPort, c.ToPort)
+}
+
+// mergePorts returns indicator with the port constraints of a previous
+// indicator for the same entry added, so that the entry matches if either of
+// them does. An indicator without constraints matches all flows, so the result
+// has none if one of them has none.
+func mergePorts(previous *Indicator, indicator *Indicator) *Indicator {
+	if previous == nil || indicator == nil || len(previous.Ports) == 0 && len(indicator.Ports) == 0 {
+		return indicator
+	}
+	merged := *indicator
+	if len(previous.Ports) == 0 || len(indicator.Ports) == 0 {
+		merged.Ports = nil
+	} else {
+		merged.Ports = append(slices.Clip(previous.Ports), indicator.Ports...)
+	}
+	return &merged
+}
+
+// Allows reports whether flow satisfies any of the indicator's port
+// constraints, or whether it has none. The port range applies to either side
+// of the flow, so that 'tcp/22' covers both SSH clients and servers.
+func (indicator *Indicator) Allows(flow *pb.EnrichedFlow) bool {
+	if len(indicator.Ports) == 0 {
+		return true
+	}
+	for _, c := range indicator.Ports {
+		if flow.GetProto() != c.Proto {
+			continue
+		}
+		if c.FromPort == 0 {
+			return true
+		}
+		if src := flow.GetSrcPort(); src >= c.FromPort && src <= c.ToPort {
+			return true
+		}
+		if dst := flow.GetDstPort(); dst >= c.FromPort && dst <= c.ToPort {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the prefix or domain entry of the indicator.
+func (indicator *Indicator) String() string {
+	if indicator.Domain != "" {
+		return indicator.Domain
+	}
+	return indicator.Prefix
+}
+
+// annotate copies the indicator's metadata onto a matched flow. For domain
+// indicators, MatchedPrefix is set to the domain entry.
+func (indicator *Indicator) annotate(flow *pb.EnrichedFlow) {
+	flow.MatchedPrefix = indicator.String()
+	flow.RepScore = indicator.Score
+	flow.EventCategories = slices.Clone(indicator.Categories)
+	flow.Blacklists = slices.Clone(indicator.Blacklists)
+}
+
+// Options controlling how indicator lists are read.
+type ListOptions struct {
+	Format            string        // a format registered using RegisterFeedParser, "plain" if empty
+	ZeroOctetPrefixes bool          // read plain IPv4 addresses ending in .0 as /24 prefixes
+	MinRepScore       float64       // skip indicators with a lower reputation score, indicators without one are kept
+	BloomFilter       bool          // check a Bloom filter before searching, faster for lists with many prefix lengths
+	MaxAge            time.Duration // skip indicators whose last event is older, if the format provides one, 0 disables
+	Matcher           string        // a matcher registered using RegisterMatcher, "sorted" if empty
+}
+
+// readIndicatorList reads the list at path using the FeedParser registered
+// for the configured format, and builds the configured Matcher.
+func readIndicatorList(path string, options ListOptions) (*IndicatorSet, error) {
+	parser, err := lookupFeedParser(options.Format)
+	if err != nil {
+		return nil, err
+	}
+	buildMatcher, err := lookupMatcher(options.Matcher)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	set, err := parser.Parse(file, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxAge > 0 {
+		dropped, oldest := set.expire(time.Now().Add(-options.MaxAge))
+		if dropped > 0 {
+			log.Debug().Msgf("Matching: Skipped %d entries of %s with a last event older than %s.", dropped, path, options.MaxAge)
+		}
+		if !oldest.IsZero() {
+			set.expires = oldest.Add(options.MaxAge)
+		}
+	}
+	set.compact(options.BloomFilter)
+	set.matcher = buildMatcher(set)
+	return set, nil
+}
+
+// emptyIndicatorSet returns a set without any indicators which is ready for
+// lookups like one read by readIndicatorList.
+func emptyIndicatorSet(options ListOptions) (*IndicatorSet, error) {
+	buildMatcher, err := lookupMatcher(options.Matcher)
+	if err != nil {
+		return nil, err
+	}
+	set := &IndicatorSet{}
+	set.compact(options.BloomFilter)
+	set.matcher = buildMatcher(set)
+	return set, nil
+}
+
+// readPlainList reads a list with one entry per line. Empty lines and
+// everything following a '#' are ignored. See parsePrefixes and parseDomain
+// for the accepted entry formats.
+func readPlainList(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	set := &IndicatorSet{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line, ports, err := cutPortConstraints(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		if line == "" {
+			continue
+		}
+		prefixes, err := parsePrefixes(line, options.ZeroOctetPrefixes)
+		if err != nil {
+			if domain, domainErr := parseDomain(line); domainErr == nil {
+				set.InsertDomain(domain, &Indicator{Domain: domain, Ports: ports})
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		for _, prefix := range prefixes {
+			set.Insert(prefix, &Indicator{Prefix: prefix.String(), Ports: ports})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// cutPortConstraints splits the trailing port constraints off an entry of a
+// plain list. A constraint is a protocol name or number, optionally followed
+// by '/' and a port or port range, e.g. 'tcp/22', 'udp/53', 'tcp/8000-8099'
+// or 'gre'.
+func cutPortConstraints(line string) (string, []PortConstraint, error) {
+	fields := strings.Fields(line)
+	var ports []PortConstraint
+	for len(fields) > 1 {
+		last := fields[len(fields)-1]
+		proto, portRange, hasPorts := strings.Cut(strings.ToLower(last), "/")
+		number, known := protoNames[proto]
+		if !known {
+			parsed, err := strconv.ParseUint(proto, 10, 8)
+			if err != nil || hasPorts && parsed == 0 {
+				if hasPorts {
+					return "", nil, fmt.Errorf("invalid protocol in port constraint '%s'", last)
+				}
+				break // not a constraint, e.g. the end of a range
+			}
+			number = uint32(parsed)
+		}
+		c := PortConstraint{Proto: number}
+		if hasPorts {
+			from, to, isRange := strings.Cut(portRange, "-")
+			if !isRange {
+				to = from
+			}
+			fromPort, fromErr := strconv.ParseUint(from, 10, 16)
+			toPort, toErr := strconv.ParseUint(to, 10, 16)
+			if fromErr != nil || toErr != nil || fromPort == 0 || toPort < fromPort {
+				return "", nil, fmt.Errorf("invalid port range in port constraint '%s'", last)
+			}
+			c.FromPort, c.ToPort = uint32(fromPort), uint32(toPort)
+		}
+		ports = append(ports, c)
+		fields = fields[:len(fields)-1]
+	}
+	slices.Reverse(ports)
+	return strings.Join(fields, " "), ports, nil
+}
+
+// readNerdCSV reads a CSV export of the NERD reputation database as provided
+// by https://nerd.cesnet.cz. Columns are identified by the header line, only
+// 'ip' is required. Multi-valued columns are separated by '|'.
+func readNerdCSV(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	csvr := csv.NewReader(r)
+	csvr.FieldsPerRecord = -1
+	header, err := csvr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["ip"]; !ok {
+		return nil, errors.New("header does not contain an 'ip' column")
+	}
+
+	// entries without events fall back to when they were added, so that they
+	// can expire
+	lastEventColumns := []string{"ts_last_event"}
+	if options.MaxAge > 0 {
+		lastEventColumns = append(lastEventColumns, "ts_added")
+	}
+
+	set := &IndicatorSet{}
+	for {
+		row, err := csvr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := csvr.FieldPos(0)
+		column := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		var score float64
+		if s := column("rep_score"); s != "" {
+			score, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid rep_score: %w", line, err)
+			}
+			if score < options.MinRepScore {
+				continue
+			}
+		}
+		var asns []uint32
+		for _, s := range splitMultiValue(column("asn")) {
+			asn, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid asn: %w", line, err)
+			}
+			asns = append(asns, uint32(asn))
+		}
+		var lastEvent time.Time
+		for _, name := range lastEventColumns {
+			if s := column(name); s != "" {
+				lastEvent, err = time.Parse(time.RFC3339, s)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid %s: %w", line, name, err)
+				}
+				break
+			}
+		}
+
+		prefixes, err := parsePrefixes(column("ip"), options.ZeroOctetPrefixes)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		for _, prefix := range prefixes {
+			set.Insert(prefix, &Indicator{
+				Prefix:     prefix.String(),
+				Score:      score,
+				Categories: splitMultiValue(column("event_categories")),
+				Blacklists: splitMultiValue(column("blacklists")),
+				Tags:       splitMultiValue(column("tags")),
+				ASNs:       asns,
+				LastEvent:  lastEvent,
+			})
+		}
+	}
+	return set, nil
+}
+
+// splitMultiValue splits a '|' separated column value, omitting empty values.
+func splitMultiValue(value string) []string {
+	var result []string
+	for _, v := range strings.Split(value, "|") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// parsePrefixes converts a single list entry into one or more prefixes. It
+// accepts plain addresses, CIDR prefixes such as '203.0.113.0/24' or
+// '2001:db8:1234::/48' and dash ranges such as '192.0.2.10 - 192.0.2.20'. If
+// zeroOctetPrefixes is set, plain IPv4 addresses ending in '.0' are read as
+// the /24 they denote.
+func parsePrefixes(entry string, zeroOctetPrefixes bool) ([]netip.Prefix, error) {
+	if from, to, isRange := strings.Cut(entry, "-"); isRange {
+		start, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return nil, err
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return nil, err
+		}
+		return rangeToPrefixes(start.Unmap(), end.Unmap())
+	}
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return []netip.Prefix{prefix.Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return nil, err
+	}
+	addr = addr.Unmap()
+	if zeroOctetPrefixes && addr.Is4() && addr.As4()[3] == 0 {
+		return []netip.Prefix{netip.PrefixFrom(addr, 24)}, nil
+	}
+	return []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// parseDomain returns the normalized form of a domain entry, which is either a
+// domain name such as 'bad.example' or a wildcard such as '*.bad.example',
+// lower case and without a trailing dot. Entries whose last label is numeric
+// are rejected, so that malformed addresses are not taken for domains.
+func parseDomain(entry string) (string, error) {
+	domain := normalizeHostname(entry)
+	name, wildcard := strings.CutPrefix(domain, "*.")
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || (len(labels) < 2 && !wildcard) {
+		return "", fmt.Errorf("invalid domain '%s'", entry)
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("invalid domain '%s'", entry)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("invalid domain '%s'", entry)
+			}
+		}
+	}
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return "", fmt.Errorf("invalid domain '%s'", entry)
+	}
+	return domain, nil
+}
+
+// normalizeHostname returns hostname in lower case and without trailing dot,
+// as returned by reverse lookups.
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+}
+
+// rangeToPrefixes returns the shortest list of prefixes exactly covering all
+// addresses from start to end, both inclusive.
+func rangeToPrefixes(start netip.Addr, end netip.Addr) ([]netip.Prefix, error) {
+	if start.Is4() != end.Is4() {
+		return nil, fmt.Errorf("range %s - %s mixes address families", start, end)
+	}
+	if end.Less(start) {
+		return nil, fmt.Errorf("range %s - %s ends before it starts", start, end)
+	}
+	var prefixes []netip.Prefix
+	for {
+		// widen the prefix as long as it starts at start and ends
+		// within the range
+		bits := start.BitLen()
+		for bits > 0 {
+			candidate := netip.PrefixFrom(start, bits-1)
+			if candidate.Masked().Addr() != start || end.Less(lastAddr(candidate)) {
+				break
+			}
+			bits -= 1
+		}
+		prefix := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes, nil
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the highest address contained in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr().AsSlice()
+	for i := range addr {
+		hostBits := (i+1)*8 - prefix.Bits()
+		switch {
+		case hostBits >= 8:
+			addr[i] = 0xff
+		case hostBits > 0:
+			addr[i] |= 0xff >> (8 - hostBits)
+		}
+	}
+	last, _ := netip.AddrFromSlice(addr)
+	return last
+}
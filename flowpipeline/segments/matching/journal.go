@@ -0,0 +1,486 @@
+package matching
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// JournalParams configures the match journal, a record of every match
+// written independently of the flows passed on by the segment.
+type JournalParams struct {
+	Journal          string        // optional, default is "", which disables the journal, one of "jsonl" or "sqlite"
+	JournalPath      string        // required with Journal, a directory for "jsonl", a database file for "sqlite"
+	JournalZstd      bool          // optional, default is true, compress "jsonl" files
+	JournalRotate    time.Duration // optional, default is 24h, how often to start a new "jsonl" file and to apply JournalRetention
+	JournalRetention time.Duration // optional, default is 720h, how long to keep match events, 0 keeps them forever
+}
+
+// readJournalParams reads the journal config keys, logging any errors.
+func (params *JournalParams) readJournalParams(config map[string]string) bool {
+	params.JournalZstd = true
+	params.JournalRotate = 24 * time.Hour
+	params.JournalRetention = 720 * time.Hour
+	switch params.Journal = config["journal"]; params.Journal {
+	case "":
+		return true
+	case "jsonl", "sqlite":
+	default:
+		log.Error().Msgf("Matching: Unknown journal '%s', must be one of 'jsonl' or 'sqlite'.", params.Journal)
+		return false
+	}
+	if config["journal_path"] == "" {
+		log.Error().Msg("Matching: A 'journal_path' parameter is required with 'journal'.")
+		return false
+	}
+	params.JournalPath = segments.ContainerVolumePrefix + config["journal_path"]
+	if config["journal_zstd"] != "" {
+		compress, err := strconv.ParseBool(config["journal_zstd"])
+		if err != nil {
+			log.Error().Msg("Matching: Could not parse 'journal_zstd' parameter, must be a boolean.")
+			return false
+		}
+		params.JournalZstd = compress
+	}
+	if config["journal_rotate"] != "" {
+		rotate, err := time.ParseDuration(config["journal_rotate"])
+		if err != nil || rotate <= 0 {
+			log.Error().Msg("Matching: Could not parse 'journal_rotate' parameter, must be a positive duration such as '24h'.")
+			return false
+		}
+		params.JournalRotate = rotate
+	}
+	if config["journal_retention"] != "" {
+		retention, err := time.ParseDuration(config["journal_retention"])
+		if err != nil || retention < 0 {
+			log.Error().Msg("Matching: Could not parse 'journal_retention' parameter, must be a positive duration such as '720h' or 0.")
+			return false
+		}
+		params.JournalRetention = retention
+	}
+	return true
+}
+
+// A MatchEvent records a single matched flow along with the indicator it
+// matched.
+type MatchEvent struct {
+	Time       time.Time `json:"time"` // the end of the flow
+	List       string    `json:"list"`
+	Tid        uint32    `json:"tid"`
+	Indicator  string    `json:"indicator"`
+	Side       string    `json:"side"`      // which addresses matched, one of "src", "dst" or "both"
+	Direction  string    `json:"direction"` // "inbound" if the remote side is the source, else "outbound"
+	LocalAddr  string    `json:"local_addr"`
+	RemoteAddr string    `json:"remote_addr"`
+	Proto      uint32    `json:"proto"`
+	SrcPort    uint32    `json:"src_port"`
+	DstPort    uint32    `json:"dst_port"`
+	Bytes      uint64    `json:"bytes"`
+	Packets    uint64    `json:"packets"`
+	RepScore   float64   `json:"rep_score,omitempty"`
+	Categories []string  `json:"categories,omitempty"`
+	Blacklists []string  `json:"blacklists,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+}
+
+// newMatchEvent describes a flow tagged by list. The remote side is taken from
+// the RemoteAddr field if set, like for alerts, otherwise it is the matched
+// side, the source if both matched.
+func newMatchEvent(list *List, msg *pb.EnrichedFlow, indicator *Indicator, side pb.EnrichedFlow_MatchedSideType, src net.IP, dst net.IP) MatchEvent {
+	remote, local, direction := src, dst, "inbound"
+	switch msg.GetRemoteAddr() {
+	case pb.EnrichedFlow_Src:
+	case pb.EnrichedFlow_Dst:
+		remote, local, direction = dst, src, "outbound"
+	default:
+		if side == pb.EnrichedFlow_MatchedDst {
+			remote, local, direction = dst, src, "outbound"
+		}
+	}
+	return MatchEvent{
+		Time:       flowEndTime(msg),
+		List:       list.label(),
+		Tid:        msg.GetTid(),
+		Indicator:  indicator.String(),
+		Side:       sideLabels[side],
+		Direction:  direction,
+		LocalAddr:  local.String(),
+		RemoteAddr: remote.String(),
+		Proto:      msg.GetProto(),
+		SrcPort:    msg.GetSrcPort(),
+		DstPort:    msg.GetDstPort(),
+		Bytes:      msg.GetBytes(),
+		Packets:    msg.GetPackets(),
+		RepScore:   msg.GetRepScore(),
+		Categories: indicator.Categories,
+		Blacklists: indicator.Blacklists,
+		Tags:       indicator.Tags,
+	}
+}
+
+// A journalWriter stores match events. Its methods are only called from the
+// journal's background goroutine.
+type journalWriter interface {
+	write(events []MatchEvent) error
+	rotate(now time.Time) error // start a new file, if applicable, and drop events past retention
+	close() error
+}
+
+var (
+	journals      = make(map[string]*matchJournal)
+	journalClaims = make(map[string]*journalClaim) // by path, guarded by journalsLock
+	journalsLock  = &sync.Mutex{}
+)
+
+// A journalClaim records the params of a journal path configured by segments,
+// so that segments sharing a journal cannot configure it differently.
+type journalClaim struct {
+	params JournalParams
+	refs   int
+}
+
+// claimJournal reserves the journal path for a configured segment. It fails if
+// another segment configured the same path with different params. The
+// returned function releases the claim, it may be called more than once.
+// Segments release it once they run, when startJournal takes over checking
+// the params, so that the segments of a reloaded config can configure the
+// journal differently than the running ones they replace.
+func claimJournal(params JournalParams) (func(), error) {
+	if params.Journal == "" {
+		return func() {}, nil
+	}
+	journalsLock.Lock()
+	defer journalsLock.Unlock()
+	claim, ok := journalClaims[params.JournalPath]
+	if ok && claim.params != params {
+		return nil, fmt.Errorf("journal %s is already configured differently by another segment", params.JournalPath)
+	}
+	if !ok {
+		claim = &journalClaim{params: params}
+		journalClaims[params.JournalPath] = claim
+	}
+	claim.refs += 1
+	return sync.OnceFunc(func() {
+		journalsLock.Lock()
+		defer journalsLock.Unlock()
+		claim.refs -= 1
+		if claim.refs == 0 {
+			delete(journalClaims, params.JournalPath)
+		}
+	}), nil
+}
+
+// A matchJournal writes match events in the background, so that flows are
+// never held up by it. Events are dropped if the writer falls behind. It is
+// shared by all segments writing to the same path, in particular by all
+// parallel instances of a segment configured with 'jobs'.
+type matchJournal struct {
+	params  JournalParams
+	writer  journalWriter
+	events  chan MatchEvent
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	users int // guarded by journalsLock
+}
+
+// startJournal registers a running segment with the journal for its path,
+// opening it with the first one. Every call must be matched by a call to stop
+// on the result.
+func startJournal(params JournalParams) (*matchJournal, error) {
+	journalsLock.Lock()
+	defer journalsLock.Unlock()
+	if j, ok := journals[params.JournalPath]; ok {
+		if j.params != params {
+			return nil, fmt.Errorf("journal %s is already in use with different parameters", params.JournalPath)
+		}
+		j.users += 1
+		return j, nil
+	}
+	var writer journalWriter
+	var err error
+	switch params.Journal {
+	case "jsonl":
+		writer, err = newJsonlJournal(params.JournalPath, params.JournalZstd, params.JournalRetention)
+	case "sqlite":
+		writer, err = newSqliteJournal(params.JournalPath, params.JournalRetention)
+	default:
+		err = fmt.Errorf("unknown journal '%s'", params.Journal)
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := &matchJournal{
+		params: params,
+		writer: writer,
+		events: make(chan MatchEvent, 4096),
+		done:   make(chan struct{}),
+		users:  1,
+	}
+	go j.run()
+	journals[params.JournalPath] = j
+	log.Info().Msgf("Matching: Writing match events to %s journal at %s.", params.Journal, params.JournalPath)
+	return j, nil
+}
+
+// record queues an event for writing.
+func (j *matchJournal) record(event MatchEvent) {
+	select {
+	case j.events <- event:
+	default:
+		if dropped := j.dropped.Add(1); dropped == 1 || dropped%1000 == 0 {
+			log.Warn().Msgf("Matching: Journal %s is falling behind, dropped %d match events so far.", j.params.JournalPath, dropped)
+		}
+	}
+}
+
+// stop unregisters a running segment. Once the last one is done, all queued
+// events are written and the journal is closed.
+func (j *matchJournal) stop() {
+	journalsLock.Lock()
+	defer journalsLock.Unlock()
+	j.users -= 1
+	if j.users > 0 {
+		return
+	}
+	delete(journals, j.params.JournalPath)
+	close(j.events)
+	<-j.done
+	if err := j.writer.close(); err != nil {
+		log.Warn().Err(err).Msgf("Matching: Error closing journal %s: ", j.params.JournalPath)
+	}
+}
+
+// run writes events in batches of up to 1000 events or one second.
+func (j *matchJournal) run() {
+	defer close(j.done)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	rotate := time.NewTicker(j.params.JournalRotate)
+	defer rotate.Stop()
+
+	var batch []MatchEvent
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := j.writer.write(batch); err != nil {
+			log.Error().Err(err).Msgf("Matching: Failed writing %d match events to journal %s: ", len(batch), j.params.JournalPath)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case event, ok := <-j.events:
+			if !ok {
+				write()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= 1000 {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case now := <-rotate.C:
+			write()
+			if err := j.writer.rotate(now); err != nil {
+				log.Error().Err(err).Msgf("Matching: Failed rotating journal %s: ", j.params.JournalPath)
+			}
+		}
+	}
+}
+
+// jsonlJournal writes one JSON object per line to files named after the
+// time they were started, e.g. matches-20250810T120000Z.jsonl.zst.
+type jsonlJournal struct {
+	dir       string
+	compress  bool
+	retention time.Duration
+
+	file    *os.File
+	encoder *zstd.Encoder // nil without compression
+	writer  *bufio.Writer
+}
+
+func newJsonlJournal(dir string, compress bool, retention time.Duration) (*jsonlJournal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	j := &jsonlJournal{dir: dir, compress: compress, retention: retention}
+	if err := j.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *jsonlJournal) write(events []MatchEvent) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := j.writer.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	if j.encoder != nil {
+		// end the current block, so that all events written so far can be read
+		return j.encoder.Flush()
+	}
+	return nil
+}
+
+func (j *jsonlJournal) rotate(now time.Time) error {
+	if j.file != nil {
+		name := j.file.Name()
+		if err := j.close(); err != nil {
+			log.Warn().Err(err).Msgf("Matching: Error closing journal file %s: ", name)
+		}
+	}
+	j.expire(now)
+	name := "matches-" + now.UTC().Format("20060102T150405Z") + ".jsonl"
+	if j.compress {
+		name += ".zst"
+	}
+	file, err := os.OpenFile(filepath.Join(j.dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	j.file, j.encoder, j.writer = file, nil, bufio.NewWriter(file)
+	if j.compress {
+		j.encoder, err = zstd.NewWriter(file, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if err != nil {
+			file.Close()
+			return err
+		}
+		j.writer = bufio.NewWriter(j.encoder)
+	}
+	return nil
+}
+
+// expire removes journal files last written to before the retention period.
+func (j *jsonlJournal) expire(now time.Time) {
+	if j.retention == 0 {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(j.dir, "matches-*.jsonl*"))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Before(now.Add(-j.retention)) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Warn().Err(err).Msgf("Matching: Could not remove expired journal file %s: ", path)
+			continue
+		}
+		log.Info().Msgf("Matching: Removed expired journal file %s.", path)
+	}
+}
+
+func (j *jsonlJournal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.writer.Flush()
+	if j.encoder != nil {
+		if encoderErr := j.encoder.Close(); err == nil {
+			err = encoderErr
+		}
+	}
+	if fileErr := j.file.Close(); err == nil {
+		err = fileErr
+	}
+	j.file = nil
+	return err
+}
+
+// sqliteJournal writes to the 'matches' table of an sqlite database. Multi
+// valued fields are stored separated by '|'. The sqlite3 driver has to be
+// linked in, as done by the flowpipeline binary.
+type sqliteJournal struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+const sqliteJournalSchema = `CREATE TABLE IF NOT EXISTS matches (
+	time_ns INTEGER, list TEXT, tid INTEGER, indicator TEXT, side TEXT, direction TEXT,
+	local_addr TEXT, remote_addr TEXT, proto INTEGER, src_port INTEGER, dst_port INTEGER,
+	bytes INTEGER, packets INTEGER, rep_score REAL, categories TEXT, blacklists TEXT, tags TEXT);
+CREATE INDEX IF NOT EXISTS matches_time_ns ON matches (time_ns);
+CREATE INDEX IF NOT EXISTS matches_remote_addr ON matches (remote_addr);`
+
+func newSqliteJournal(path string, retention time.Duration) (*sqliteJournal, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteJournalSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	j := &sqliteJournal{db: db, retention: retention}
+	if err := j.rotate(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *sqliteJournal) write(events []MatchEvent) error {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	insert, err := tx.Prepare("INSERT INTO matches VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, e := range events {
+		_, err := insert.Exec(e.Time.UnixNano(), e.List, e.Tid, e.Indicator, e.Side, e.Direction,
+			e.LocalAddr, e.RemoteAddr, e.Proto, e.SrcPort, e.DstPort, int64(e.Bytes), int64(e.Packets), e.RepScore,
+			strings.Join(e.Categories, "|"), strings.Join(e.Blacklists, "|"), strings.Join(e.Tags, "|"))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (j *sqliteJournal) rotate(now time.Time) error {
+	if j.retention == 0 {
+		return nil
+	}
+	result, err := j.db.Exec("DELETE FROM matches WHERE time_ns < ?", now.Add(-j.retention).UnixNano())
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		log.Info().Msgf("Matching: Removed %d expired match events from journal.", deleted)
+	}
+	return nil
+}
+
+func (j *sqliteJournal) close() error {
+	return j.db.Close()
+}
@@ -0,0 +1,262 @@
+//go:build cgo
+// +build cgo
+
+package matching
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// runJournaled passes flows through a matching segment and returns once the
+// segment and its journal are done.
+func runJournaled(t *testing.T, config map[string]string, flows ...*pb.EnrichedFlow) {
+	segment := MatchingSegment{}.New(config)
+	if segment == nil {
+		t.Fatal("[error] Configuration error, could not initialize segment.")
+	}
+	runJournaledSegment(segment, flows...)
+}
+
+func runJournaledSegment(segment segments.Segment, flows ...*pb.EnrichedFlow) {
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for _, flow := range flows {
+		in <- flow
+		<-out
+	}
+	close(in)
+	wg.Wait()
+}
+
+var journaledFlows = []*pb.EnrichedFlow{
+	{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("198.51.100.7").To4(), Proto: 6, SrcPort: 50000, DstPort: 443, Bytes: 1500, TimeFlowEndNs: 1754836631000000000},
+	{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("192.0.2.2").To4()},
+}
+
+// Matching Segment test, match events are written to a zstd compressed journal
+func TestSegment_Matching_journalJSONL(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "journal")
+	runJournaled(t, map[string]string{"ip_list_path": writeTestList(t, testList), "journal": "jsonl", "journal_path": dir}, journaledFlows...)
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "matches-*.jsonl.zst"))
+	if len(paths) != 1 {
+		t.Fatalf("[error] Expected one journal file, got %v.", paths)
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	var events []MatchEvent
+	scanner := bufio.NewScanner(decoder)
+	for scanner.Scan() {
+		var event MatchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 1 {
+		t.Fatalf("[error] Expected one match event, got %d.", len(events))
+	}
+	event := events[0]
+	if event.Indicator != "198.51.100.7/32" || event.List != "bad_ip" || event.Side != "dst" || event.Direction != "outbound" ||
+		event.LocalAddr != "192.0.2.1" || event.RemoteAddr != "198.51.100.7" || event.DstPort != 443 || event.Bytes != 1500 ||
+		!event.Time.Equal(time.Unix(1754836631, 0)) {
+		t.Errorf("[error] Wrong match event: %+v", event)
+	}
+}
+
+// Matching Segment test, match events are written to an sqlite table
+func TestSegment_Matching_journalSqlite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matches.sqlite")
+	runJournaled(t, map[string]string{"ip_list_path": writeTestList(t, testList), "journal": "sqlite", "journal_path": path}, journaledFlows...)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var indicator, remote string
+	var dstPort int
+	err = db.QueryRow("SELECT indicator, remote_addr, dst_port FROM matches").Scan(&indicator, &remote, &dstPort)
+	if err != nil || indicator != "198.51.100.7/32" || remote != "198.51.100.7" || dstPort != 443 {
+		t.Errorf("[error] Wrong match event in sqlite journal: %s %s %d (%v)", indicator, remote, dstPort, err)
+	}
+
+	// events past retention are deleted on rotation
+	journal, err := newSqliteJournal(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM matches").Scan(&count); err != nil || count != 0 {
+		t.Errorf("[error] Expired match events were kept, got %d (%v).", count, err)
+	}
+}
+
+func TestJsonlJournal_retention(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "matches-20200101T000000Z.jsonl.zst")
+	other := filepath.Join(dir, "notes.txt")
+	for _, path := range []string{old, other} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal, err := newJsonlJournal(dir, false, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.write([]MatchEvent{{Indicator: "198.51.100.7/32"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.rotate(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); err == nil {
+		t.Error("[error] Expired journal file was kept.")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("[error] Unrelated file was removed.")
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "matches-*.jsonl"))
+	if len(paths) != 2 {
+		t.Errorf("[error] Expected two uncompressed journal files after rotation, got %v.", paths)
+	}
+}
+
+func TestSegment_Matching_journalInvalid(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"journal": "csv", "journal_path": "matches"},
+		{"journal": "jsonl"},
+		{"journal": "jsonl", "journal_path": "matches", "journal_rotate": "0s"},
+		{"journal": "sqlite", "journal_path": "matches.sqlite", "journal_retention": "forever"},
+	} {
+		config["ip_list_path"] = writeTestList(t, testList)
+		if segment := (MatchingSegment{}).New(config); segment != nil {
+			t.Errorf("[error] Segment Matching accepts invalid journal config %v.", config)
+		}
+	}
+}
+
+// Matching Segment test, segments sharing a journal have to configure it alike
+func TestSegment_Matching_journalMismatch(t *testing.T) {
+	dir := t.TempDir()
+	config := map[string]string{"ip_list_path": writeTestList(t, testList), "journal": "jsonl", "journal_path": dir}
+	first := MatchingSegment{}.New(config)
+	if first == nil {
+		t.Fatal("[error] Configuration error, could not initialize segment.")
+	}
+	second := MatchingSegment{}.New(config)
+	if second == nil {
+		t.Fatal("[error] Segment Matching rejects a journal configured alike.")
+	}
+	second.Close()
+	config["journal_rotate"] = "1h"
+	if segment := (MatchingSegment{}).New(config); segment != nil {
+		t.Error("[error] Segment Matching accepts a journal configured differently by another segment.")
+	}
+	first.Close()
+	if segment := (MatchingSegment{}).New(config); segment == nil {
+		t.Error("[error] Segment Matching rejects a journal which is no longer in use.")
+	} else {
+		segment.Close()
+	}
+}
+
+// Matching Segment test, a reloaded config can configure the journal of a
+// running segment differently
+func TestSegment_Matching_journalReload(t *testing.T) {
+	dir := t.TempDir()
+	config := map[string]string{"ip_list_path": writeTestList(t, testList), "journal": "jsonl", "journal_path": dir}
+	running := MatchingSegment{}.New(config)
+	if running == nil {
+		t.Fatal("[error] Configuration error, could not initialize segment.")
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	running.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go running.Run(wg)
+	in <- &pb.EnrichedFlow{}
+	<-out
+
+	config["journal_rotate"] = "1h"
+	reloaded := MatchingSegment{}.New(config)
+	if reloaded == nil {
+		t.Fatal("[error] Segment Matching rejects a journal configured differently by a running segment.")
+	}
+	close(in)
+	wg.Wait()
+	runJournaledSegment(reloaded, journaledFlows...)
+	if _, ok := journals[dir]; ok {
+		t.Error("[error] Journal was not closed after the reloaded segment stopped.")
+	}
+}
+
+func TestNewMatchEvent_remoteAddr(t *testing.T) {
+	list := &List{Note: "bad_ip"}
+	indicator := &Indicator{Prefix: "198.51.100.7/32"}
+	src, dst := net.ParseIP("198.51.100.7"), net.ParseIP("203.0.113.1")
+	for _, test := range []struct {
+		remoteAddr pb.EnrichedFlow_RemoteAddrType
+		side       pb.EnrichedFlow_MatchedSideType
+		remote     net.IP
+		direction  string
+	}{
+		{pb.EnrichedFlow_Neither, pb.EnrichedFlow_MatchedSrc, src, "inbound"},
+		{pb.EnrichedFlow_Neither, pb.EnrichedFlow_MatchedDst, dst, "outbound"},
+		{pb.EnrichedFlow_Neither, pb.EnrichedFlow_MatchedBoth, src, "inbound"},
+		{pb.EnrichedFlow_Dst, pb.EnrichedFlow_MatchedBoth, dst, "outbound"},
+		{pb.EnrichedFlow_Dst, pb.EnrichedFlow_MatchedSrc, dst, "outbound"},
+		{pb.EnrichedFlow_Src, pb.EnrichedFlow_MatchedDst, src, "inbound"},
+	} {
+		event := newMatchEvent(list, &pb.EnrichedFlow{RemoteAddr: test.remoteAddr}, indicator, test.side, src, dst)
+		if event.RemoteAddr != test.remote.String() || event.Direction != test.direction {
+			t.Errorf("[error] Match event of a flow with RemoteAddr %s matched on %s has remote address %s (%s), expected %s (%s).",
+				test.remoteAddr, test.side, event.RemoteAddr, event.Direction, test.remote, test.direction)
+		}
+	}
+}
+
+func TestJsonlJournal_rotateCloseError(t *testing.T) {
+	j, err := newJsonlJournal(t.TempDir(), true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.file.Close() // closing the encoder fails now
+	if err := j.rotate(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("[error] JsonlJournal failed rotating: %v", err)
+	}
+	j.close()
+}
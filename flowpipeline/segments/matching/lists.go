@@ -0,0 +1,247 @@
+package matching
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ReloadSignal triggers an immediate reload of all indicator lists in use.
+const ReloadSignal = syscall.SIGUSR1
+
+var (
+	lists        = make(map[listKey]*indicatorList)
+	loadFailures = make(map[listKey]uint64) // failed initial reads of lists not in use, guarded by listsLock
+	listsLock    = &sync.Mutex{}
+)
+
+type listKey struct {
+	path     string
+	options  ListOptions
+	interval time.Duration
+}
+
+// An indicatorList is an IndicatorSet read from a file which is replaced
+// atomically whenever the file changes. It is shared by all segments
+// referencing the same file with the same options, in particular by all
+// parallel instances of a segment configured with 'jobs'.
+type indicatorList struct {
+	path     string
+	options  ListOptions
+	interval time.Duration // how often to check the file for changes, 0 disables polling
+
+	current atomic.Pointer[IndicatorSet]
+	modTime time.Time
+	size    int64
+
+	lastReload     atomic.Int64  // unix time of the last successful read
+	reloadFailures atomic.Uint64 // number of failed reloads, including failed initial reads
+
+	updatedLock sync.Mutex
+	updated     chan struct{} // closed and replaced whenever a new version is swapped in
+	refresh     chan struct{} // asks watch to read the file again, see refreshLists
+
+	refs  int           // number of segments holding the list, guarded by listsLock
+	users int           // number of running segments, guarded by listsLock
+	stop  chan struct{} // closed once the last user is done
+}
+
+// getList returns the shared list for path and options, reading it if it is
+// not in use yet. Every call must be matched by a call to release. Failed
+// initial reads are remembered and counted as reload failures of the list
+// once it has been read, such as after a config reload. If missingOK is set,
+// a file which does not exist yet, such as the destination of a feed before
+// its first download, results in an empty list until it is read once running.
+func getList(path string, options ListOptions, interval time.Duration, missingOK bool) (*indicatorList, error) {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	key := listKey{path, options, interval}
+	if list, ok := lists[key]; ok {
+		list.refs += 1
+		return list, nil
+	}
+	list := &indicatorList{path: path, options: options, interval: interval, refresh: make(chan struct{}, 1)}
+	if err := list.reload(); errors.Is(err, fs.ErrNotExist) && missingOK {
+		set, err := emptyIndicatorSet(options)
+		if err != nil {
+			return nil, err
+		}
+		list.current.Store(set)
+	} else if err != nil {
+		loadFailures[key] += 1
+		return nil, err
+	}
+	list.reloadFailures.Store(loadFailures[key])
+	delete(loadFailures, key)
+	list.refs = 1
+	lists[key] = list
+	return list, nil
+}
+
+// release drops a segment's reference to the list. The list is forgotten once
+// no segment holds it anymore, so that later segments read it anew.
+func (list *indicatorList) release() {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	list.refs -= 1
+	if list.refs > 0 {
+		return
+	}
+	key := listKey{list.path, list.options, list.interval}
+	if lists[key] == list {
+		delete(lists, key)
+	}
+}
+
+// refreshLists makes all lists in use read path again, such as after a feed
+// replaced it, instead of waiting for the next check for changes.
+func refreshLists(path string) {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	for _, list := range lists {
+		if list.path != path {
+			continue
+		}
+		select {
+		case list.refresh <- struct{}{}:
+		default: // already pending
+		}
+	}
+}
+
+// Load returns the current IndicatorSet. The result must not be retained
+// across flows if reloads are to take effect.
+func (list *indicatorList) Load() *IndicatorSet {
+	return list.current.Load()
+}
+
+// Updated returns a channel which is closed once a new version of the list
+// has been swapped in.
+func (list *indicatorList) Updated() <-chan struct{} {
+	list.updatedLock.Lock()
+	defer list.updatedLock.Unlock()
+	if list.updated == nil {
+		list.updated = make(chan struct{})
+	}
+	return list.updated
+}
+
+// start registers a running segment and starts watching the file for changes
+// with the first one. Every call must be matched by a call to done.
+func (list *indicatorList) start() {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	list.users += 1
+	if list.users > 1 {
+		return
+	}
+	list.stop = make(chan struct{})
+	go list.watch(list.stop)
+}
+
+// done unregisters a running segment and stops watching the file once the
+// last one is done.
+func (list *indicatorList) done() {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	list.users -= 1
+	if list.users > 0 {
+		return
+	}
+	close(list.stop)
+}
+
+// watch reloads the list whenever its modification time or size change, as
+// checked every interval, as soon as an indicator exceeds the maximum age,
+// when its feed replaced the file, or when ReloadSignal is received. Expiry does not depend on the interval, so
+// that indicators expire with polling disabled as well.
+func (list *indicatorList) watch(stop <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, ReloadSignal)
+	defer signal.Stop(sigs)
+
+	var tick <-chan time.Time
+	if list.interval > 0 {
+		ticker := time.NewTicker(list.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	expiry := time.NewTimer(time.Hour)
+	defer expiry.Stop()
+	var retry time.Time // expired indicators are not dropped before this after a failed reload
+	for {
+		expiry.Stop()
+		if expires := list.Load().expires; !expires.IsZero() {
+			if retry.After(expires) {
+				expires = retry
+			}
+			expiry.Reset(time.Until(expires))
+		}
+		select {
+		case <-tick:
+			if !list.changed() {
+				continue
+			}
+		case <-expiry.C:
+			log.Debug().Msgf("Matching: Indicators of %s exceeded the maximum age.", list.path)
+		case <-sigs:
+			log.Info().Msgf("Matching: Received reload signal for %s.", list.path)
+		case <-list.refresh:
+		case <-stop:
+			return
+		}
+		if err := list.reload(); err != nil {
+			retry = time.Now().Add(time.Minute)
+			list.reloadFailures.Add(1)
+			log.Error().Err(err).Msgf("Matching: Failed reloading %s, keeping the previous version: ", list.path)
+		}
+	}
+}
+
+// changed reports whether the file looks different from the last time it was
+// read.
+func (list *indicatorList) changed() bool {
+	info, err := os.Stat(list.path)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Matching: Could not check %s for changes: ", list.path)
+		return false
+	}
+	return !info.ModTime().Equal(list.modTime) || info.Size() != list.size
+}
+
+// reload reads the file and swaps in the result. Lookups in progress keep
+// using the previous set. A file which fails to read is not retried until it
+// changes again.
+func (list *indicatorList) reload() error {
+	info, err := os.Stat(list.path)
+	if err != nil {
+		return err
+	}
+	list.modTime, list.size = info.ModTime(), info.Size()
+	set, err := readIndicatorList(list.path, list.options)
+	if err != nil {
+		return err
+	}
+	previous := list.current.Swap(set)
+	list.lastReload.Store(time.Now().Unix())
+	list.updatedLock.Lock()
+	if list.updated != nil {
+		close(list.updated)
+		list.updated = nil
+	}
+	list.updatedLock.Unlock()
+	if previous == nil {
+		log.Info().Msgf("Matching: Loaded %d entries from %s.", set.Len(), list.path)
+	} else {
+		added, removed := set.Diff(previous)
+		log.Info().Msgf("Matching: Reloaded %s, %d entries added, %d removed, %d total.", list.path, added, removed, set.Len())
+	}
+	return nil
+}
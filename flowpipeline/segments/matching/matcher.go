@@ -0,0 +1,190 @@
+package matching
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// A Matcher finds the most specific prefix of an indicator list containing
+// an address. Every list is read into an IndicatorSet, which keeps its
+// prefixes in sorted tables for reloads and comparisons, and a Matcher built
+// from it is used for all address lookups. Matchers have to be safe for
+// concurrent use.
+type Matcher interface {
+	// Match returns the indicator of the most specific prefix containing
+	// addr, or nil if there is none. IPv4 addresses are never passed in their
+	// IPv4-mapped IPv6 form. If flow is not nil, indicators whose port
+	// constraints it does not satisfy according to Indicator.Allows are
+	// skipped in favor of less specific ones.
+	Match(addr netip.Addr, flow *pb.EnrichedFlow) *Indicator
+}
+
+// A MatcherBuilder builds a Matcher for a compacted set, see
+// IndicatorSet.All.
+type MatcherBuilder func(set *IndicatorSet) Matcher
+
+var (
+	matchers     = make(map[string]MatcherBuilder)
+	matchersLock = &sync.RWMutex{}
+)
+
+// RegisterMatcher makes a lookup algorithm available to the 'matcher'
+// parameter. Errors and exits immediately on conflicts.
+func RegisterMatcher(name string, build MatcherBuilder) {
+	matchersLock.Lock()
+	defer matchersLock.Unlock()
+	if _, ok := matchers[name]; ok {
+		log.Fatal().Msgf("Matching: Tried to register conflicting matcher '%s'.", name)
+	}
+	matchers[name] = build
+}
+
+// lookupMatcher returns the builder for name, "sorted" if empty.
+func lookupMatcher(name string) (MatcherBuilder, error) {
+	if name == "" {
+		name = "sorted"
+	}
+	matchersLock.RLock()
+	defer matchersLock.RUnlock()
+	if build, ok := matchers[name]; ok {
+		return build, nil
+	}
+	names := make([]string, 0, len(matchers))
+	for name := range matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown matcher '%s', must be one of '%s'", name, strings.Join(names, "', '"))
+}
+
+// hashMatcher looks up every prefix length present in the list in a hash
+// map, longest first.
+type hashMatcher struct {
+	tables []hashTable
+}
+
+type hashTable struct {
+	is4     bool
+	bits    int // relative to the 128 bit key, as in prefixTable
+	entries map[prefixKey]*Indicator
+}
+
+func newHashMatcher(set *IndicatorSet) Matcher {
+	matcher := &hashMatcher{}
+	for t := range set.tables {
+		table := &set.tables[t]
+		hashed := hashTable{is4: table.is4, bits: table.bits, entries: make(map[prefixKey]*Indicator, len(table.keys))}
+		for i, key := range table.keys {
+			indicator := &Indicator{Prefix: table.prefix(key).String()}
+			if table.meta != nil && table.meta[i] != 0 {
+				indicator = set.indicators[table.meta[i]-1]
+			}
+			hashed.entries[key] = indicator
+		}
+		matcher.tables = append(matcher.tables, hashed) // set.tables is sorted longest first
+	}
+	return matcher
+}
+
+// Match implements Matcher.
+func (matcher *hashMatcher) Match(addr netip.Addr, flow *pb.EnrichedFlow) *Indicator {
+	is4 := addr.Is4()
+	key := keyFromAddr(addr)
+	for t := range matcher.tables {
+		table := &matcher.tables[t]
+		if table.is4 != is4 {
+			continue
+		}
+		indicator, ok := table.entries[key.mask(table.bits)]
+		if ok && (flow == nil || indicator.Allows(flow)) {
+			return indicator
+		}
+	}
+	return nil
+}
+
+// trieMatcher is a binary trie with one level per address bit, IPv4 and IPv6
+// addresses have separate roots.
+type trieMatcher struct {
+	root4, root6 *trieNode
+}
+
+type trieNode struct {
+	children  [2]*trieNode
+	indicator *Indicator // nil if no prefix ends here
+}
+
+func newTrieMatcher(set *IndicatorSet) Matcher {
+	matcher := &trieMatcher{root4: &trieNode{}, root6: &trieNode{}}
+	for prefix, indicator := range set.All() {
+		node, bit := matcher.root6, 0
+		if prefix.Addr().Is4() {
+			node, bit = matcher.root4, 96
+		}
+		key := keyFromAddr(prefix.Addr())
+		for end := bit + prefix.Bits(); bit < end; bit++ {
+			b := key.bit(bit)
+			if node.children[b] == nil {
+				node.children[b] = &trieNode{}
+			}
+			node = node.children[b]
+		}
+		node.indicator = indicator
+	}
+	return matcher
+}
+
+// Match implements Matcher.
+func (matcher *trieMatcher) Match(addr netip.Addr, flow *pb.EnrichedFlow) *Indicator {
+	node, bit := matcher.root6, 0
+	if addr.Is4() {
+		node, bit = matcher.root4, 96
+	}
+	key := keyFromAddr(addr)
+	var path [129]*Indicator // indicators passed on the way down, most specific last
+	var n int
+	for node != nil {
+		if node.indicator != nil {
+			path[n] = node.indicator
+			n += 1
+		}
+		if bit == 128 {
+			break
+		}
+		node = node.children[key.bit(bit)]
+		bit += 1
+	}
+	for i := n - 1; i >= 0; i-- {
+		if flow == nil || path[i].Allows(flow) {
+			return path[i]
+		}
+	}
+	return nil
+}
+
+// bit returns the i-th bit of the key, counting from the most significant.
+func (key prefixKey) bit(i int) int {
+	if i < 64 {
+		return int(key.hi>>(63-i)) & 1
+	}
+	return int(key.lo>>(127-i)) & 1
+}
+
+func init() {
+	RegisterMatcher("sorted", func(set *IndicatorSet) Matcher { return set })
+	RegisterMatcher("bloom", func(set *IndicatorSet) Matcher {
+		if set.bloom != nil {
+			return set
+		}
+		return set.withBloomFilter()
+	})
+	RegisterMatcher("hashmap", newHashMatcher)
+	RegisterMatcher("trie", newTrieMatcher)
+}
@@ -0,0 +1,168 @@
+package matching
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// The evaluation harness runs on the sample files by default. Other lists and
+// labelled flows can be evaluated using e.g.:
+//
+//	go test ./segments/matching -run TestEvaluateMatchers -v -args \
+//	    -eval.list nerd_export.csv -eval.format nerd-csv \
+//	    -eval.flows flows.json -eval.labels labels.txt
+var (
+	evalList     = flag.String("eval.list", "eval_list.txt", "indicator list for TestEvaluateMatchers")
+	evalFormat   = flag.String("eval.format", "plain", "format of -eval.list")
+	evalFlows    = flag.String("eval.flows", "eval_flows.json", "flows for TestEvaluateMatchers, one JSON object per line")
+	evalLabels   = flag.String("eval.labels", "eval_labels.txt", "one boolean per flow in -eval.flows, true if it should match")
+	evalMatchers = flag.String("eval.matchers", "sorted,bloom,hashmap,trie", "comma separated matchers to evaluate")
+	evalDuration = flag.Duration("eval.duration", 100*time.Millisecond, "minimum time to measure throughput for")
+)
+
+func TestEvaluateMatchers(t *testing.T) {
+	flows, labels, err := ReadLabelledFlows(*evalFlows, *evalLabels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evaluations, err := EvaluateMatchers(*evalList, ListOptions{Format: *evalFormat}, strings.Split(*evalMatchers, ","), flows, labels, *evalDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range evaluations {
+		t.Log(e)
+		if e.TruePositives != evaluations[0].TruePositives || e.FalsePositives != evaluations[0].FalsePositives {
+			t.Errorf("[error] Matcher %s disagrees with %s.", e.Matcher, evaluations[0].Matcher)
+		}
+	}
+	if *evalList == "eval_list.txt" && *evalFlows == "eval_flows.json" {
+		e := evaluations[0]
+		if e.TruePositives != 6 || e.FalsePositives != 1 || e.FalseNegatives != 1 || e.TrueNegatives != 4 {
+			t.Errorf("[error] Wrong evaluation of the sample files: %s", e)
+		}
+	}
+}
+
+func TestReadLabelledFlows(t *testing.T) {
+	labels := filepath.Join(t.TempDir(), "labels.txt")
+	if err := os.WriteFile(labels, []byte("true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadLabelledFlows("eval_flows.json", labels); err == nil {
+		t.Error("[error] Accepted fewer labels than flows.")
+	}
+}
+
+// randomSet returns a set of n random prefixes, some with port constraints.
+func randomSet(n int, seed int64) *IndicatorSet {
+	rng := rand.New(rand.NewSource(seed))
+	set := &IndicatorSet{}
+	for i := 0; i < n; i++ {
+		var prefix netip.Prefix
+		if rng.Intn(4) == 0 {
+			var b [16]byte
+			rng.Read(b[:])
+			prefix = netip.PrefixFrom(netip.AddrFrom16(b), 16+rng.Intn(113)).Masked()
+		} else {
+			var b [4]byte
+			rng.Read(b[:])
+			prefix = netip.PrefixFrom(netip.AddrFrom4(b), 8+rng.Intn(25)).Masked()
+		}
+		indicator := &Indicator{Prefix: prefix.String()}
+		if rng.Intn(10) == 0 {
+			indicator.Ports = []PortConstraint{{Proto: 6, FromPort: 22, ToPort: 22}}
+		}
+		set.Insert(prefix, indicator)
+	}
+	set.compact(false)
+	return set
+}
+
+// randomAddr returns an address within a random prefix of set, or a random
+// address.
+func randomAddr(rng *rand.Rand, prefixes []netip.Prefix) net.IP {
+	if rng.Intn(2) == 0 {
+		prefix := prefixes[rng.Intn(len(prefixes))]
+		b := prefix.Addr().AsSlice()
+		for i := prefix.Bits() / 8; i < len(b); i++ {
+			b[i] |= byte(rng.Intn(256)) & (0xff >> max(0, prefix.Bits()-i*8))
+		}
+		return net.IP(b)
+	}
+	b := make([]byte, 4)
+	rng.Read(b)
+	return net.IP(b)
+}
+
+func TestMatchers_agree(t *testing.T) {
+	set := randomSet(5000, 1)
+	prefixes := set.Prefixes()
+	rng := rand.New(rand.NewSource(2))
+	for _, name := range []string{"bloom", "hashmap", "trie"} {
+		build, err := lookupMatcher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matcher := build(set)
+		if set.bloom != nil || set.matcher != nil {
+			t.Fatalf("[error] Matcher %s modified the set it was built from.", name)
+		}
+		for i := 0; i < 20000; i++ {
+			ip := randomAddr(rng, prefixes)
+			addr, _ := netip.AddrFromSlice(ip)
+			flow := &pb.EnrichedFlow{Proto: uint32(6 + 11*rng.Intn(2)), DstPort: uint32(22 + rng.Intn(2))}
+			expected, got := set.Match(addr.Unmap(), flow), matcher.Match(addr.Unmap(), flow)
+			if (expected == nil) != (got == nil) || (expected != nil && expected.Prefix != got.Prefix) {
+				t.Fatalf("[error] Matcher %s returned %v for %s, sorted tables %v.", name, got, addr, expected)
+			}
+		}
+	}
+	if _, err := lookupMatcher("linear"); err == nil {
+		t.Error("[error] Unknown matcher accepted.")
+	}
+}
+
+// Matching Segment test, the matcher can be selected
+func TestSegment_Matching_matcher(t *testing.T) {
+	for _, name := range []string{"sorted", "bloom", "hashmap", "trie"} {
+		result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList), "matcher": name},
+			&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("203.0.113.200").To4()})
+		if result.MatchedPrefix != "203.0.113.128/25" {
+			t.Errorf("[error] Segment Matching with matcher %s got '%s'.", name, result.MatchedPrefix)
+		}
+	}
+	if segment := (MatchingSegment{}).New(map[string]string{"ip_list_path": writeTestList(t, testList), "matcher": "linear"}); segment != nil {
+		t.Error("[error] Segment Matching accepts an unknown matcher.")
+	}
+}
+
+func BenchmarkMatchers(b *testing.B) {
+	set := randomSet(100000, 1)
+	prefixes := set.Prefixes()
+	rng := rand.New(rand.NewSource(2))
+	addrs := make([]netip.Addr, 4096)
+	for i := range addrs {
+		addrs[i], _ = netip.AddrFromSlice(randomAddr(rng, prefixes))
+		addrs[i] = addrs[i].Unmap()
+	}
+	for _, name := range []string{"sorted", "bloom", "hashmap", "trie"} {
+		build, _ := lookupMatcher(name)
+		matcher := build(set)
+		b.Run(fmt.Sprintf("matcher=%s", name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matcher.Match(addrs[i%len(addrs)], nil)
+			}
+		})
+	}
+}
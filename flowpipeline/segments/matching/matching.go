@@ -1,116 +1,579 @@
+// Tags flows whose source or destination address is contained in an indicator
+// list, i.e. a blocklist of addresses, CIDR prefixes or address ranges. The
+// most specific matching prefix is written to the MatchedPrefix field, along
+// with any reputation data the list provides for it. Domain entries of a list
+// are matched against the host names set by the reversedns segment, for such
+// matches MatchedPrefix holds the domain entry instead. Several named lists
+// with their own tag IDs can be configured, the first matching list wins.
 package matching
 
 import (
-	"bufio"
-	"fmt"
-	"log"
+	"errors"
+	"io/fs"
+	"math"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 )
 
 type MatchingSegment struct {
 	segments.BaseSegment
-	CSVData    map[string]string
-	ipListPath string
+	PrometheusParams
+	JournalParams
+	Lists          []*List       // the lists to match against, in order of priority
+	ReloadInterval time.Duration // optional, default is 1m, how often to check the lists for changes, 0 disables
+
+	releaseJournal func() // releases the claim on the journal path, see claimJournal
+}
+
+// A List is a single named indicator list along with the tag it applies to
+// matching flows.
+type List struct {
+	Name              string        // optional, default is "" for the single list configured without 'lists'
+	IPListPath        string        // optional, default is "segments/matching/bad_ips.txt", required for named lists
+	TagID             uint32        // optional, default is 65001, required for named lists
+	Note              string        // optional, default is "bad_ip", or the name for named lists
+	DomainTagID       uint32        // optional, default is 65010, or TagID for named lists, the tag ID for flows matching by host name
+	DomainNote        string        // optional, default is "bad_domain", or Note for named lists
+	Format            string        // optional, default is "plain", the list format, see RegisterFeedParser
+	ZeroOctetPrefixes bool          // optional, default is false, read plain IPv4 addresses ending in .0 as /24 prefixes
+	MinRepScore       float64       // optional, default is 0, ignore indicators with a lower reputation score
+	BloomFilter       bool          // optional, default is false, check a Bloom filter before searching the list
+	Matcher           string        // optional, default is "sorted", the lookup algorithm, see RegisterMatcher
+	MaxAge            time.Duration // optional, default is 0, ignore indicators whose last event is older, 0 disables
+	ScoreHalfLife     time.Duration // optional, default is 0, halve the reported reputation score each time an indicator's last event ages by this, 0 disables
+	UpdateURL         string        // optional, default is "", an http(s):// or file:// URL to keep the list updated from
+	UpdateInterval    time.Duration // optional, default is 1h, how often to check UpdateURL for a new version
+	UpdateMinLines    int           // optional, default is 1, reject updates with fewer non-empty, non-comment lines not counting headers, 0 disables
+	Direction         string        // optional, default is "both", which addresses to look up, one of "both", "remote", "inbound" or "outbound"
+	AllowlistPath     string        // optional, default is "", a file of rules suppressing matches, see readAllowRules
+	AllowTags         []string      // optional, default is none, suppress matches of indicators with any of these tags
+
+	list       *indicatorList
+	feed       *feedUpdater
+	allowlist  *allowlist
+	suppressed atomic.Uint64 // number of matches suppressed by the allowlist
+	released   sync.Once
 }
 
+// Config keys which apply to a single list only and are not inherited by
+// named lists from the top level.
+var listOnlyKeys = map[string]bool{"ip_list_path": true, "tid": true, "note": true, "domain_tid": true, "domain_note": true, "update_url": true}
+
 // New implements segments.Segment.
-func (m *MatchingSegment) New(config map[string]string) segments.Segment {
-	println("Initializing matching segment....")
+func (segment MatchingSegment) New(config map[string]string) segments.Segment {
+	newsegment := &MatchingSegment{
+		ReloadInterval: time.Minute,
+	}
+	newsegment.InitDefaultPrometheusParams()
+	newsegment.Endpoint = config["endpoint"]
+	if config["metricspath"] != "" {
+		newsegment.MetricsPath = config["metricspath"]
+	}
+	if config["top_indicators"] != "" {
+		topIndicators, err := strconv.Atoi(config["top_indicators"])
+		if err != nil || topIndicators < 0 {
+			log.Error().Msg("Matching: Could not parse 'top_indicators' parameter, must be a positive integer or 0.")
+			return nil
+		}
+		newsegment.TopIndicators = topIndicators
+	}
+	if config["reload_interval"] != "" {
+		reloadInterval, err := time.ParseDuration(config["reload_interval"])
+		if err != nil || reloadInterval < 0 {
+			log.Error().Msg("Matching: Could not parse 'reload_interval' parameter, must be a positive duration such as '30s' or 0.")
+			return nil
+		}
+		newsegment.ReloadInterval = reloadInterval
+	} else {
+		log.Info().Msg("Matching: 'reload_interval' set to default '1m'.")
+	}
+	if !newsegment.readJournalParams(config) {
+		return nil
+	}
 
-	m.CSVData = make(map[string]string)
-	m.ipListPath = "segments/matching/bad_ips.txt"
-	if p, ok := config["ip_list_path"]; ok && strings.TrimSpace(p) != "" {
-		m.ipListPath = p
+	if config["lists"] == "" {
+		list := newsegment.newList("", config)
+		if list == nil {
+			return nil
+		}
+		newsegment.Lists = append(newsegment.Lists, list)
+		return newsegment.claimJournal()
 	}
 
-	return m
-}
+	names := make(map[string]bool)
+	for _, name := range strings.Split(config["lists"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.Contains(name, ".") || names[name] {
+			log.Error().Msgf("Matching: Invalid or duplicate list name '%s' in 'lists' parameter.", name)
+			return nil
+		}
+		names[name] = true
 
-// Run implements segments.Segment.
-func (m *MatchingSegment) Run(wg *sync.WaitGroup) {
-	defer func() {
-		close(m.Out)
-		wg.Done()
-	}()
+		// named lists inherit the top level options unless they set their own
+		listConfig := make(map[string]string)
+		for key, value := range config {
+			if !listOnlyKeys[key] && !strings.Contains(key, ".") {
+				listConfig[key] = value
+			}
+		}
+		for key, value := range config {
+			if strings.HasPrefix(key, name+".") {
+				listConfig[strings.TrimPrefix(key, name+".")] = value
+			}
+		}
+		list := newsegment.newList(name, listConfig)
+		if list == nil {
+			newsegment.Close()
+			return nil
+		}
+		newsegment.Lists = append(newsegment.Lists, list)
+	}
+	for key := range config {
+		if name, _, found := strings.Cut(key, "."); found && !names[name] {
+			log.Warn().Msgf("Matching: Ignoring '%s' parameter, '%s' is not in 'lists'.", key, name)
+		} else if !found && listOnlyKeys[key] {
+			log.Warn().Msgf("Matching: Ignoring '%s' parameter, it has to be set per list when using 'lists'.", key)
+		}
+	}
+	return newsegment.claimJournal()
+}
 
-	// Initialization stage: load IP list once
-	file, err := os.Open(m.ipListPath)
+// claimJournal finishes New by claiming the configured journal path, see
+// claimJournal. It returns nil if this fails.
+func (segment *MatchingSegment) claimJournal() segments.Segment {
+	release, err := claimJournal(segment.JournalParams)
 	if err != nil {
-		log.Fatalf("matching: failed to open ip list file '%s': %v", m.ipListPath, err)
+		log.Error().Err(err).Msg("Matching: Could not use 'journal_path' parameter: ")
+		segment.Close()
+		return nil
+	}
+	segment.releaseJournal = release
+	return segment
+}
+
+// newList reads the config of a single list. For named lists, config has the
+// list's own keys with the name prefix removed.
+func (segment *MatchingSegment) newList(name string, config map[string]string) *List {
+	param := func(key string) string { // how to refer to a key in logs
+		if name == "" {
+			return key
+		}
+		return name + "." + key
+	}
+	newlist := &List{
+		Name:           name,
+		IPListPath:     "segments/matching/bad_ips.txt",
+		TagID:          TagIDBadIP,
+		Note:           "bad_ip",
+		UpdateInterval: time.Hour,
+		UpdateMinLines: 1,
+	}
+	if name != "" {
+		newlist.Note = name
+		if config["ip_list_path"] == "" || config["tid"] == "" {
+			log.Error().Msgf("Matching: Parameters '%s' and '%s' are required for named lists.", param("ip_list_path"), param("tid"))
+			return nil
+		}
+	}
+	if p := strings.TrimSpace(config["ip_list_path"]); p != "" {
+		newlist.IPListPath = p
+	} else {
+		log.Info().Msgf("Matching: 'ip_list_path' set to default '%s'.", newlist.IPListPath)
+	}
+	if config["tid"] != "" {
+		tid, err := strconv.ParseUint(config["tid"], 10, 32)
+		if err != nil || tid == 0 {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a positive integer.", param("tid"))
+			return nil
+		}
+		newlist.TagID = uint32(tid)
+	}
+	if config["note"] != "" {
+		newlist.Note = config["note"]
 	}
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	newlist.DomainTagID, newlist.DomainNote = TagIDBadDomain, "bad_domain"
+	if name != "" {
+		newlist.DomainTagID, newlist.DomainNote = newlist.TagID, newlist.Note
+	}
+	if config["domain_tid"] != "" {
+		tid, err := strconv.ParseUint(config["domain_tid"], 10, 32)
+		if err != nil || tid == 0 {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a positive integer.", param("domain_tid"))
+			return nil
+		}
+		newlist.DomainTagID = uint32(tid)
+	}
+	if config["domain_note"] != "" {
+		newlist.DomainNote = config["domain_note"]
+	}
+	switch config["direction"] {
+	case "", "both":
+		newlist.Direction = "both"
+	case "remote", "inbound", "outbound":
+		newlist.Direction = config["direction"]
+	default:
+		log.Error().Msgf("Matching: Unknown direction '%s' in '%s', must be one of 'both', 'remote', 'inbound' or 'outbound'.", config["direction"], param("direction"))
+		return nil
+	}
+	if config["zero_octet_prefixes"] != "" {
+		zeroOctetPrefixes, err := strconv.ParseBool(config["zero_octet_prefixes"])
+		if err != nil {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a boolean.", param("zero_octet_prefixes"))
+			return nil
+		}
+		newlist.ZeroOctetPrefixes = zeroOctetPrefixes
+	}
+	newlist.Format = "plain"
+	if config["format"] != "" {
+		if _, err := lookupFeedParser(config["format"]); err != nil {
+			log.Error().Err(err).Msgf("Matching: Could not use '%s' parameter: ", param("format"))
+			return nil
 		}
-		m.CSVData[line] = "bad_ip"
+		newlist.Format = config["format"]
 	}
-	if err := scanner.Err(); err != nil {
-		_ = file.Close()
-		log.Fatalf("matching: error reading ip list file '%s': %v", m.ipListPath, err)
+	if config["min_rep_score"] != "" {
+		minRepScore, err := strconv.ParseFloat(config["min_rep_score"], 64)
+		if err != nil {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a number.", param("min_rep_score"))
+			return nil
+		}
+		newlist.MinRepScore = minRepScore
 	}
-	if err := file.Close(); err != nil {
-		log.Fatalf("matching: error closing ip list file '%s': %v", m.ipListPath, err)
+
+	if config["bloom_filter"] != "" {
+		bloomFilter, err := strconv.ParseBool(config["bloom_filter"])
+		if err != nil {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a boolean.", param("bloom_filter"))
+			return nil
+		}
+		newlist.BloomFilter = bloomFilter
 	}
-	fmt.Printf("matching: loaded %d IPs from %s\n", len(m.CSVData), m.ipListPath)
 
-	// Processing stage: continuous loop on incoming flows
-	for msg := range m.In {
-		matched := false
-		// Prefer existing string fields if populated, otherwise derive from bytes
-		src := msg.GetSourceIP()
-		if src == "" {
-			src = net.IP(msg.GetSrcAddr()).String()
+	if config["matcher"] != "" {
+		if _, err := lookupMatcher(config["matcher"]); err != nil {
+			log.Error().Err(err).Msgf("Matching: Could not use '%s' parameter: ", param("matcher"))
+			return nil
+		}
+		newlist.Matcher = config["matcher"]
+	}
+	if config["max_age"] != "" {
+		maxAge, err := time.ParseDuration(config["max_age"])
+		if err != nil || maxAge < 0 {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a positive duration such as '720h' or 0.", param("max_age"))
+			return nil
 		}
-		dst := msg.GetDestinationIP()
-		if dst == "" {
-			dst = net.IP(msg.GetDstAddr()).String()
+		newlist.MaxAge = maxAge
+	}
+	if config["score_half_life"] != "" {
+		scoreHalfLife, err := time.ParseDuration(config["score_half_life"])
+		if err != nil || scoreHalfLife < 0 {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a positive duration such as '168h' or 0.", param("score_half_life"))
+			return nil
 		}
+		newlist.ScoreHalfLife = scoreHalfLife
+	}
 
-		if src != "" {
-			if _, ok := m.CSVData[src]; ok {
-				matched = true
+	if config["allow_tags"] != "" {
+		for _, tag := range strings.Split(config["allow_tags"], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				newlist.AllowTags = append(newlist.AllowTags, tag)
 			}
 		}
-		if dst != "" {
-			if _, ok := m.CSVData[dst]; ok {
-				matched = true
+	}
+	newlist.AllowlistPath = strings.TrimSpace(config["allowlist_path"])
+	if newlist.AllowlistPath != "" || len(newlist.AllowTags) > 0 {
+		allowlistPath := newlist.AllowlistPath
+		if allowlistPath != "" {
+			allowlistPath = segments.ContainerVolumePrefix + allowlistPath
+		}
+		allow, err := newAllowlist(allowlistPath, newlist.AllowTags, segment.ReloadInterval)
+		if err != nil {
+			log.Error().Err(err).Msgf("Matching: Could not read allowlist '%s': ", newlist.AllowlistPath)
+			return nil
+		}
+		newlist.allowlist = allow
+	}
+
+	options := ListOptions{
+		Format:            newlist.Format,
+		ZeroOctetPrefixes: newlist.ZeroOctetPrefixes,
+		MinRepScore:       newlist.MinRepScore,
+		BloomFilter:       newlist.BloomFilter,
+		MaxAge:            newlist.MaxAge,
+		Matcher:           newlist.Matcher,
+	}
+	path := segments.ContainerVolumePrefix + newlist.IPListPath
+
+	if config["update_interval"] != "" {
+		updateInterval, err := time.ParseDuration(config["update_interval"])
+		if err != nil || updateInterval <= 0 {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a positive duration such as '1h'.", param("update_interval"))
+			return nil
+		}
+		newlist.UpdateInterval = updateInterval
+	}
+	if config["update_min_lines"] != "" {
+		updateMinLines, err := strconv.Atoi(config["update_min_lines"])
+		if err != nil || updateMinLines < 0 {
+			log.Error().Msgf("Matching: Could not parse '%s' parameter, must be a positive integer or 0.", param("update_min_lines"))
+			return nil
+		}
+		newlist.UpdateMinLines = updateMinLines
+	}
+	if newlist.UpdateURL = strings.TrimSpace(config["update_url"]); newlist.UpdateURL != "" {
+		feed, err := newFeedUpdater(newlist.UpdateURL, path, newlist.UpdateInterval, newlist.UpdateMinLines, func(path string) error {
+			_, err := readIndicatorList(path, options)
+			return err
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("Matching: Could not use '%s' parameter: ", param("update_url"))
+			return nil
+		}
+		feed.HeaderLines = feedHeaderLines[newlist.Format]
+		newlist.feed = feed
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			log.Info().Msgf("Matching: %s does not exist yet, it is fetched from %s once the segment runs.", path, newlist.UpdateURL)
+		}
+	}
+
+	list, err := getList(path, options, segment.ReloadInterval, newlist.feed != nil)
+	if err != nil {
+		log.Error().Err(err).Msgf("Matching: Could not read ip list '%s': ", newlist.IPListPath)
+		return nil
+	}
+	newlist.list = list
+	return newlist
+}
+
+// Run implements segments.Segment.
+func (segment *MatchingSegment) Run(wg *sync.WaitGroup) {
+	var feeds []*feedUpdater
+	for _, list := range segment.Lists {
+		list.list.start()
+		list.allowlist.start()
+		if list.feed != nil {
+			feeds = append(feeds, startFeed(list.feed))
+		}
+	}
+	var exporter *PrometheusExporter
+	if segment.Endpoint != "" {
+		exporter = startExporter(segment.PrometheusParams)
+		for _, list := range segment.Lists {
+			exporter.addList(list.label(), list.list)
+		}
+	}
+	var journal *matchJournal
+	if segment.Journal != "" {
+		var err error
+		if journal, err = startJournal(segment.JournalParams); err != nil {
+			log.Error().Err(err).Msgf("Matching: Could not open journal %s, match events are not recorded: ", segment.JournalPath)
+		}
+	}
+	if segment.releaseJournal != nil {
+		segment.releaseJournal()
+	}
+	defer func() {
+		if journal != nil {
+			journal.stop()
+		}
+		if exporter != nil {
+			exporter.done()
+		}
+		for _, feed := range feeds {
+			feed.done()
+		}
+		for _, list := range segment.Lists {
+			list.allowlist.done()
+			list.list.done()
+			list.release()
+			if suppressed := list.suppressed.Load(); suppressed > 0 {
+				log.Info().Msgf("Matching: Suppressed %d matches of list '%s' by allowlist rules.", suppressed, list.label())
 			}
 		}
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	for msg := range segment.In {
+		src, dst := flowAddresses(msg)
 
-		if matched {
+		// the first list containing a checked address wins
+		for _, list := range segment.Lists {
+			indicator, side, suppressedBy := list.match(list.list.Load(), msg, src, dst)
+			if indicator == nil {
+				if suppressedBy != nil {
+					list.suppressed.Add(1)
+					if exporter != nil {
+						exporter.suppress(list.label(), suppressedBy.label())
+					}
+					log.Debug().Msgf("Matching: Flow %s -> %s is on list '%s', but allowed by rule '%s' (%s).", src, dst, list.Note, suppressedBy.text, suppressedBy.label())
+				}
+				continue
+			}
 			// Tag matched flows so they can be filtered downstream
-			TagAsBadIP(msg)
+			list.tag(msg, indicator, side)
+			if exporter != nil {
+				exporter.hit(list.label(), sideLabels[side], indicator.String())
+			}
+			if journal != nil {
+				journal.record(newMatchEvent(list, msg, indicator, side, src, dst))
+			}
+			log.Debug().Msgf("Matching: %s of flow %s -> %s is on list '%s' (%s).", side, src, dst, list.Note, indicator)
+			break
+		}
+
+		segment.Out <- msg
+	}
+}
+
+// Close implements segments.Segment. It releases the lists of a segment which
+// has been constructed but is never run, such as when building the pipeline
+// fails later on.
+func (segment *MatchingSegment) Close() {
+	for _, list := range segment.Lists {
+		list.release()
+	}
+	if segment.releaseJournal != nil {
+		segment.releaseJournal()
+	}
+}
+
+// release drops the reference to the shared list, at most once.
+func (list *List) release() {
+	list.released.Do(list.list.release)
+}
+
+// tag marks a flow as matching indicator of this list. Matches by host name
+// use the list's DomainTagID.
+func (list *List) tag(msg *pb.EnrichedFlow, indicator *Indicator, side pb.EnrichedFlow_MatchedSideType) {
+	if indicator.Domain != "" {
+		TagWithID(msg, list.DomainTagID, list.DomainNote)
+	} else {
+		TagWithID(msg, list.TagID, list.Note)
+	}
+	indicator.annotate(msg)
+	msg.MatchedSide = side
+	if list.ScoreHalfLife > 0 && !indicator.LastEvent.IsZero() {
+		msg.RepScore = decayScore(indicator.Score, time.Since(indicator.LastEvent), list.ScoreHalfLife)
+	}
+}
+
+// decayScore halves score for every halfLife of age.
+func decayScore(score float64, age time.Duration, halfLife time.Duration) float64 {
+	if age <= 0 {
+		return score
+	}
+	return score * math.Exp2(-age.Seconds()/halfLife.Seconds())
+}
+
+// label identifies the list in metrics.
+func (list *List) label() string {
+	if list.Name != "" {
+		return list.Name
+	}
+	return list.Note
+}
+
+var sideLabels = map[pb.EnrichedFlow_MatchedSideType]string{
+	pb.EnrichedFlow_MatchedSrc:  "src",
+	pb.EnrichedFlow_MatchedDst:  "dst",
+	pb.EnrichedFlow_MatchedBoth: "both",
+}
 
-			if src != "" && m.CSVData[src] != "" {
-				fmt.Printf("MATCH FOUND! IP: %s is on the blocklist\n", src)
-			} else if dst != "" && m.CSVData[dst] != "" {
-				fmt.Printf("MATCH FOUND! IP: %s is on the blocklist\n", dst)
+// match looks up the flow addresses selected by the list's Direction in
+// indicators, usually the current version of the list, and the host names of
+// sides whose address is not found. Indicators with port constraints the flow
+// does not satisfy are skipped. If both sides are found, the source's
+// indicator is returned. Matches suppressed by the list's
+// allowlist are skipped, if this leaves no match the suppressing rule is
+// returned.
+func (list *List) match(indicators *IndicatorSet, msg *pb.EnrichedFlow, src net.IP, dst net.IP) (*Indicator, pb.EnrichedFlow_MatchedSideType, *allowRule) {
+	checkSrc, checkDst := sidesToCheck(list.Direction, msg)
+	var srcIndicator, dstIndicator *Indicator
+	if checkSrc {
+		srcIndicator = indicators.LookupFlow(src, msg)
+		if srcIndicator == nil {
+			srcIndicator = indicators.LookupHostnameFlow(msg.GetSrcHostName(), msg)
+		}
+	}
+	if checkDst {
+		dstIndicator = indicators.LookupFlow(dst, msg)
+		if dstIndicator == nil {
+			dstIndicator = indicators.LookupHostnameFlow(msg.GetDstHostName(), msg)
+		}
+	}
+	var suppressedBy *allowRule
+	if list.allowlist != nil && (srcIndicator != nil || dstIndicator != nil) {
+		now := time.Now()
+		if srcIndicator != nil {
+			if rule := list.allowlist.suppresses(srcIndicator, src, dst, now); rule != nil {
+				srcIndicator, suppressedBy = nil, rule
+			}
+		}
+		if dstIndicator != nil {
+			if rule := list.allowlist.suppresses(dstIndicator, dst, src, now); rule != nil {
+				dstIndicator, suppressedBy = nil, rule
 			}
 		}
+	}
+	switch {
+	case srcIndicator != nil && dstIndicator != nil:
+		return srcIndicator, pb.EnrichedFlow_MatchedBoth, nil
+	case srcIndicator != nil:
+		return srcIndicator, pb.EnrichedFlow_MatchedSrc, nil
+	case dstIndicator != nil:
+		return dstIndicator, pb.EnrichedFlow_MatchedDst, nil
+	}
+	return nil, pb.EnrichedFlow_NotMatched, suppressedBy
+}
 
-		m.Out <- msg
+// sidesToCheck returns whether the source and destination of a flow are to
+// be looked up for direction, one of "both", "remote", "inbound" or
+// "outbound".
+func sidesToCheck(direction string, msg *pb.EnrichedFlow) (checkSrc bool, checkDst bool) {
+	switch direction {
+	case "both":
+		checkSrc, checkDst = true, true
+	case "remote":
+		checkSrc, checkDst = msg.RemoteAddr == pb.EnrichedFlow_Src, msg.RemoteAddr == pb.EnrichedFlow_Dst
+	case "inbound":
+		checkSrc = msg.RemoteAddr != pb.EnrichedFlow_Dst
+	case "outbound":
+		checkDst = msg.RemoteAddr != pb.EnrichedFlow_Src
 	}
+	return checkSrc, checkDst
 }
 
-// Name implements segments.Segment.
-func (m *MatchingSegment) Name() string {
-	return "matching"
+// flowAddresses returns the source and destination address of a flow. The
+// string fields set by the addrstrings segment take precedence if present.
+func flowAddresses(msg *pb.EnrichedFlow) (net.IP, net.IP) {
+	src := net.IP(msg.GetSrcAddr())
+	if s := msg.GetSourceIP(); s != "" {
+		src = net.ParseIP(s)
+	}
+	dst := net.IP(msg.GetDstAddr())
+	if d := msg.GetDestinationIP(); d != "" {
+		dst = net.ParseIP(d)
+	}
+	return src, dst
 }
 
-// Close implements segments.Segment.
-func (m *MatchingSegment) Close() {
-	println("Closing matching segment.")
+// Name implements segments.Segment.
+func (segment *MatchingSegment) Name() string {
+	return "matching"
 }
 
 func init() {
-	matchingSegment := &MatchingSegment{}
-	segments.RegisterSegment("matching", matchingSegment)
+	segment := &MatchingSegment{}
+	segments.RegisterSegment("matching", segment)
 }
@@ -0,0 +1,668 @@
+package matching
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/rs/zerolog"
+)
+
+const testList = `# test list
+198.51.100.7
+203.0.113.0/24
+203.0.113.128/25
+2001:db8:1234::/48
+192.0.2.10 - 192.0.2.20
+`
+
+func writeTestList(t testing.TB, content string) string {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Matching Segment test, exact address
+func TestSegment_Matching_address(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.7").To4(), DstAddr: net.ParseIP("192.0.2.1").To4()})
+	if result.Tid != TagIDBadIP || !result.Inlist || result.MatchedPrefix != "198.51.100.7/32" {
+		t.Errorf("[error] Segment Matching is not matching a plain address, got Tid %d, MatchedPrefix '%s'.", result.Tid, result.MatchedPrefix)
+	}
+}
+
+// Matching Segment test, most specific prefix wins
+func TestSegment_Matching_longestPrefix(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("203.0.113.200").To4()})
+	if result.MatchedPrefix != "203.0.113.128/25" {
+		t.Errorf("[error] Segment Matching is not doing longest prefix matches, got '%s'.", result.MatchedPrefix)
+	}
+	result = segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.5").To4()})
+	if result.MatchedPrefix != "203.0.113.0/24" {
+		t.Errorf("[error] Segment Matching is not matching CIDR prefixes, got '%s'.", result.MatchedPrefix)
+	}
+}
+
+// Matching Segment test, IPv6 prefixes
+func TestSegment_Matching_ipv6(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("2001:db8::1"), DstAddr: net.ParseIP("2001:db8:1234:5678::1")})
+	if result.MatchedPrefix != "2001:db8:1234::/48" {
+		t.Errorf("[error] Segment Matching is not matching IPv6 prefixes, got '%s'.", result.MatchedPrefix)
+	}
+}
+
+// Matching Segment test, dash ranges and their boundaries
+func TestSegment_Matching_range(t *testing.T) {
+	for addr, expected := range map[string]bool{"192.0.2.9": false, "192.0.2.10": true, "192.0.2.16": true, "192.0.2.20": true, "192.0.2.21": false} {
+		result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+			&pb.EnrichedFlow{SrcAddr: net.ParseIP(addr).To4()})
+		if result.Inlist != expected {
+			t.Errorf("[error] Segment Matching range match for %s is %t, should be %t.", addr, result.Inlist, expected)
+		}
+	}
+}
+
+// Matching Segment test, string fields from addrstrings take precedence
+func TestSegment_Matching_addrStrings(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+		&pb.EnrichedFlow{SourceIP: "203.0.113.1", SrcAddr: net.ParseIP("192.0.2.1").To4()})
+	if !result.Inlist {
+		t.Error("[error] Segment Matching is not using the SourceIP field.")
+	}
+}
+
+// Matching Segment test, no match
+func TestSegment_Matching_noMatch(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": writeTestList(t, testList)},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("2001:db8::1")})
+	if result.Inlist || result.Tid != 0 || result.MatchedPrefix != "" {
+		t.Error("[error] Segment Matching is tagging unmatched flows.")
+	}
+}
+
+// Matching Segment test, zero octet addresses as prefixes
+func TestSegment_Matching_zeroOctetPrefixes(t *testing.T) {
+	list := writeTestList(t, "203.0.113.0\n")
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": list},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.5").To4()})
+	if result.Inlist {
+		t.Error("[error] Segment Matching is reading plain addresses as prefixes by default.")
+	}
+	result = segments.TestSegment("matching", map[string]string{"ip_list_path": list, "zero_octet_prefixes": "true"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.5").To4()})
+	if result.MatchedPrefix != "203.0.113.0/24" {
+		t.Errorf("[error] Segment Matching is not reading zero octet addresses as prefixes, got '%s'.", result.MatchedPrefix)
+	}
+}
+
+// Matching Segment test, reputation data from NERD exports
+func TestSegment_Matching_nerdCSV(t *testing.T) {
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": "nerd_export.csv", "format": "nerd-csv"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("149.100.11.243").To4()})
+	if !result.Inlist || result.MatchedPrefix != "149.100.11.243/32" {
+		t.Fatalf("[error] Segment Matching is not matching NERD exports, got MatchedPrefix '%s'.", result.MatchedPrefix)
+	}
+	if result.RepScore != 0.990811011904762 {
+		t.Errorf("[error] Segment Matching is not setting RepScore, got %f.", result.RepScore)
+	}
+	if !reflect.DeepEqual(result.EventCategories, []string{"AnomalyTraffic", "AttemptLogin", "ReconScanning"}) {
+		t.Errorf("[error] Segment Matching is not setting EventCategories, got %v.", result.EventCategories)
+	}
+	if !reflect.DeepEqual(result.Blacklists, []string{"abuseipdb", "turris_greylist", "uceprotect", "blocklist_de-ssh"}) {
+		t.Errorf("[error] Segment Matching is not setting Blacklists, got %v.", result.Blacklists)
+	}
+}
+
+// Matching Segment test, low confidence indicators are ignored
+func TestSegment_Matching_minRepScore(t *testing.T) {
+	list := writeTestList(t, "ip,rep_score\n198.51.100.1,0.2\n198.51.100.2,0.8\n")
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": list, "format": "nerd-csv", "min_rep_score": "0.5"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4()})
+	if result.Inlist {
+		t.Error("[error] Segment Matching is matching indicators below 'min_rep_score'.")
+	}
+	result = segments.TestSegment("matching", map[string]string{"ip_list_path": list, "format": "nerd-csv", "min_rep_score": "0.5"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.2").To4()})
+	if !result.Inlist || result.RepScore != 0.8 {
+		t.Error("[error] Segment Matching is not matching indicators above 'min_rep_score'.")
+	}
+}
+
+// Matching Segment test, indicators older than 'max_age' are ignored and scores decay
+func TestSegment_Matching_maxAge(t *testing.T) {
+	now := time.Now().UTC()
+	list := writeTestList(t, "ip,rep_score,ts_added,ts_last_event\n"+
+		"198.51.100.1,0.8,,"+now.Add(-48*time.Hour).Format(time.RFC3339)+"\n"+
+		"198.51.100.2,0.8,,"+now.Add(-24*365*time.Hour).Format(time.RFC3339)+"\n"+
+		"198.51.100.3,0.8,"+now.Add(-24*365*time.Hour).Format(time.RFC3339)+",\n"+
+		"198.51.100.4,0.8,,\n")
+	config := map[string]string{"ip_list_path": list, "format": "nerd-csv", "max_age": "720h"}
+	for addr, expected := range map[string]bool{"198.51.100.1": true, "198.51.100.2": false, "198.51.100.3": false, "198.51.100.4": true} {
+		result := segments.TestSegment("matching", config, &pb.EnrichedFlow{SrcAddr: net.ParseIP(addr).To4()})
+		if result.Inlist != expected {
+			t.Errorf("[error] Segment Matching match for %s is %t with 'max_age', should be %t.", addr, result.Inlist, expected)
+		}
+	}
+
+	config["score_half_life"] = "24h"
+	result := segments.TestSegment("matching", config, &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4()})
+	if result.RepScore < 0.19 || result.RepScore > 0.2 {
+		t.Errorf("[error] Segment Matching is not decaying scores, got %f after two half lives.", result.RepScore)
+	}
+	result = segments.TestSegment("matching", config, &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.4").To4()})
+	if result.RepScore != 0.8 {
+		t.Errorf("[error] Segment Matching is decaying scores without last event, got %f.", result.RepScore)
+	}
+	delete(config, "max_age")
+	result = segments.TestSegment("matching", config, &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.3").To4()})
+	if result.RepScore != 0.8 {
+		t.Errorf("[error] Segment Matching is using 'ts_added' without 'max_age', got score %f.", result.RepScore)
+	}
+	if segment := (MatchingSegment{}).New(map[string]string{"ip_list_path": list, "max_age": "-1h"}); segment != nil {
+		t.Error("[error] Segment Matching accepts a negative 'max_age'.")
+	}
+}
+
+// Matching Segment test, indicators exceeding 'max_age' while running are dropped, even without polling
+func TestSegment_Matching_maxAgeExpiry(t *testing.T) {
+	lastEvent := time.Now().Add(-time.Hour + 200*time.Millisecond).UTC().Format(time.RFC3339Nano)
+	path := writeTestList(t, "ip,ts_last_event\n198.51.100.1,"+lastEvent+"\n")
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": path, "format": "nerd-csv", "max_age": "1h", "reload_interval": "0"})
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	defer func() {
+		close(in)
+		wg.Wait()
+	}()
+
+	in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4()}
+	if result := <-out; !result.Inlist {
+		t.Fatal("[error] Segment Matching is not matching indicators within 'max_age'.")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4()}
+		if result := <-out; !result.Inlist {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("[error] Segment Matching keeps matching indicators exceeding 'max_age' while running.")
+}
+
+func TestDecayScore(t *testing.T) {
+	if score := decayScore(0.8, 7*24*time.Hour, 7*24*time.Hour); score != 0.4 {
+		t.Errorf("[error] Got %f after one half life.", score)
+	}
+	if score := decayScore(0.8, -time.Hour, time.Hour); score != 0.8 {
+		t.Errorf("[error] Got %f for a last event in the future.", score)
+	}
+}
+
+func TestSegment_Matching_invalidList(t *testing.T) {
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": writeTestList(t, "not-an-address\n")})
+	if segment != nil {
+		t.Error("[error] Segment Matching accepts invalid list entries.")
+	}
+	segment = MatchingSegment{}.New(map[string]string{"ip_list_path": writeTestList(t, "address\n192.0.2.1\n"), "format": "nerd-csv"})
+	if segment != nil {
+		t.Error("[error] Segment Matching accepts NERD exports without 'ip' column.")
+	}
+}
+
+// Matching Segment test, list changes are picked up while running
+func TestSegment_Matching_reload(t *testing.T) {
+	path := writeTestList(t, "198.51.100.1\n")
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": path, "reload_interval": "10ms"})
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	defer func() {
+		close(in)
+		wg.Wait()
+	}()
+
+	in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.2").To4()}
+	if result := <-out; result.Inlist {
+		t.Fatal("[error] Segment Matching is matching an address not on the list.")
+	}
+
+	// write and rename like the updater does
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("198.51.100.2\n198.51.100.3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.2").To4()}
+		if result := <-out; result.Inlist {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("[error] Segment Matching did not reload the changed list.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4()}
+	if result := <-out; result.Inlist {
+		t.Error("[error] Segment Matching is still matching an address removed from the list.")
+	}
+}
+
+// Matching Segment test, a missing list is fetched from 'update_url' once
+// running, not when the segment is constructed
+func TestSegment_Matching_updateURL(t *testing.T) {
+	dir := t.TempDir()
+	source, path := filepath.Join(dir, "source.txt"), filepath.Join(dir, "list.txt")
+	if err := os.WriteFile(source, []byte("198.51.100.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": path, "update_url": "file://" + source}).(*MatchingSegment)
+	if _, err := os.Stat(path); err == nil {
+		t.Error("[error] Segment Matching fetched its list when constructed.")
+	}
+	updated := segment.Lists[0].list.Updated()
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	defer func() {
+		close(in)
+		wg.Wait()
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("[error] Segment Matching did not read its list after fetching it.")
+	}
+	in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4()}
+	if result := <-out; !result.Inlist {
+		t.Error("[error] Segment Matching did not fetch its list from 'update_url'.")
+	}
+}
+
+// Matching Segment test, named lists are tagged with their own IDs in order
+func TestSegment_Matching_namedLists(t *testing.T) {
+	config := map[string]string{
+		"lists":                  "botnet-c2, scanners",
+		"botnet-c2.ip_list_path": writeTestList(t, "192.0.2.1\n"),
+		"botnet-c2.tid":          "65002",
+		"scanners.ip_list_path":  writeTestList(t, "192.0.2.0/24\n198.51.100.1\n"),
+		"scanners.tid":           "65003",
+		"scanners.note":          "Research Scanner",
+	}
+	result := segments.TestSegment("matching", config,
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("198.51.100.1").To4(), DstAddr: net.ParseIP("192.0.2.1").To4()})
+	if result.Tid != 65002 || result.Note != "botnet-c2" {
+		t.Errorf("[error] Segment Matching did not apply the first matching list, got tid %d note %s.", result.Tid, result.Note)
+	}
+	result = segments.TestSegment("matching", config,
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.2").To4()})
+	if result.Tid != 65003 || result.Note != "research_scanner" || result.MatchedPrefix != "192.0.2.0/24" {
+		t.Errorf("[error] Segment Matching did not apply the second list, got tid %d note %s.", result.Tid, result.Note)
+	}
+}
+
+// Matching Segment test, named lists inherit top level options
+func TestSegment_Matching_namedListsInherit(t *testing.T) {
+	segment := MatchingSegment{}.New(map[string]string{
+		"lists":          "a,b",
+		"format":         "nerd-csv",
+		"a.ip_list_path": "nerd_export.csv",
+		"a.tid":          "65002",
+		"b.ip_list_path": writeTestList(t, "192.0.2.1\n"),
+		"b.tid":          "65003",
+		"b.format":       "plain",
+	}).(*MatchingSegment)
+	if segment.Lists[0].Format != "nerd-csv" || segment.Lists[1].Format != "plain" {
+		t.Errorf("[error] Segment Matching lists have formats %s and %s.", segment.Lists[0].Format, segment.Lists[1].Format)
+	}
+}
+
+// Matching Segment test, invalid named list configurations are rejected
+func TestSegment_Matching_namedListsInvalid(t *testing.T) {
+	path := writeTestList(t, "192.0.2.1\n")
+	for _, config := range []map[string]string{
+		{"lists": "a", "a.ip_list_path": path},                     // no tid
+		{"lists": "a", "a.tid": "65002"},                           // no path
+		{"lists": "a", "a.ip_list_path": path, "a.tid": "0"},       // invalid tid
+		{"lists": "a,a", "a.ip_list_path": path, "a.tid": "65002"}, // duplicate
+		{"lists": "a,", "a.ip_list_path": path, "a.tid": "65002"},  // empty name
+		{"lists": "a", "a.ip_list_path": path, "a.tid": "65002", "a.format": "xml"},
+	} {
+		if segment := (MatchingSegment{}).New(config); segment != nil {
+			t.Errorf("[error] Segment Matching accepts invalid config %v.", config)
+		}
+	}
+}
+
+// Matching Segment test, the matched side is recorded
+func TestSegment_Matching_matchedSide(t *testing.T) {
+	config := map[string]string{"ip_list_path": writeTestList(t, testList)}
+	for _, test := range []struct {
+		src, dst string
+		side     pb.EnrichedFlow_MatchedSideType
+		prefix   string
+	}{
+		{"198.51.100.7", "192.0.2.1", pb.EnrichedFlow_MatchedSrc, "198.51.100.7/32"},
+		{"192.0.2.1", "198.51.100.7", pb.EnrichedFlow_MatchedDst, "198.51.100.7/32"},
+		{"203.0.113.1", "198.51.100.7", pb.EnrichedFlow_MatchedBoth, "203.0.113.0/24"},
+		{"192.0.2.1", "192.0.2.2", pb.EnrichedFlow_NotMatched, ""},
+	} {
+		result := segments.TestSegment("matching", config,
+			&pb.EnrichedFlow{SrcAddr: net.ParseIP(test.src).To4(), DstAddr: net.ParseIP(test.dst).To4()})
+		if result.MatchedSide != test.side || result.MatchedPrefix != test.prefix {
+			t.Errorf("[error] Segment Matching reports side %s prefix %s for %s -> %s, should be %s %s.",
+				result.MatchedSide, result.MatchedPrefix, test.src, test.dst, test.side, test.prefix)
+		}
+	}
+}
+
+// Matching Segment test, domain entries are matched against host names
+func TestSegment_Matching_hostname(t *testing.T) {
+	config := map[string]string{"ip_list_path": writeTestList(t, "198.51.100.7\nbad.example\n*.fastflux.example\n")}
+	for _, test := range []struct {
+		src, srcName, dstName string
+		tid                   uint32
+		prefix                string
+		side                  pb.EnrichedFlow_MatchedSideType
+	}{
+		{"192.0.2.1", "", "Bad.Example.", TagIDBadDomain, "bad.example", pb.EnrichedFlow_MatchedDst},
+		{"192.0.2.1", "a.b.fastflux.example.", "", TagIDBadDomain, "*.fastflux.example", pb.EnrichedFlow_MatchedSrc},
+		{"198.51.100.7", "x.fastflux.example.", "", TagIDBadIP, "198.51.100.7/32", pb.EnrichedFlow_MatchedSrc},
+		{"192.0.2.1", "fastflux.example.", "notbad.example.", 0, "", pb.EnrichedFlow_NotMatched},
+	} {
+		result := segments.TestSegment("matching", config,
+			&pb.EnrichedFlow{SrcAddr: net.ParseIP(test.src).To4(), DstAddr: net.ParseIP("192.0.2.2").To4(), SrcHostName: test.srcName, DstHostName: test.dstName})
+		if result.Tid != test.tid || result.MatchedPrefix != test.prefix || result.MatchedSide != test.side {
+			t.Errorf("[error] Segment Matching reports tid %d prefix '%s' side %s for %s/%s, should be %d '%s' %s.",
+				result.Tid, result.MatchedPrefix, result.MatchedSide, test.srcName, test.dstName, test.tid, test.prefix, test.side)
+		}
+	}
+	result := segments.TestSegment("matching", map[string]string{"ip_list_path": config["ip_list_path"], "domain_tid": "65011", "domain_note": "c2_domain"},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), SrcHostName: "bad.example"})
+	if result.Tid != 65011 || result.Note != "c2_domain" {
+		t.Errorf("[error] Segment Matching is not using 'domain_tid', got tid %d note %s.", result.Tid, result.Note)
+	}
+}
+
+// Matching Segment test, port constraints restrict matches to protocols and ports
+func TestSegment_Matching_portConstraints(t *testing.T) {
+	config := map[string]string{"ip_list_path": writeTestList(t, "203.0.113.0/24\n203.0.113.7 tcp/22\n203.0.113.7 tcp/8000-8099\n198.51.100.53 udp/53 # resolver abuse\n192.0.2.10 - 192.0.2.20 gre\n")}
+	for _, test := range []struct {
+		src              string
+		proto            uint32
+		srcPort, dstPort uint32
+		prefix           string
+	}{
+		{"203.0.113.7", 6, 50000, 22, "203.0.113.7/32"},
+		{"203.0.113.7", 6, 22, 50000, "203.0.113.7/32"},
+		{"203.0.113.7", 6, 50000, 8080, "203.0.113.7/32"},
+		{"203.0.113.7", 17, 50000, 22, "203.0.113.0/24"},
+		{"198.51.100.53", 17, 53, 40000, "198.51.100.53/32"},
+		{"198.51.100.53", 6, 53, 40000, ""},
+		{"192.0.2.15", 47, 0, 0, "192.0.2.12/30"},
+		{"192.0.2.15", 6, 1234, 80, ""},
+	} {
+		result := segments.TestSegment("matching", config,
+			&pb.EnrichedFlow{SrcAddr: net.ParseIP(test.src).To4(), DstAddr: net.ParseIP("192.0.2.1").To4(), Proto: test.proto, SrcPort: test.srcPort, DstPort: test.dstPort})
+		if result.MatchedPrefix != test.prefix {
+			t.Errorf("[error] Segment Matching matched '%s' for %s proto %d ports %d/%d, should be '%s'.",
+				result.MatchedPrefix, test.src, test.proto, test.srcPort, test.dstPort, test.prefix)
+		}
+	}
+}
+
+// Duplicate entries match if any of their constraints is satisfied, an entry
+// without constraints matches all flows
+func TestReadPlainList_duplicateConstraints(t *testing.T) {
+	set, err := readPlainList(strings.NewReader("192.0.2.1\n192.0.2.1 tcp/22\n192.0.2.2 tcp/22\n192.0.2.2 udp/53\n192.0.2.3 tcp/22\n192.0.2.3\n"+
+		"a.example\na.example tcp/22\nb.example tcp/22\nb.example udp/53\n"), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &pb.EnrichedFlow{Proto: 17, SrcPort: 53, DstPort: 40000}
+	icmp := &pb.EnrichedFlow{Proto: 1}
+	for _, test := range []struct {
+		entry   string
+		flow    *pb.EnrichedFlow
+		matches bool
+	}{
+		{"192.0.2.1", icmp, true},
+		{"192.0.2.2", udp, true},
+		{"192.0.2.2", icmp, false},
+		{"192.0.2.3", icmp, true},
+		{"a.example", icmp, true},
+		{"b.example", udp, true},
+		{"b.example", icmp, false},
+	} {
+		var indicator *Indicator
+		if ip := net.ParseIP(test.entry); ip != nil {
+			indicator = set.LookupFlow(ip, test.flow)
+		} else {
+			indicator = set.LookupHostnameFlow(test.entry, test.flow)
+		}
+		if (indicator != nil) != test.matches {
+			t.Errorf("[error] Duplicate entry %s matches proto %d: %t, should be %t.", test.entry, test.flow.Proto, indicator != nil, test.matches)
+		}
+	}
+}
+
+func TestCutPortConstraints(t *testing.T) {
+	entry, ports, err := cutPortConstraints("192.0.2.10 - 192.0.2.20 TCP/22 udp/1000-2000 47")
+	expected := []PortConstraint{{Proto: 6, FromPort: 22, ToPort: 22}, {Proto: 17, FromPort: 1000, ToPort: 2000}, {Proto: 47}}
+	if err != nil || entry != "192.0.2.10 - 192.0.2.20" || !reflect.DeepEqual(ports, expected) {
+		t.Errorf("[error] Got entry '%s' and constraints %v (%v).", entry, ports, err)
+	}
+	if ports[0].String() != "tcp/22" || ports[1].String() != "udp/1000-2000" || ports[2].String() != "gre" {
+		t.Errorf("[error] Constraints formatted as %v.", ports)
+	}
+	for _, line := range []string{"192.0.2.1 tcp/0", "192.0.2.1 tcp/22-21", "192.0.2.1 tcp/65536", "192.0.2.1 bogus/22"} {
+		if _, _, err := cutPortConstraints(line); err == nil {
+			t.Errorf("[error] Accepted invalid constraint in '%s'.", line)
+		}
+	}
+	if _, err := readPlainList(strings.NewReader("tcp/22\n"), ListOptions{}); err == nil {
+		t.Error("[error] Accepted constraint without address.")
+	}
+}
+
+func TestParseDomain(t *testing.T) {
+	for entry, expected := range map[string]string{
+		"Bad.Example.":    "bad.example",
+		"*.bad.example":   "*.bad.example",
+		"*.tk":            "*.tk",
+		"xn--bcher-kva.x": "xn--bcher-kva.x",
+	} {
+		if domain, err := parseDomain(entry); err != nil || domain != expected {
+			t.Errorf("[error] Parsed '%s' as '%s' (%v), should be '%s'.", entry, domain, err, expected)
+		}
+	}
+	for _, entry := range []string{"localhost", "192.0.2.300", "bad..example", "-bad.example", "bad.example/24", "*.", "b*d.example"} {
+		if _, err := parseDomain(entry); err == nil {
+			t.Errorf("[error] Accepted invalid domain '%s'.", entry)
+		}
+	}
+}
+
+// Matching Segment test, only the configured direction is matched
+func TestSegment_Matching_direction(t *testing.T) {
+	path := writeTestList(t, "198.51.100.7\n")
+	bad, local := net.ParseIP("198.51.100.7").To4(), net.ParseIP("192.0.2.1").To4()
+	inbound := func(remote pb.EnrichedFlow_RemoteAddrType) *pb.EnrichedFlow {
+		return &pb.EnrichedFlow{SrcAddr: bad, DstAddr: local, RemoteAddr: remote}
+	}
+	outbound := func(remote pb.EnrichedFlow_RemoteAddrType) *pb.EnrichedFlow {
+		return &pb.EnrichedFlow{SrcAddr: local, DstAddr: bad, RemoteAddr: remote}
+	}
+	for _, test := range []struct {
+		direction string
+		flow      *pb.EnrichedFlow
+		inlist    bool
+	}{
+		{"inbound", inbound(pb.EnrichedFlow_Neither), true},
+		{"inbound", inbound(pb.EnrichedFlow_Src), true},
+		{"inbound", outbound(pb.EnrichedFlow_Neither), false},
+		{"inbound", inbound(pb.EnrichedFlow_Dst), false},
+		{"outbound", outbound(pb.EnrichedFlow_Neither), true},
+		{"outbound", outbound(pb.EnrichedFlow_Dst), true},
+		{"outbound", inbound(pb.EnrichedFlow_Neither), false},
+		{"remote", inbound(pb.EnrichedFlow_Src), true},
+		{"remote", outbound(pb.EnrichedFlow_Dst), true},
+		{"remote", outbound(pb.EnrichedFlow_Src), false},
+		{"remote", inbound(pb.EnrichedFlow_Neither), false},
+		{"both", outbound(pb.EnrichedFlow_Src), true},
+	} {
+		result := segments.TestSegment("matching", map[string]string{"ip_list_path": path, "direction": test.direction}, test.flow)
+		if result.Inlist != test.inlist {
+			t.Errorf("[error] Segment Matching with direction %s matched %t for %s -> %s with remote %s.",
+				test.direction, result.Inlist, net.IP(test.flow.SrcAddr), net.IP(test.flow.DstAddr), test.flow.RemoteAddr)
+		}
+	}
+	if segment := (MatchingSegment{}).New(map[string]string{"ip_list_path": path, "direction": "sideways"}); segment != nil {
+		t.Error("[error] Segment Matching accepts an unknown direction.")
+	}
+}
+
+// Matching Segment test, parallel instances share one list
+func TestSegment_Matching_sharedList(t *testing.T) {
+	config := map[string]string{"ip_list_path": writeTestList(t, testList)}
+	first := MatchingSegment{}.New(config).(*MatchingSegment)
+	second := MatchingSegment{}.New(config).(*MatchingSegment)
+	if first.Lists[0].list != second.Lists[0].list {
+		t.Error("[error] Segment Matching instances with the same config do not share their list.")
+	}
+
+	parallel := &segments.ParallelizedSegment{}
+	parallel.AddSegment(first)
+	parallel.AddSegment(second)
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	parallel.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go parallel.Run(wg)
+	for i := 0; i < 10; i++ {
+		in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.1").To4()}
+		if result := <-out; !result.Inlist {
+			t.Error("[error] Segment Matching with parallel jobs is not matching.")
+		}
+	}
+	close(in)
+	wg.Wait()
+	if first.Lists[0].list.users != 0 {
+		t.Errorf("[error] Segment Matching list still has %d users after all jobs finished.", first.Lists[0].list.users)
+	}
+}
+
+// Matching Segment test, lists of segments which are never run are released on Close
+func TestSegment_Matching_closeWithoutRun(t *testing.T) {
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": writeTestList(t, testList)}).(*MatchingSegment)
+	list := segment.Lists[0].list
+	segment.Close()
+	segment.Close()
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	if list.refs != 0 || lists[listKey{list.path, list.options, list.interval}] != nil {
+		t.Errorf("[error] Segment Matching list is still held with %d references after Close.", list.refs)
+	}
+}
+
+// Matching Segment test, failed initial reads count as reload failures
+func TestSegment_Matching_initialLoadFailure(t *testing.T) {
+	path := writeTestList(t, "not an address\n")
+	if segment := (MatchingSegment{}).New(map[string]string{"ip_list_path": path}); segment != nil {
+		t.Fatal("[error] Segment Matching accepts an invalid list.")
+	}
+	if err := os.WriteFile(path, []byte(testList), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": path}).(*MatchingSegment)
+	defer segment.Close()
+	if failures := segment.Lists[0].list.reloadFailures.Load(); failures != 1 {
+		t.Errorf("[error] Segment Matching counted %d reload failures, should be 1.", failures)
+	}
+}
+
+func TestIndicatorSet_Diff(t *testing.T) {
+	previous, _ := readPlainList(strings.NewReader("192.0.2.1\n192.0.2.2\n192.0.2.3\n"), ListOptions{})
+	current, _ := readPlainList(strings.NewReader("192.0.2.2\n192.0.2.3\n192.0.2.4\n192.0.2.4\n198.51.100.0/24\n"), ListOptions{})
+	added, removed := current.Diff(previous)
+	if added != 2 || removed != 1 {
+		t.Errorf("[error] IndicatorSet diff is %d added, %d removed, should be 2 and 1.", added, removed)
+	}
+}
+
+func TestRangeToPrefixes(t *testing.T) {
+	tests := map[string][]string{
+		"192.0.2.0 - 192.0.2.255":   {"192.0.2.0/24"},
+		"192.0.2.10 - 192.0.2.20":   {"192.0.2.10/31", "192.0.2.12/30", "192.0.2.16/30", "192.0.2.20/32"},
+		"0.0.0.0 - 255.255.255.255": {"0.0.0.0/0"},
+		"2001:db8::-2001:db8::ffff": {"2001:db8::/112"},
+	}
+	for entry, expected := range tests {
+		prefixes, err := parsePrefixes(entry, false)
+		if err != nil {
+			t.Errorf("[error] Range '%s' could not be parsed: %v", entry, err)
+			continue
+		}
+		if len(prefixes) != len(expected) {
+			t.Errorf("[error] Range '%s' resulted in %v, should be %v.", entry, prefixes, expected)
+			continue
+		}
+		for i := range prefixes {
+			if prefixes[i].String() != expected[i] {
+				t.Errorf("[error] Range '%s' resulted in %v, should be %v.", entry, prefixes, expected)
+				break
+			}
+		}
+	}
+	if _, err := parsePrefixes("192.0.2.20 - 192.0.2.10", false); err == nil {
+		t.Error("[error] Reversed range was accepted.")
+	}
+}
+
+// Matching Segment benchmark with the bundled list
+func BenchmarkMatching(b *testing.B) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Stdout, _ = os.Open(os.DevNull)
+
+	segment := MatchingSegment{}.New(map[string]string{"ip_list_path": "bad_ips.txt"})
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+
+	for n := 0; n < b.N; n++ {
+		in <- &pb.EnrichedFlow{SrcAddr: []byte{192, 168, 88, 142}, DstAddr: []byte{1, 15, 118, 23}}
+		<-out
+	}
+	close(in)
+}
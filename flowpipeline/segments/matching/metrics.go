@@ -0,0 +1,256 @@
+package matching
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/BelWue/flowpipeline/pipeline/admin"
+)
+
+var (
+	exporters     = make(map[string]*PrometheusExporter)
+	exportersLock = &sync.Mutex{}
+)
+
+type PrometheusParams struct {
+	Endpoint      string // optional, default is "" which disables metrics, an address such as ":9091" or a path on the admin server such as "/matching"
+	MetricsPath   string // optional, default is "/metrics"
+	TopIndicators int    // optional, default is 10, number of most matched indicators to export per list, 0 disables
+}
+
+// InitDefaultPrometheusParams sets the defaults of all optional parameters.
+func (params *PrometheusParams) InitDefaultPrometheusParams() {
+	params.MetricsPath = "/metrics"
+	params.TopIndicators = 10
+}
+
+// PrometheusExporter provides the metrics of all matching segments using the
+// same endpoint, in particular of all parallel instances of a segment
+// configured with 'jobs'.
+type PrometheusExporter struct {
+	Registry   *prometheus.Registry
+	Hits       *prometheus.CounterVec
+	Suppressed *prometheus.CounterVec
+
+	params    PrometheusParams
+	stop      func() // stops serving, see admin.ServeSegment
+	collector *PrometheusCollector
+	users     int // number of running segments, guarded by exportersLock
+}
+
+// PrometheusCollector reports the state of all lists in use by the segments
+// of an exporter at scrape time.
+type PrometheusCollector struct {
+	sync.Mutex
+	lists map[string]*indicatorList // by list label
+	top   map[string]*topIndicators // by list label
+
+	indicatorsDesc     *prometheus.Desc
+	lastReloadDesc     *prometheus.Desc
+	reloadFailuresDesc *prometheus.Desc
+	topIndicatorsDesc  *prometheus.Desc
+}
+
+func NewPrometheusCollector() *PrometheusCollector {
+	return &PrometheusCollector{
+		lists: make(map[string]*indicatorList),
+		top:   make(map[string]*topIndicators),
+		indicatorsDesc: prometheus.NewDesc(
+			"matching_indicators",
+			"Number of prefixes and domain entries in the current version of a list.",
+			[]string{"list"}, nil,
+		),
+		lastReloadDesc: prometheus.NewDesc(
+			"matching_last_reload_timestamp_seconds",
+			"Time of the last successful read of a list.",
+			[]string{"list"}, nil,
+		),
+		reloadFailuresDesc: prometheus.NewDesc(
+			"matching_reload_failures_total",
+			"Number of failed reloads of a list.",
+			[]string{"list"}, nil,
+		),
+		topIndicatorsDesc: prometheus.NewDesc(
+			"matching_top_indicator_hits",
+			"Number of matched flows for the most matched indicators of a list, approximated for lower ranks.",
+			[]string{"list", "indicator"}, nil,
+		),
+	}
+}
+
+func (collector *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.indicatorsDesc
+	ch <- collector.lastReloadDesc
+	ch <- collector.reloadFailuresDesc
+	ch <- collector.topIndicatorsDesc
+}
+
+func (collector *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.Lock()
+	defer collector.Unlock()
+	for label, list := range collector.lists {
+		ch <- prometheus.MustNewConstMetric(collector.indicatorsDesc, prometheus.GaugeValue, float64(list.Load().Len()), label)
+		ch <- prometheus.MustNewConstMetric(collector.lastReloadDesc, prometheus.GaugeValue, float64(list.lastReload.Load()), label)
+		ch <- prometheus.MustNewConstMetric(collector.reloadFailuresDesc, prometheus.CounterValue, float64(list.reloadFailures.Load()), label)
+	}
+	for label, top := range collector.top {
+		for _, entry := range top.Top() {
+			ch <- prometheus.MustNewConstMetric(collector.topIndicatorsDesc, prometheus.GaugeValue, float64(entry.count), label, entry.indicator)
+		}
+	}
+}
+
+// Initialize Prometheus Exporter
+func (e *PrometheusExporter) Initialize() {
+	e.Hits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "matching_hits_total",
+			Help: "Number of flows matching a list, by matched side.",
+		}, []string{"list", "side"})
+	e.Suppressed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "matching_suppressed_total",
+			Help: "Number of flows matching a list which were not tagged due to an allowlist rule, by the rule's reason.",
+		}, []string{"list", "reason"})
+	e.collector = NewPrometheusCollector()
+	e.Registry = prometheus.NewRegistry()
+	e.Registry.MustRegister(e.Hits)
+	e.Registry.MustRegister(e.Suppressed)
+	e.Registry.MustRegister(e.collector)
+}
+
+// serve Handler for metricPath on the given endpoint, see admin.ServeSegment,
+// the returned function has to be called when the segment stops
+func (e *PrometheusExporter) ServeEndpoints(promParams *PrometheusParams) func() {
+	mux := http.NewServeMux()
+	mux.Handle(promParams.MetricsPath, promhttp.HandlerFor(e.Registry, promhttp.HandlerOpts{}))
+	stop, err := admin.ServeSegment(promParams.Endpoint, mux)
+	if err != nil {
+		log.Error().Err(err).Msgf("Matching: Failed to start metrics endpoint on %s", promParams.Endpoint)
+		return func() {}
+	}
+	log.Info().Msgf("Matching: Enabled metrics on %s, listening at %s.", promParams.MetricsPath, promParams.Endpoint)
+	return stop
+}
+
+// startExporter registers a running segment with the exporter for its
+// endpoint, starting it with the first one. Every call must be matched by a
+// call to done on the result.
+func startExporter(params PrometheusParams) *PrometheusExporter {
+	exportersLock.Lock()
+	defer exportersLock.Unlock()
+	exporter, ok := exporters[params.Endpoint]
+	if !ok {
+		exporter = &PrometheusExporter{params: params}
+		exporter.Initialize()
+		exporter.stop = exporter.ServeEndpoints(&params)
+		exporters[params.Endpoint] = exporter
+	}
+	exporter.users += 1
+	return exporter
+}
+
+// done unregisters a running segment and stops serving once the last one is
+// done.
+func (e *PrometheusExporter) done() {
+	exportersLock.Lock()
+	defer exportersLock.Unlock()
+	e.users -= 1
+	if e.users > 0 {
+		return
+	}
+	e.stop()
+	delete(exporters, e.params.Endpoint)
+}
+
+// addList makes the state of a list available under the given label.
+func (e *PrometheusExporter) addList(label string, list *indicatorList) {
+	e.collector.Lock()
+	defer e.collector.Unlock()
+	e.collector.lists[label] = list
+	if _, ok := e.collector.top[label]; !ok && e.params.TopIndicators > 0 {
+		e.collector.top[label] = newTopIndicators(e.params.TopIndicators)
+	}
+}
+
+// hit counts a flow matching an indicator of the list with the given label.
+func (e *PrometheusExporter) hit(label string, side string, indicator string) {
+	e.Hits.WithLabelValues(label, side).Inc()
+	e.collector.Lock()
+	top := e.collector.top[label]
+	e.collector.Unlock()
+	if top != nil {
+		top.Add(indicator)
+	}
+}
+
+// suppress counts a flow matching the list with the given label which was not
+// tagged due to an allowlist rule.
+func (e *PrometheusExporter) suppress(label string, reason string) {
+	e.Suppressed.WithLabelValues(label, reason).Inc()
+}
+
+// topIndicators approximates the most frequently matched indicators in
+// bounded memory using the Space-Saving algorithm: it counts a fixed number
+// of indicators and replaces the least counted one when a new indicator
+// comes along. Counts of the top n are exact unless the distribution is very
+// flat.
+type topIndicators struct {
+	sync.Mutex
+	n      int
+	counts map[string]uint64
+}
+
+type topEntry struct {
+	indicator string
+	count     uint64
+}
+
+func newTopIndicators(n int) *topIndicators {
+	return &topIndicators{n: n, counts: make(map[string]uint64)}
+}
+
+// Add counts a hit for indicator.
+func (top *topIndicators) Add(indicator string) {
+	top.Lock()
+	defer top.Unlock()
+	if _, ok := top.counts[indicator]; ok || len(top.counts) < 10*top.n {
+		top.counts[indicator] += 1
+		return
+	}
+	var minIndicator string
+	var minCount uint64
+	for indicator, count := range top.counts {
+		if minIndicator == "" || count < minCount {
+			minIndicator, minCount = indicator, count
+		}
+	}
+	delete(top.counts, minIndicator)
+	top.counts[indicator] = minCount + 1
+}
+
+// Top returns the n most counted indicators, highest first.
+func (top *topIndicators) Top() []topEntry {
+	top.Lock()
+	entries := make([]topEntry, 0, len(top.counts))
+	for indicator, count := range top.counts {
+		entries = append(entries, topEntry{indicator, count})
+	}
+	top.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].indicator < entries[j].indicator
+	})
+	if len(entries) > top.n {
+		entries = entries[:top.n]
+	}
+	return entries
+}
@@ -0,0 +1,108 @@
+package matching
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// gatherMetrics returns all metrics of a registry by name and labels, e.g.
+// `matching_hits_total{list="bad_ip",side="src"}`.
+func gatherMetrics(t *testing.T, exporter *PrometheusExporter) map[string]float64 {
+	families, err := exporter.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName() + "{"
+			for i, label := range metric.GetLabel() {
+				if i > 0 {
+					name += ","
+				}
+				name += fmt.Sprintf("%s=%q", label.GetName(), label.GetValue())
+			}
+			name += "}"
+			switch {
+			case metric.GetCounter() != nil:
+				metrics[name] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				metrics[name] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return metrics
+}
+
+// Matching Segment test, metrics are exported
+func TestSegment_Matching_metrics(t *testing.T) {
+	segment := MatchingSegment{}.New(map[string]string{
+		"ip_list_path":   writeTestList(t, testList),
+		"endpoint":       "127.0.0.1:0",
+		"top_indicators": "1",
+	})
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for _, flow := range []struct{ src, dst string }{
+		{"203.0.113.1", "192.0.2.1"},
+		{"203.0.113.2", "192.0.2.1"},
+		{"192.0.2.1", "198.51.100.7"},
+		{"192.0.2.1", "192.0.2.2"},
+	} {
+		in <- &pb.EnrichedFlow{SrcAddr: net.ParseIP(flow.src).To4(), DstAddr: net.ParseIP(flow.dst).To4()}
+		<-out
+	}
+
+	exportersLock.Lock()
+	exporter := exporters["127.0.0.1:0"]
+	exportersLock.Unlock()
+	metrics := gatherMetrics(t, exporter)
+	close(in)
+	wg.Wait()
+
+	for name, value := range map[string]float64{
+		`matching_hits_total{list="bad_ip",side="src"}`:                         2,
+		`matching_hits_total{list="bad_ip",side="dst"}`:                         1,
+		`matching_indicators{list="bad_ip"}`:                                    8,
+		`matching_reload_failures_total{list="bad_ip"}`:                         0,
+		`matching_top_indicator_hits{indicator="203.0.113.0/24",list="bad_ip"}`: 2,
+	} {
+		if metrics[name] != value {
+			t.Errorf("[error] Segment Matching reports %s %f, should be %f.", name, metrics[name], value)
+		}
+	}
+	if metrics[`matching_last_reload_timestamp_seconds{list="bad_ip"}`] == 0 {
+		t.Error("[error] Segment Matching does not report the last reload.")
+	}
+	if _, ok := metrics[`matching_top_indicator_hits{indicator="198.51.100.7/32",list="bad_ip"}`]; ok {
+		t.Error("[error] Segment Matching reports more than 'top_indicators' indicators.")
+	}
+	if _, ok := exporters["127.0.0.1:0"]; ok {
+		t.Error("[error] Segment Matching did not stop its exporter.")
+	}
+}
+
+func TestTopIndicators(t *testing.T) {
+	top := newTopIndicators(2)
+	for i := 0; i < 100; i++ {
+		top.Add("frequent")
+		if i%2 == 0 {
+			top.Add("common")
+		}
+		top.Add(fmt.Sprintf("rare-%d", i)) // evicting each other
+	}
+	entries := top.Top()
+	if len(entries) != 2 || entries[0].indicator != "frequent" || entries[0].count != 100 || entries[1].indicator != "common" {
+		t.Errorf("[error] Wrong top indicators: %+v", entries)
+	}
+	if len(top.counts) > 20 {
+		t.Errorf("[error] Top indicators are not bounded, %d counted.", len(top.counts))
+	}
+}
@@ -0,0 +1,443 @@
+package matching
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A FeedParser reads an indicator list in a specific format. Implementations
+// should honor the options applicable to their format and return an error
+// for malformed input instead of skipping it, so that broken downloads are
+// not swapped in.
+type FeedParser interface {
+	Parse(r io.Reader, options ListOptions) (*IndicatorSet, error)
+}
+
+// FeedParserFunc adapts a function to the FeedParser interface.
+type FeedParserFunc func(r io.Reader, options ListOptions) (*IndicatorSet, error)
+
+// Parse implements FeedParser.
+func (f FeedParserFunc) Parse(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	return f(r, options)
+}
+
+var (
+	feedParsers     = make(map[string]FeedParser)
+	feedParsersLock = &sync.RWMutex{}
+)
+
+// RegisterFeedParser makes a list format available to the 'format'
+// parameter. Errors and exits immediately on conflicts.
+func RegisterFeedParser(format string, parser FeedParser) {
+	feedParsersLock.Lock()
+	defer feedParsersLock.Unlock()
+	if _, ok := feedParsers[format]; ok {
+		log.Fatal().Msgf("Matching: Tried to register conflicting list format '%s'.", format)
+	}
+	feedParsers[format] = parser
+}
+
+// lookupFeedParser returns the parser for format, "plain" if empty.
+func lookupFeedParser(format string) (FeedParser, error) {
+	if format == "" {
+		format = "plain"
+	}
+	feedParsersLock.RLock()
+	defer feedParsersLock.RUnlock()
+	if parser, ok := feedParsers[format]; ok {
+		return parser, nil
+	}
+	formats := make([]string, 0, len(feedParsers))
+	for name := range feedParsers {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	return nil, fmt.Errorf("unknown list format '%s', must be one of '%s'", format, strings.Join(formats, "', '"))
+}
+
+// readSpamhausDrop reads the Spamhaus DROP and EDROP lists, both in the
+// classic text format with lines like '1.10.16.0/20 ; SBL256894' and ';'
+// comments, and in the newer JSON lines format. The SBL id is kept as a tag.
+func readSpamhausDrop(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	set := &IndicatorSet{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line := strings.TrimSpace(scanner.Text())
+		var entry, sblid string
+		if strings.HasPrefix(line, "{") {
+			var record struct {
+				Type  string `json:"type"`
+				Cidr  string `json:"cidr"`
+				SblId string `json:"sblid"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			if record.Type == "metadata" {
+				continue
+			}
+			entry, sblid = record.Cidr, record.SblId
+		} else {
+			entry, sblid, _ = strings.Cut(line, ";")
+			entry, sblid = strings.TrimSpace(entry), strings.TrimSpace(sblid)
+		}
+		if entry == "" {
+			continue
+		}
+		prefixes, err := parsePrefixes(entry, false)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		var tags []string
+		if sblid != "" {
+			tags = []string{sblid}
+		}
+		for _, prefix := range prefixes {
+			set.Insert(prefix, &Indicator{Prefix: prefix.String(), Tags: tags})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// mispAttribute is the subset of a MISP attribute used for matching.
+type mispAttribute struct {
+	Type      string `json:"type"`
+	Category  string `json:"category"`
+	Value     string `json:"value"`
+	Timestamp string `json:"timestamp"`
+	Deleted   bool   `json:"deleted"`
+	Tag       []struct {
+		Name string `json:"name"`
+	} `json:"Tag"`
+}
+
+type mispEvent struct {
+	Attribute []mispAttribute `json:"Attribute"`
+	Object    []struct {
+		Attribute []mispAttribute `json:"Attribute"`
+	} `json:"Object"`
+}
+
+// readMispJSON reads MISP JSON exports, either attribute searches
+// ({"response": {"Attribute": [...]}}) or event exports
+// ({"response": [{"Event": {...}}]}, or a single {"Event": {...}}). Only
+// address attributes (ip-src, ip-dst, their '|port' variants and domain|ip)
+// and domain attributes (domain, hostname) are used, the attribute category
+// and tags are kept. Attributes have no score, so MinRepScore does not apply.
+func readMispJSON(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	var export struct {
+		Response  json.RawMessage `json:"response"`
+		Attribute []mispAttribute `json:"Attribute"`
+		Event     *mispEvent      `json:"Event"`
+	}
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+
+	attributes := export.Attribute
+	var events []mispEvent
+	if export.Event != nil {
+		events = append(events, *export.Event)
+	}
+	if len(export.Response) > 0 {
+		var attributeSearch struct {
+			Attribute []mispAttribute `json:"Attribute"`
+		}
+		var eventSearch []struct {
+			Event mispEvent `json:"Event"`
+		}
+		if err := json.Unmarshal(export.Response, &attributeSearch); err == nil {
+			attributes = append(attributes, attributeSearch.Attribute...)
+		} else if err := json.Unmarshal(export.Response, &eventSearch); err == nil {
+			for _, result := range eventSearch {
+				events = append(events, result.Event)
+			}
+		} else {
+			return nil, errors.New("'response' contains neither attributes nor events")
+		}
+	}
+	for _, event := range events {
+		attributes = append(attributes, event.Attribute...)
+		for _, object := range event.Object {
+			attributes = append(attributes, object.Attribute...)
+		}
+	}
+
+	set := &IndicatorSet{}
+	for i, attribute := range attributes {
+		var entry, domain string
+		switch attribute.Type {
+		case "ip-src", "ip-dst":
+			entry = attribute.Value
+		case "ip-src|port", "ip-dst|port":
+			entry, _, _ = strings.Cut(attribute.Value, "|")
+		case "domain|ip":
+			domain, entry, _ = strings.Cut(attribute.Value, "|")
+		case "domain", "hostname":
+			domain = attribute.Value
+		default:
+			continue
+		}
+		if attribute.Deleted {
+			continue
+		}
+		var prefixes []netip.Prefix
+		if entry != "" {
+			var err error
+			prefixes, err = parsePrefixes(strings.TrimSpace(entry), false)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %d: %w", i, err)
+			}
+		}
+		if domain != "" {
+			var err error
+			domain, err = parseDomain(domain)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %d: %w", i, err)
+			}
+		}
+		var lastEvent time.Time
+		if attribute.Timestamp != "" {
+			seconds, err := strconv.ParseInt(attribute.Timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %d: invalid timestamp: %w", i, err)
+			}
+			lastEvent = time.Unix(seconds, 0).UTC()
+		}
+		var categories, tags []string
+		if attribute.Category != "" {
+			categories = []string{attribute.Category}
+		}
+		for _, tag := range attribute.Tag {
+			tags = append(tags, tag.Name)
+		}
+		indicator := Indicator{
+			Categories: categories,
+			Tags:       tags,
+			LastEvent:  lastEvent,
+		}
+		for _, prefix := range prefixes {
+			indicator := indicator
+			indicator.Prefix = prefix.String()
+			set.Insert(prefix, &indicator)
+		}
+		if domain != "" {
+			indicator := indicator
+			indicator.Domain = domain
+			set.InsertDomain(domain, &indicator)
+		}
+	}
+	return set, nil
+}
+
+// stixObject is the subset of a STIX 2.1 object used for matching.
+type stixObject struct {
+	Type           string    `json:"type"`
+	Value          string    `json:"value"`           // ipv4-addr, ipv6-addr, domain-name
+	Pattern        string    `json:"pattern"`         // indicator
+	PatternType    string    `json:"pattern_type"`    // indicator
+	IndicatorTypes []string  `json:"indicator_types"` // indicator
+	Confidence     *int      `json:"confidence"`
+	Labels         []string  `json:"labels"`
+	Modified       time.Time `json:"modified"`
+	ValidUntil     time.Time `json:"valid_until"`
+	Revoked        bool      `json:"revoked"`
+}
+
+// stixAddressComparison matches the address comparisons of STIX patterns, e.g.
+// "[ipv4-addr:value = '198.51.100.1']" or "[ipv6-addr:value ISSUBSET '2001:db8::/32']".
+var stixAddressComparison = regexp.MustCompile(`ipv[46]-addr:value\s*(?:=|ISSUBSET)\s*'([^']+)'`)
+
+// stixDomainComparison matches the domain comparisons of STIX patterns, e.g.
+// "[domain-name:value = 'bad.example']".
+var stixDomainComparison = regexp.MustCompile(`domain-name:value\s*=\s*'([^']+)'`)
+
+// readStixBundle reads a STIX 2.1 bundle. Addresses and domains are taken
+// from ipv4-addr, ipv6-addr and domain-name objects, and from the address and
+// domain comparisons in the patterns of indicator objects. For indicators, the
+// indicator types are kept as categories, the labels as tags and the
+// confidence as score between 0 and 1. Revoked and expired indicators are
+// skipped, as are indicators with a confidence below MinRepScore.
+func readStixBundle(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	var bundle struct {
+		Type    string       `json:"type"`
+		Objects []stixObject `json:"objects"`
+	}
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Type != "bundle" {
+		return nil, fmt.Errorf("expected an object of type 'bundle', got '%s'", bundle.Type)
+	}
+
+	set := &IndicatorSet{}
+	now := time.Now()
+	for i, object := range bundle.Objects {
+		var entries, domains []string
+		indicator := Indicator{}
+		switch object.Type {
+		case "ipv4-addr", "ipv6-addr":
+			entries = []string{object.Value}
+		case "domain-name":
+			domains = []string{object.Value}
+		case "indicator":
+			if object.PatternType != "" && object.PatternType != "stix" {
+				continue
+			}
+			if object.Revoked || (!object.ValidUntil.IsZero() && object.ValidUntil.Before(now)) {
+				continue
+			}
+			for _, match := range stixAddressComparison.FindAllStringSubmatch(object.Pattern, -1) {
+				entries = append(entries, match[1])
+			}
+			for _, match := range stixDomainComparison.FindAllStringSubmatch(object.Pattern, -1) {
+				domains = append(domains, match[1])
+			}
+			if object.Confidence != nil {
+				indicator.Score = float64(*object.Confidence) / 100
+			}
+			indicator.Categories = object.IndicatorTypes
+			indicator.Tags = object.Labels
+			indicator.LastEvent = object.Modified
+		default:
+			continue
+		}
+		// only indicators with a confidence have a score to compare
+		if object.Confidence != nil && indicator.Score < options.MinRepScore {
+			continue
+		}
+		for _, entry := range domains {
+			domain, err := parseDomain(entry)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %w", i, err)
+			}
+			indicator := indicator
+			indicator.Domain = domain
+			set.InsertDomain(domain, &indicator)
+		}
+		for _, entry := range entries {
+			prefixes, err := parsePrefixes(strings.TrimSpace(entry), false)
+			if err != nil {
+				return nil, fmt.Errorf("object %d: %w", i, err)
+			}
+			for _, prefix := range prefixes {
+				indicator := indicator
+				indicator.Prefix = prefix.String()
+				set.Insert(prefix, &indicator)
+			}
+		}
+	}
+	return set, nil
+}
+
+// validPrefix reports whether entry is a single address or CIDR prefix.
+func validPrefix(entry string) bool {
+	if _, err := netip.ParsePrefix(entry); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(entry)
+	return err == nil
+}
+
+// readFireholNetset reads FireHOL .netset and .ipset files, which contain one
+// address or CIDR prefix per line and '#' comments. Other entries, such as
+// ranges, are rejected.
+func readFireholNetset(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	set := &IndicatorSet{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !validPrefix(line) {
+			return nil, fmt.Errorf("line %d: invalid address or prefix '%s'", lineno, line)
+		}
+		prefixes, err := parsePrefixes(line, false)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		for _, prefix := range prefixes {
+			set.Insert(prefix, &Indicator{Prefix: prefix.String()})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// hostsFileNames are the names found in most hosts files, which are not
+// indicators.
+var hostsFileNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// readHostsFile reads domain blocklists in hosts file format, with lines like
+// '0.0.0.0 bad.example other.example' and '#' comments, as published by many
+// DNS blocklist projects. The addresses are ignored, every name is an exact
+// domain entry.
+func readHostsFile(r io.Reader, options ListOptions) (*IndicatorSet, error) {
+	set := &IndicatorSet{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 || !validPrefix(fields[0]) {
+			return nil, fmt.Errorf("line %d: expected an address followed by names", lineno)
+		}
+		for _, name := range fields[1:] {
+			if hostsFileNames[strings.ToLower(name)] {
+				continue
+			}
+			domain, err := parseDomain(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineno, err)
+			}
+			set.InsertDomain(domain, &Indicator{Domain: domain})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func init() {
+	RegisterFeedParser("plain", FeedParserFunc(readPlainList))
+	RegisterFeedParser("nerd-csv", FeedParserFunc(readNerdCSV))
+	RegisterFeedParser("spamhaus-drop", FeedParserFunc(readSpamhausDrop))
+	RegisterFeedParser("firehol-netset", FeedParserFunc(readFireholNetset))
+	RegisterFeedParser("misp-json", FeedParserFunc(readMispJSON))
+	RegisterFeedParser("stix2", FeedParserFunc(readStixBundle))
+	RegisterFeedParser("hosts", FeedParserFunc(readHostsFile))
+}
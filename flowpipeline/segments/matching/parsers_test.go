@@ -0,0 +1,151 @@
+package matching
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lookupPrefix returns the prefix of the indicator matching addr, or "".
+func lookupPrefix(set *IndicatorSet, addr string) string {
+	if indicator := set.Lookup(net.ParseIP(addr)); indicator != nil {
+		return indicator.Prefix
+	}
+	return ""
+}
+
+func readSample(t *testing.T, path string, options ListOptions) *IndicatorSet {
+	set, err := readIndicatorList(path, options)
+	if err != nil {
+		t.Fatalf("[error] Could not read %s as %s: %v", path, options.Format, err)
+	}
+	return set
+}
+
+func TestFeedParser_spamhausDrop(t *testing.T) {
+	for _, path := range []string{"spamhaus_drop.txt", "spamhaus_drop_v4.json"} {
+		set := readSample(t, path, ListOptions{Format: "spamhaus-drop"})
+		if prefix := lookupPrefix(set, "192.0.2.77"); prefix != "192.0.2.0/24" {
+			t.Errorf("[error] %s: got prefix '%s' for 192.0.2.77.", path, prefix)
+		}
+		if prefix := lookupPrefix(set, "198.51.100.200"); prefix != "" {
+			t.Errorf("[error] %s: 198.51.100.200 matched '%s'.", path, prefix)
+		}
+		if indicator := set.Lookup(net.ParseIP("198.51.100.1")); indicator == nil || !slices.Equal(indicator.Tags, []string{"SBL434604"}) {
+			t.Errorf("[error] %s: SBL id not kept as tag: %+v", path, indicator)
+		}
+	}
+	set := readSample(t, "spamhaus_drop.txt", ListOptions{Format: "spamhaus-drop"})
+	if set.Len() != 3 || lookupPrefix(set, "2001:db8:dead::1") != "2001:db8:dead::/48" {
+		t.Errorf("[error] EDROP style IPv6 entries not read, got %d prefixes.", set.Len())
+	}
+	if _, err := readSpamhausDrop(strings.NewReader("192.0.2.0/33 ; SBL1\n"), ListOptions{}); err == nil {
+		t.Error("[error] Invalid prefix accepted.")
+	}
+}
+
+func TestFeedParser_fireholNetset(t *testing.T) {
+	set := readSample(t, "firehol_level1.netset", ListOptions{Format: "firehol-netset"})
+	if set.Len() != 3 {
+		t.Errorf("[error] Got %d prefixes, should be 3.", set.Len())
+	}
+	if prefix := lookupPrefix(set, "203.0.113.100"); prefix != "203.0.113.64/26" {
+		t.Errorf("[error] Got prefix '%s' for 203.0.113.100.", prefix)
+	}
+	if prefix := lookupPrefix(set, "198.51.100.7"); prefix != "198.51.100.7/32" {
+		t.Errorf("[error] Got prefix '%s' for 198.51.100.7.", prefix)
+	}
+	if _, err := readFireholNetset(strings.NewReader("192.0.2.1 - 192.0.2.9\n"), ListOptions{}); err == nil {
+		t.Error("[error] Ranges accepted in netset.")
+	}
+}
+
+func TestFeedParser_mispJSON(t *testing.T) {
+	set := readSample(t, "misp_attributes.json", ListOptions{Format: "misp-json"})
+	if set.Len() != 4 {
+		t.Errorf("[error] Got %d prefixes and domains, should be 4.", set.Len())
+	}
+	indicator := set.Lookup(net.ParseIP("198.51.100.7"))
+	if indicator == nil || !slices.Equal(indicator.Categories, []string{"Network activity"}) ||
+		!slices.Equal(indicator.Tags, []string{"tlp:green", "botnet-c2"}) || !indicator.LastEvent.Equal(time.Unix(1754836631, 0)) {
+		t.Errorf("[error] Wrong indicator for ip-dst attribute: %+v", indicator)
+	}
+	if prefix := lookupPrefix(set, "192.0.2.1"); prefix != "192.0.2.0/24" {
+		t.Errorf("[error] ip-src|port attribute not read, got '%s'.", prefix)
+	}
+	if prefix := lookupPrefix(set, "2001:db8::7"); prefix != "2001:db8::7/128" {
+		t.Errorf("[error] domain|ip attribute not read, got '%s'.", prefix)
+	}
+	if prefix := lookupPrefix(set, "203.0.113.9"); prefix != "" {
+		t.Error("[error] Deleted attribute was read.")
+	}
+	if indicator := set.LookupHostname("c2.example.com."); indicator == nil || indicator.Domain != "c2.example.com" {
+		t.Errorf("[error] domain attribute not read, got %+v.", indicator)
+	}
+
+	events := `{"response": [{"Event": {"Attribute": [{"type": "ip-dst", "value": "192.0.2.1"}],
+		"Object": [{"Attribute": [{"type": "ip-src", "value": "192.0.2.2"}]}]}}]}`
+	set, err := readMispJSON(strings.NewReader(events), ListOptions{})
+	if err != nil || set.Len() != 2 {
+		t.Errorf("[error] Event export not read: %v", err)
+	}
+	if _, err := readMispJSON(strings.NewReader(`{"response": {"Attribute": [{"type": "ip-dst", "value": "bogus"}]}}`), ListOptions{}); err == nil {
+		t.Error("[error] Invalid attribute value accepted.")
+	}
+}
+
+func TestFeedParser_stix2(t *testing.T) {
+	set := readSample(t, "stix_bundle.json", ListOptions{Format: "stix2"})
+	indicator := set.Lookup(net.ParseIP("198.51.100.7"))
+	if indicator == nil || indicator.Score != 0.85 || !slices.Equal(indicator.Categories, []string{"malicious-activity"}) ||
+		!slices.Equal(indicator.Tags, []string{"botnet-c2"}) {
+		t.Errorf("[error] Wrong indicator for pattern: %+v", indicator)
+	}
+	if prefix := lookupPrefix(set, "2001:db8:beef::1"); prefix != "2001:db8:beef::/48" {
+		t.Errorf("[error] ISSUBSET comparison not read, got '%s'.", prefix)
+	}
+	if prefix := lookupPrefix(set, "192.0.2.1"); prefix != "192.0.2.0/24" {
+		t.Errorf("[error] ipv4-addr object not read, got '%s'.", prefix)
+	}
+	if prefix := lookupPrefix(set, "203.0.113.6"); prefix != "" {
+		t.Error("[error] Expired indicator was read.")
+	}
+	if indicator := set.LookupHostname("c2.example.com"); indicator == nil {
+		t.Error("[error] domain-name comparison not read.")
+	}
+
+	set = readSample(t, "stix_bundle.json", ListOptions{Format: "stix2", MinRepScore: 0.5})
+	if lookupPrefix(set, "203.0.113.5") != "" || lookupPrefix(set, "198.51.100.7") == "" {
+		t.Error("[error] 'min_rep_score' not applied to confidence.")
+	}
+	if lookupPrefix(set, "192.0.2.1") == "" {
+		t.Error("[error] 'min_rep_score' applied to an ipv4-addr object without confidence.")
+	}
+	if _, err := readStixBundle(strings.NewReader(`{"type": "indicator"}`), ListOptions{}); err == nil {
+		t.Error("[error] Non-bundle accepted.")
+	}
+}
+
+func TestFeedParser_hosts(t *testing.T) {
+	hosts := "# blocklist\n127.0.0.1 localhost\n0.0.0.0 Bad.Example other.example # comment\n::1 ip6-localhost\n"
+	set, err := readHostsFile(strings.NewReader(hosts), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != 2 || set.LookupHostname("bad.example") == nil || set.LookupHostname("sub.bad.example") != nil {
+		t.Errorf("[error] Got %d domains from hosts file.", set.Len())
+	}
+	for _, invalid := range []string{"bad.example\n", "0.0.0.0 bad..example\n"} {
+		if _, err := readHostsFile(strings.NewReader(invalid), ListOptions{}); err == nil {
+			t.Errorf("[error] Invalid hosts file line '%s' accepted.", invalid)
+		}
+	}
+}
+
+func TestFeedParser_unknownFormat(t *testing.T) {
+	if _, err := readIndicatorList("bad_ips.txt", ListOptions{Format: "xml"}); err == nil {
+		t.Error("[error] Unknown format accepted.")
+	}
+}
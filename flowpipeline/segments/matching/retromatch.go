@@ -0,0 +1,497 @@
+package matching
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/input/replay"
+)
+
+// Retromatch searches flows stored by the sqlite or clickhouse segments for
+// prefixes added to an indicator list, whenever a new version of the list is
+// loaded. Stored flows involving a new prefix are tagged just like the
+// matching segment would have tagged them and emitted in addition to the
+// flows passing through.
+type Retromatch struct {
+	segments.BaseSegment
+	Lists       []*List       // the lists to watch, configured like those of the matching segment
+	FileName    string        // optional, an sqlite database written by the sqlite segment
+	DSN         string        // optional, a clickhouse database written by the clickhouse segment using the "flowhouse" preset
+	Lookback    time.Duration // optional, default is 72h, how far back to search stored flows
+	InitialScan bool          // optional, default is false, search for all prefixes of the lists once at startup
+}
+
+// Config keys of the retromatch segment, all others are used to configure
+// the lists.
+var retromatchKeys = map[string]bool{"filename": true, "dsn": true, "lookback": true, "initial_scan": true}
+
+// New implements segments.Segment.
+func (segment Retromatch) New(config map[string]string) segments.Segment {
+	newsegment := &Retromatch{
+		FileName: config["filename"],
+		DSN:      config["dsn"],
+		Lookback: 72 * time.Hour,
+	}
+	if newsegment.FileName == "" && newsegment.DSN == "" {
+		log.Error().Msg("Retromatch: This segment requires a 'filename' or a 'dsn' parameter.")
+		return nil
+	}
+	if newsegment.FileName != "" {
+		if err := pingDB("sqlite3", newsegment.FileName); err != nil {
+			log.Error().Err(err).Msgf("Retromatch: Could not open DB file at %s: ", newsegment.FileName)
+			return nil
+		}
+	}
+	if newsegment.DSN != "" {
+		if err := pingDB("clickhouse", newsegment.DSN); err != nil {
+			log.Error().Err(err).Msg("Retromatch: Could not open clickhouse database: ")
+			return nil
+		}
+	}
+	if config["lookback"] != "" {
+		lookback, err := time.ParseDuration(config["lookback"])
+		if err != nil || lookback <= 0 {
+			log.Error().Msg("Retromatch: Could not parse 'lookback' parameter, must be a positive duration such as '72h'.")
+			return nil
+		}
+		newsegment.Lookback = lookback
+	} else {
+		log.Info().Msg("Retromatch: 'lookback' set to default '72h'.")
+	}
+	if config["initial_scan"] != "" {
+		initialScan, err := strconv.ParseBool(config["initial_scan"])
+		if err != nil {
+			log.Error().Msg("Retromatch: Could not parse 'initial_scan' parameter, must be a boolean.")
+			return nil
+		}
+		newsegment.InitialScan = initialScan
+	}
+
+	listConfig := make(map[string]string)
+	for key, value := range config {
+		if !retromatchKeys[key] {
+			listConfig[key] = value
+		}
+	}
+	matching, ok := MatchingSegment{}.New(listConfig).(*MatchingSegment)
+	if !ok || matching == nil {
+		log.Error().Msg("Retromatch: Could not set up lists.")
+		return nil
+	}
+	newsegment.Lists = matching.Lists
+	matching.releaseJournal() // only the lists are used
+	return newsegment
+}
+
+// pingDB checks that a database can be connected to.
+func pingDB(driver string, dsn string) error {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+var errRetromatchStopped = errors.New("stopped")
+
+// Run implements segments.Segment.
+func (segment *Retromatch) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	var stores []flowStore
+	if segment.FileName != "" {
+		db, err := sql.Open("sqlite3", segment.FileName)
+		if err != nil {
+			log.Panic().Err(err).Msgf("Retromatch: Failed opening DB \"%s\"", segment.FileName) // this has already been checked in New
+		}
+		defer db.Close()
+		stores = append(stores, &sqliteStore{db: db, fileName: segment.FileName})
+	}
+	if segment.DSN != "" {
+		db, err := sql.Open("clickhouse", segment.DSN)
+		if err != nil {
+			log.Panic().Err(err).Msg("Retromatch: Failed opening clickhouse database") // this has already been checked in New
+		}
+		defer db.Close()
+		stores = append(stores, &clickhouseStore{db})
+	}
+
+	var feeds []*feedUpdater
+	for _, list := range segment.Lists {
+		list.list.start()
+		list.allowlist.start()
+		if list.feed != nil {
+			feeds = append(feeds, startFeed(list.feed))
+		}
+	}
+	defer func() {
+		for _, feed := range feeds {
+			feed.done()
+		}
+		for _, list := range segment.Lists {
+			list.allowlist.done()
+			list.list.done()
+			list.release()
+		}
+	}()
+
+	found := make(chan *pb.EnrichedFlow)
+	stop := make(chan struct{})
+	searches := &sync.WaitGroup{}
+	for _, list := range segment.Lists {
+		searches.Add(1)
+		go func(list *List) {
+			defer searches.Done()
+			segment.watch(list, stores, found, stop)
+		}(list)
+	}
+	for {
+		select {
+		case msg, ok := <-segment.In:
+			if !ok {
+				close(stop)
+				searches.Wait()
+				return
+			}
+			segment.Out <- msg
+		case msg := <-found:
+			segment.Out <- msg
+		}
+	}
+}
+
+// Close implements segments.Segment. It releases the lists of a segment which
+// is never run.
+func (segment *Retromatch) Close() {
+	for _, list := range segment.Lists {
+		list.release()
+	}
+}
+
+// watch searches the stores for the prefixes added by every new version of
+// the list until stop is closed.
+func (segment *Retromatch) watch(list *List, stores []flowStore, found chan<- *pb.EnrichedFlow, stop <-chan struct{}) {
+	previous := list.list.Load()
+	if segment.InitialScan {
+		if !segment.search(list, previous, stores, found, stop) {
+			return
+		}
+	}
+	for {
+		// get the channel first, so that no version swapped in after
+		// loading the current one is missed
+		updated := list.list.Updated()
+		current := list.list.Load()
+		if current != previous {
+			added := current.Added(previous)
+			previous = current
+			if added.Len() > 0 && !segment.search(list, added, stores, found, stop) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-updated:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// search emits all stored flows within the lookback period matching
+// indicators, tagged for list. It returns false if stop was closed.
+func (segment *Retromatch) search(list *List, indicators *IndicatorSet, stores []flowStore, found chan<- *pb.EnrichedFlow, stop <-chan struct{}) bool {
+	since := time.Now().Add(-segment.Lookback)
+	prefixes := indicators.Prefixes()
+	for _, store := range stores {
+		var count int
+		err := store.search(prefixes, since, func(msg *pb.EnrichedFlow) error {
+			src, dst := flowAddresses(msg)
+			indicator, side, _ := list.match(indicators, msg, src, dst)
+			if indicator == nil {
+				return nil
+			}
+			list.tag(msg, indicator, side)
+			select {
+			case found <- msg:
+				count += 1
+				return nil
+			case <-stop:
+				return errRetromatchStopped
+			}
+		})
+		if errors.Is(err, errRetromatchStopped) {
+			return false
+		} else if err != nil {
+			log.Error().Err(err).Msgf("Retromatch: Failed searching %s for list '%s': ", store, list.label())
+			continue
+		}
+		log.Info().Msgf("Retromatch: Found %d flows of the last %s in %s for %d new prefixes of list '%s'.", count, segment.Lookback, store, len(prefixes), list.label())
+	}
+	return true
+}
+
+// A flowStore is a database of flows stored by one of the output segments.
+type flowStore interface {
+	// search calls handle for stored flows received since the given time
+	// which may involve one of prefixes. Stores may return additional
+	// flows, but not less.
+	search(prefixes []netip.Prefix, since time.Time, handle func(*pb.EnrichedFlow) error) error
+	String() string
+}
+
+// sqliteStore searches a database written by the sqlite segment. Addresses are
+// stored as text, so flows are selected by the text ranges their addresses
+// fall into, using indexes on the address columns which are added on the
+// first search. If a prefix has no such range, all flows in the lookback
+// period are returned.
+type sqliteStore struct {
+	db       *sql.DB
+	fileName string
+
+	indexLock sync.Mutex
+	indexed   bool
+}
+
+const sqliteRangesPerQuery = 2000
+
+func (store *sqliteStore) search(prefixes []netip.Prefix, since time.Time, handle func(*pb.EnrichedFlow) error) error {
+	store.createIndexes()
+	// the sqlite segment may store a subset of the flow fields, depending
+	// on its 'fields' parameter and version
+	columns, err := replay.FlowColumns(store.db)
+	if err != nil {
+		return err
+	}
+	var ranges []textRange
+	for _, prefix := range prefixes {
+		prefixRanges, ok := textRanges(prefix)
+		if !ok {
+			return replay.ScanFlows(store.db, fmt.Sprintf("SELECT %s FROM flows WHERE TimeReceivedNs >= ?", strings.Join(columns, ",")), []any{since.UnixNano()}, handle)
+		}
+		ranges = append(ranges, prefixRanges...)
+	}
+	for start := 0; start < len(ranges); start += sqliteRangesPerQuery {
+		end := min(start+sqliteRangesPerQuery, len(ranges))
+		query, args := sqliteQuery(columns, ranges[start:end], since)
+		if err := replay.ScanFlows(store.db, query, args, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndexes adds indexes on the address columns unless this has been done
+// already. It is retried on the next search if the table does not exist yet.
+func (store *sqliteStore) createIndexes() {
+	store.indexLock.Lock()
+	defer store.indexLock.Unlock()
+	if store.indexed {
+		return
+	}
+	for _, column := range []string{"SrcAddr", "DstAddr"} {
+		if _, err := store.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS flows_%s ON flows (%s)", column, column)); err != nil {
+			log.Warn().Err(err).Msgf("Retromatch: Could not index %s in %s, searching all flows: ", column, store.fileName)
+			return
+		}
+	}
+	store.indexed = true
+}
+
+// A textRange selects the addresses stored as text by the sqlite segment
+// which start with prefix, or which are equal to it if exact is set.
+type textRange struct {
+	prefix string
+	exact  bool
+}
+
+// textRanges returns text ranges covering all addresses of prefix. IPv4
+// prefixes are split at octet boundaries. IPv6 addresses share a start only
+// up to their first zero group, which may be compressed, so false is returned
+// for IPv6 prefixes starting with one.
+func textRanges(prefix netip.Prefix) ([]textRange, bool) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	if prefix.Bits() == addr.BitLen() {
+		return []textRange{{addr.String(), true}}, true
+	}
+	if addr.Is4() {
+		octets := (prefix.Bits() + 7) / 8
+		if octets == 0 {
+			return nil, false
+		}
+		b := addr.As4()
+		start := binary.BigEndian.Uint32(b[:])
+		step := uint32(1) << (32 - 8*octets)
+		ranges := make([]textRange, 0, 1<<(8*octets-prefix.Bits()))
+		for i := 0; i < cap(ranges); i++ {
+			binary.BigEndian.PutUint32(b[:], start+uint32(i)*step)
+			parts := make([]string, octets)
+			for j := range parts {
+				parts[j] = strconv.Itoa(int(b[j]))
+			}
+			if octets == 4 {
+				ranges = append(ranges, textRange{strings.Join(parts, "."), true})
+			} else {
+				ranges = append(ranges, textRange{strings.Join(parts, ".") + ".", false})
+			}
+		}
+		return ranges, true
+	}
+	b := addr.As16()
+	var groups []string
+	for i := 0; i < prefix.Bits()/16; i++ {
+		group := binary.BigEndian.Uint16(b[2*i:])
+		if group == 0 {
+			break
+		}
+		groups = append(groups, strconv.FormatUint(uint64(group), 16))
+	}
+	if len(groups) == 0 {
+		return nil, false
+	}
+	return []textRange{{strings.Join(groups, ":") + ":", false}}, true
+}
+
+// sqliteQuery returns a query for columns of all flows stored by the sqlite
+// segment received since the given time with a source or destination address
+// within one of ranges, and its arguments.
+func sqliteQuery(columns []string, ranges []textRange, since time.Time) (string, []any) {
+	args := []any{since.UnixNano()}
+	conditions := make([]string, 0, 2*len(ranges))
+	for _, column := range []string{"SrcAddr", "DstAddr"} {
+		for _, r := range ranges {
+			if r.exact {
+				conditions = append(conditions, column+" = ?")
+				args = append(args, r.prefix)
+				continue
+			}
+			// all strings starting with prefix sort before prefix with its last character incremented
+			end := r.prefix[:len(r.prefix)-1] + string(r.prefix[len(r.prefix)-1]+1)
+			conditions = append(conditions, fmt.Sprintf("(%s >= ? AND %s < ?)", column, column))
+			args = append(args, r.prefix, end)
+		}
+	}
+	return fmt.Sprintf("SELECT %s FROM flows WHERE TimeReceivedNs >= ? AND (%s)", strings.Join(columns, ","), strings.Join(conditions, " OR ")), args
+}
+
+func (store *sqliteStore) String() string {
+	return store.fileName
+}
+
+// clickhouseStore searches a database written by the clickhouse segment using
+// the "flowhouse" preset. Flows are selected by address, querying for at most
+// clickhousePrefixesPerQuery prefixes at a time.
+type clickhouseStore struct {
+	db *sql.DB
+}
+
+const clickhousePrefixesPerQuery = 500
+
+func (store *clickhouseStore) search(prefixes []netip.Prefix, since time.Time, handle func(*pb.EnrichedFlow) error) error {
+	for start := 0; start < len(prefixes); start += clickhousePrefixesPerQuery {
+		end := min(start+clickhousePrefixesPerQuery, len(prefixes))
+		query, args := flowhouseQuery(prefixes[start:end], since)
+		if err := store.query(query, args, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *clickhouseStore) query(query string, args []any, handle func(*pb.EnrichedFlow) error) error {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var agent, srcAddr, dstAddr, nextHop net.IP
+		var intIn, intOut string
+		var srcAs, dstAs uint32
+		var proto uint8
+		var srcPort, dstPort uint16
+		var timestamp time.Time
+		var size, packets, samplingRate uint64
+		if err := rows.Scan(&agent, &intIn, &intOut, &srcAddr, &dstAddr, &nextHop, &srcAs, &dstAs, &proto, &srcPort, &dstPort, &timestamp, &size, &packets, &samplingRate); err != nil {
+			return err
+		}
+		flow := &pb.EnrichedFlow{
+			SamplerAddress: unmapAddr(agent),
+			SrcIfDesc:      intIn,
+			DstIfDesc:      intOut,
+			SrcAddr:        unmapAddr(srcAddr),
+			DstAddr:        unmapAddr(dstAddr),
+			NextHop:        unmapAddr(nextHop),
+			SrcAs:          srcAs,
+			DstAs:          dstAs,
+			Proto:          uint32(proto),
+			SrcPort:        uint32(srcPort),
+			DstPort:        uint32(dstPort),
+			TimeReceivedNs: uint64(timestamp.UnixNano()),
+			Bytes:          size,
+			Packets:        packets,
+			SamplingRate:   samplingRate,
+			Etype:          0x86dd,
+		}
+		if len(flow.SrcAddr) == net.IPv4len {
+			flow.Etype = 0x0800
+		}
+		if err := handle(flow); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (store *clickhouseStore) String() string {
+	return "clickhouse"
+}
+
+// flowhouseQuery returns a query for all flows of the "flowhouse" schema
+// received since the given time with a source or destination address within
+// one of prefixes, and its arguments. IPv4 addresses are stored as IPv4-mapped
+// IPv6 addresses, which toIPv6 converts them to as well.
+func flowhouseQuery(prefixes []netip.Prefix, since time.Time) (string, []any) {
+	args := []any{since}
+	conditions := make([]string, 0, 2*len(prefixes))
+	for _, column := range []string{"src_ip_addr", "dst_ip_addr"} {
+		for _, prefix := range prefixes {
+			conditions = append(conditions, fmt.Sprintf("%s BETWEEN toIPv6(?) AND toIPv6(?)", column))
+			args = append(args, prefix.Masked().Addr().String(), lastAddr(prefix).String())
+		}
+	}
+	query := `SELECT agent, int_in, int_out, src_ip_addr, dst_ip_addr, nexthop, src_asn, dst_asn,
+		ip_protocol, src_port, dst_port, timestamp, size, packets, samplerate
+		FROM flows WHERE timestamp >= ? AND (` + strings.Join(conditions, " OR ") + ")"
+	return query, args
+}
+
+// unmapAddr returns IPv4-mapped addresses in their 4 byte form.
+func unmapAddr(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func init() {
+	segment := &Retromatch{}
+	segments.RegisterSegment("retromatch", segment)
+}
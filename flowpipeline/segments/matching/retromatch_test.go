@@ -0,0 +1,188 @@
+//go:build cgo
+// +build cgo
+
+package matching
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments/output/sqlite"
+)
+
+// writeTestFlows stores the given fields of flows using the sqlite segment,
+// all fields if empty.
+func writeTestFlows(t *testing.T, fields string, flows ...*pb.EnrichedFlow) string {
+	path := filepath.Join(t.TempDir(), "flows.sqlite")
+	segment := sqlite.Sqlite{}.New(map[string]string{"filename": path, "fields": fields})
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	for _, flow := range flows {
+		in <- flow
+		<-out
+	}
+	close(in)
+	wg.Wait()
+	return path
+}
+
+func startRetromatch(t *testing.T, config map[string]string) (chan *pb.EnrichedFlow, chan *pb.EnrichedFlow, func()) {
+	segment := Retromatch{}.New(config)
+	if segment == nil {
+		t.Fatal("[error] Segment Retromatch failed to initialize.")
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	return in, out, func() {
+		close(in)
+		for range out {
+		}
+		wg.Wait()
+	}
+}
+
+func receiveFlow(t *testing.T, out chan *pb.EnrichedFlow) *pb.EnrichedFlow {
+	select {
+	case flow := <-out:
+		return flow
+	case <-time.After(5 * time.Second):
+		t.Fatal("[error] Segment Retromatch did not emit a flow in time.")
+	}
+	return nil
+}
+
+// Retromatch Segment test, stored flows are searched for added prefixes
+func TestSegment_Retromatch_reload(t *testing.T) {
+	now := uint64(time.Now().UnixNano())
+	db := writeTestFlows(t, "",
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("198.51.100.1").To4(), TimeReceivedNs: now, Bytes: 10},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.9").To4(), DstAddr: net.ParseIP("192.0.2.1").To4(), TimeReceivedNs: now, Bytes: 20},
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("203.0.113.10").To4(), DstAddr: net.ParseIP("192.0.2.1").To4(), TimeReceivedNs: now - uint64(200*time.Hour), Bytes: 30},
+	)
+	path := writeTestList(t, "198.51.100.1\n")
+	in, out, stop := startRetromatch(t, map[string]string{"ip_list_path": path, "reload_interval": "10ms", "tid": "65005", "filename": db})
+	defer stop()
+
+	in <- &pb.EnrichedFlow{Bytes: 1}
+	if result := receiveFlow(t, out); result.Bytes != 1 || result.Inlist {
+		t.Error("[error] Segment Retromatch is not passing through flows unchanged.")
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("198.51.100.1\n203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	result := receiveFlow(t, out)
+	if result.Bytes != 20 || result.Tid != 65005 || result.MatchedPrefix != "203.0.113.0/24" || result.MatchedSide != pb.EnrichedFlow_MatchedSrc {
+		t.Errorf("[error] Segment Retromatch emitted an unexpected flow, got %d bytes, Tid %d, MatchedPrefix '%s'.", result.Bytes, result.Tid, result.MatchedPrefix)
+	}
+	if !net.IP(result.SrcAddr).Equal(net.ParseIP("203.0.113.9")) {
+		t.Errorf("[error] Segment Retromatch is not restoring stored addresses, got %v.", result.SrcAddr)
+	}
+	select {
+	case result := <-out:
+		t.Errorf("[error] Segment Retromatch emitted a flow outside the lookback period or for an old prefix, got %d bytes.", result.Bytes)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Retromatch Segment test, all prefixes are searched at startup if requested
+func TestSegment_Retromatch_initialScan(t *testing.T) {
+	db := writeTestFlows(t, "",
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("198.51.100.7").To4(), TimeReceivedNs: uint64(time.Now().UnixNano())},
+	)
+	_, out, stop := startRetromatch(t, map[string]string{"ip_list_path": writeTestList(t, testList), "filename": db, "initial_scan": "true"})
+	defer stop()
+	result := receiveFlow(t, out)
+	if result.MatchedPrefix != "198.51.100.7/32" || result.MatchedSide != pb.EnrichedFlow_MatchedDst {
+		t.Errorf("[error] Segment Retromatch is not searching at startup, got MatchedPrefix '%s'.", result.MatchedPrefix)
+	}
+}
+
+// Retromatch Segment test, databases storing a subset of the fields are searched
+func TestSegment_Retromatch_fieldSubset(t *testing.T) {
+	db := writeTestFlows(t, "TimeReceivedNs,SrcAddr,DstAddr,Bytes",
+		&pb.EnrichedFlow{SrcAddr: net.ParseIP("192.0.2.1").To4(), DstAddr: net.ParseIP("198.51.100.7").To4(), TimeReceivedNs: uint64(time.Now().UnixNano()), Bytes: 42, Packets: 3},
+	)
+	_, out, stop := startRetromatch(t, map[string]string{"ip_list_path": writeTestList(t, testList), "filename": db, "initial_scan": "true"})
+	defer stop()
+	result := receiveFlow(t, out)
+	if result.MatchedPrefix != "198.51.100.7/32" || result.Bytes != 42 || result.Packets != 0 {
+		t.Errorf("[error] Segment Retromatch is not reading a subset of the fields, got MatchedPrefix '%s', %d bytes.", result.MatchedPrefix, result.Bytes)
+	}
+	if !net.IP(result.SrcAddr).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("[error] Segment Retromatch is not restoring stored addresses, got %v.", result.SrcAddr)
+	}
+}
+
+// Retromatch Segment test, a database is required
+func TestSegment_Retromatch_noDatabase(t *testing.T) {
+	if (Retromatch{}).New(map[string]string{"ip_list_path": writeTestList(t, testList)}) != nil {
+		t.Error("[error] Segment Retromatch initializes without a database.")
+	}
+	if (Retromatch{}).New(map[string]string{"ip_list_path": writeTestList(t, testList), "filename": filepath.Join(t.TempDir(), "missing", "flows.sqlite")}) != nil {
+		t.Error("[error] Segment Retromatch initializes with a database which cannot be opened.")
+	}
+}
+
+func TestFlowhouseQuery(t *testing.T) {
+	query, args := flowhouseQuery([]netip.Prefix{netip.MustParsePrefix("203.0.113.0/24"), netip.MustParsePrefix("2001:db8::/32")}, time.Unix(0, 0))
+	if strings.Count(query, "?") != len(args) || len(args) != 9 {
+		t.Errorf("[error] Query has %d placeholders for %d arguments.", strings.Count(query, "?"), len(args))
+	}
+	if args[1] != "203.0.113.0" || args[2] != "203.0.113.255" || args[4] != "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff" {
+		t.Errorf("[error] Query has unexpected address ranges %v.", args)
+	}
+}
+
+func TestTextRanges(t *testing.T) {
+	for prefix, expected := range map[string][]textRange{
+		"192.0.2.1/32":    {{"192.0.2.1", true}},
+		"192.0.2.0/24":    {{"192.0.2.", false}},
+		"10.0.0.0/15":     {{"10.0.", false}, {"10.1.", false}},
+		"192.0.2.0/31":    {{"192.0.2.0", true}, {"192.0.2.1", true}},
+		"2001:db8::/32":   {{"2001:db8:", false}},
+		"2001:db8::1/128": {{"2001:db8::1", true}},
+		"2001:0:1::/48":   {{"2001:", false}},
+	} {
+		ranges, ok := textRanges(netip.MustParsePrefix(prefix))
+		if !ok || !slices.Equal(ranges, expected) {
+			t.Errorf("[error] Got text ranges %v for %s, should be %v.", ranges, prefix, expected)
+		}
+	}
+	for _, prefix := range []string{"0.0.0.0/0", "::/0", "::ffff:0:0/96"} {
+		if _, ok := textRanges(netip.MustParsePrefix(prefix)); ok {
+			t.Errorf("[error] Got text ranges for %s, which has none.", prefix)
+		}
+	}
+}
+
+func TestSqliteQuery(t *testing.T) {
+	query, args := sqliteQuery([]string{"SrcAddr", "DstAddr"}, []textRange{{"192.0.2.", false}, {"198.51.100.7", true}}, time.Unix(0, 0))
+	if strings.Count(query, "?") != len(args) || len(args) != 7 {
+		t.Errorf("[error] Query has %d placeholders for %d arguments.", strings.Count(query, "?"), len(args))
+	}
+	if args[1] != "192.0.2." || args[2] != "192.0.2/" || args[3] != "198.51.100.7" {
+		t.Errorf("[error] Query has unexpected address ranges %v.", args)
+	}
+	if !strings.HasPrefix(query, "SELECT SrcAddr,DstAddr FROM flows ") {
+		t.Errorf("[error] Query does not select the given columns: %s", query)
+	}
+}
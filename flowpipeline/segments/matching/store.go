@@ -0,0 +1,517 @@
+package matching
+
+import (
+	"cmp"
+	"encoding/binary"
+	"hash/maphash"
+	"iter"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// An IndicatorSet stores indicators for longest prefix lookups, and domain
+// indicators for hostname lookups. It is built
+// using Insert and compacted before its first lookup into one sorted array of
+// packed 16-byte keys per prefix length, which keeps memory use at about 20
+// bytes per prefix, plus the metadata of indicators which carry any.
+// Compacted sets are immutable and safe for concurrent lookups, they are
+// shared by all segments using the same list. Sets returned by
+// readIndicatorList are always compacted.
+type IndicatorSet struct {
+	pending     []pendingIndicator
+	hasPending  atomic.Bool // whether pending needs to be compacted before lookups
+	compactLock sync.Mutex  // guards compacting pending indicators on first use
+
+	tables     []prefixTable // longest prefixes first
+	indicators []*Indicator  // indicators with metadata, see prefixTable.meta
+	bloom      *bloomFilter  // optional pre-check of all keys
+	length     int
+
+	domains map[string]*Indicator // by domain entry, see parseDomain
+
+	expires time.Time // when the oldest remaining indicator exceeds the list's max age, zero if none will
+	matcher Matcher   // used for lookups instead of the sorted tables, if set
+}
+
+type pendingIndicator struct {
+	prefix    netip.Prefix
+	indicator *Indicator
+}
+
+// A prefixKey is an address packed into two integers, IPv4 addresses are
+// stored in their IPv4-mapped IPv6 form.
+type prefixKey struct {
+	hi, lo uint64
+}
+
+// A prefixTable holds all prefixes of one address family and length.
+type prefixTable struct {
+	is4   bool
+	bits  int // relative to the 128 bit key, i.e. 96 more than the IPv4 prefix length
+	keys  []prefixKey
+	meta  []uint32 // index+1 into IndicatorSet.indicators for each key, 0 if there is no metadata, nil if there is none at all
+	index []uint32 // for large tables, the first key for each value of the leading 16 address bits, narrowing down searches
+}
+
+// Insert adds an indicator for the given prefix. Inserting the same prefix
+// twice replaces the previous indicator, keeping the port constraints of both,
+// see mergePorts. Insert must not be called once the set is in use for
+// lookups.
+func (set *IndicatorSet) Insert(prefix netip.Prefix, indicator *Indicator) {
+	if !prefix.IsValid() {
+		return
+	}
+	set.pending = append(set.pending, pendingIndicator{prefix.Masked(), indicator})
+	set.hasPending.Store(true)
+}
+
+// InsertDomain adds an indicator for a domain entry as returned by
+// parseDomain. Inserting the same entry twice replaces the previous indicator,
+// keeping the port constraints of both, see mergePorts. InsertDomain must not
+// be called once the set is in use for lookups.
+func (set *IndicatorSet) InsertDomain(domain string, indicator *Indicator) {
+	if set.domains == nil {
+		set.domains = make(map[string]*Indicator)
+	}
+	set.domains[domain] = mergePorts(set.domains[domain], indicator)
+}
+
+// expire drops all indicators whose last event is before cutoff, indicators
+// without one are kept. The time of the oldest remaining last event is
+// returned, or zero if there is none. expire must not be called once the set
+// is in use for lookups.
+func (set *IndicatorSet) expire(cutoff time.Time) (dropped int, oldest time.Time) {
+	keep := func(indicator *Indicator) bool {
+		if indicator == nil || indicator.LastEvent.IsZero() {
+			return true
+		}
+		if indicator.LastEvent.Before(cutoff) {
+			dropped += 1
+			return false
+		}
+		if oldest.IsZero() || indicator.LastEvent.Before(oldest) {
+			oldest = indicator.LastEvent
+		}
+		return true
+	}
+	set.pending = slices.DeleteFunc(set.pending, func(p pendingIndicator) bool { return !keep(p.indicator) })
+	for domain, indicator := range set.domains {
+		if !keep(indicator) {
+			delete(set.domains, domain)
+		}
+	}
+	return dropped, oldest
+}
+
+// LookupHostname returns the indicator of the most specific domain entry
+// matching hostname, or nil if there is none. Entries like "bad.example"
+// match only this name, entries like "*.bad.example" match all names below it.
+func (set *IndicatorSet) LookupHostname(hostname string) *Indicator {
+	return set.lookupHostname(hostname, nil)
+}
+
+// LookupHostnameFlow is like LookupHostname, but skips entries whose port
+// constraints are not satisfied by msg.
+func (set *IndicatorSet) LookupHostnameFlow(hostname string, msg *pb.EnrichedFlow) *Indicator {
+	return set.lookupHostname(hostname, msg)
+}
+
+func (set *IndicatorSet) lookupHostname(hostname string, msg *pb.EnrichedFlow) *Indicator {
+	if len(set.domains) == 0 || hostname == "" {
+		return nil
+	}
+	name := normalizeHostname(hostname)
+	if indicator, ok := set.domains[name]; ok && (msg == nil || indicator.Allows(msg)) {
+		return indicator
+	}
+	for {
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return nil
+		}
+		if indicator, ok := set.domains["*."+parent]; ok && (msg == nil || indicator.Allows(msg)) {
+			return indicator
+		}
+		name = parent
+	}
+}
+
+// Lookup returns the indicator with the most specific prefix containing ip,
+// or nil if there is none.
+func (set *IndicatorSet) Lookup(ip net.IP) *Indicator {
+	return set.lookup(ip, nil)
+}
+
+// LookupFlow returns the indicator with the most specific prefix containing
+// ip whose port constraints are satisfied by msg, or nil if there is none.
+func (set *IndicatorSet) LookupFlow(ip net.IP, msg *pb.EnrichedFlow) *Indicator {
+	return set.lookup(ip, msg)
+}
+
+// lookup implements Lookup and LookupFlow, msg is nil for the former.
+func (set *IndicatorSet) lookup(ip net.IP, msg *pb.EnrichedFlow) *Indicator {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	if set.matcher != nil {
+		return set.matcher.Match(addr.Unmap(), msg)
+	}
+	return set.Match(addr.Unmap(), msg)
+}
+
+// Match implements Matcher by searching the sorted tables, which is the
+// "sorted" matcher.
+func (set *IndicatorSet) Match(addr netip.Addr, flow *pb.EnrichedFlow) *Indicator {
+	set.compactPending()
+	is4 := addr.Is4()
+	key := keyFromAddr(addr)
+	for t := range set.tables {
+		table := &set.tables[t]
+		if table.is4 != is4 {
+			continue
+		}
+		masked := key.mask(table.bits)
+		if set.bloom != nil && !set.bloom.contains(table.bits, masked) {
+			continue
+		}
+		i, found := table.search(masked)
+		if !found {
+			continue
+		}
+		if table.meta != nil && table.meta[i] != 0 {
+			indicator := set.indicators[table.meta[i]-1]
+			if flow != nil && !indicator.Allows(flow) {
+				continue // try less specific prefixes
+			}
+			return indicator
+		}
+		return &Indicator{Prefix: table.prefix(masked).String()}
+	}
+	return nil
+}
+
+// All iterates over all distinct prefixes in this set and their indicators,
+// longest prefixes first. Indicators without metadata are created on the fly.
+func (set *IndicatorSet) All() iter.Seq2[netip.Prefix, *Indicator] {
+	return func(yield func(netip.Prefix, *Indicator) bool) {
+		set.compactPending()
+		for t := range set.tables {
+			table := &set.tables[t]
+			for i, key := range table.keys {
+				prefix := table.prefix(key)
+				indicator := &Indicator{Prefix: prefix.String()}
+				if table.meta != nil && table.meta[i] != 0 {
+					indicator = set.indicators[table.meta[i]-1]
+				}
+				if !yield(prefix, indicator) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Len returns the number of distinct prefixes and domain entries in this set.
+func (set *IndicatorSet) Len() int {
+	set.compactPending()
+	return set.length + len(set.domains)
+}
+
+// Prefixes returns all distinct prefixes in this set, longest first.
+func (set *IndicatorSet) Prefixes() []netip.Prefix {
+	set.compactPending()
+	prefixes := make([]netip.Prefix, 0, set.length)
+	for t := range set.tables {
+		for _, key := range set.tables[t].keys {
+			prefixes = append(prefixes, set.tables[t].prefix(key))
+		}
+	}
+	return prefixes
+}
+
+// Diff returns the number of distinct prefixes and domain entries present in
+// set, but not in previous, and vice versa.
+func (set *IndicatorSet) Diff(previous *IndicatorSet) (added int, removed int) {
+	set.compactPending()
+	previous.compactPending()
+	var common int
+	for _, table := range set.tables {
+		for _, other := range previous.tables {
+			if other.is4 != table.is4 || other.bits != table.bits {
+				continue
+			}
+			for _, key := range table.keys {
+				if _, found := other.search(key); found {
+					common += 1
+				}
+			}
+		}
+	}
+	for domain := range set.domains {
+		if _, found := previous.domains[domain]; found {
+			common += 1
+		}
+	}
+	return set.Len() - common, previous.Len() - common
+}
+
+// Added returns a compacted set of the prefixes and domain entries present in
+// set, but not in previous, along with their indicators.
+func (set *IndicatorSet) Added(previous *IndicatorSet) *IndicatorSet {
+	set.compactPending()
+	previous.compactPending()
+	added := &IndicatorSet{}
+	for _, table := range set.tables {
+		var other *prefixTable
+		for t := range previous.tables {
+			if previous.tables[t].is4 == table.is4 && previous.tables[t].bits == table.bits {
+				other = &previous.tables[t]
+			}
+		}
+		for i, key := range table.keys {
+			if other != nil {
+				if _, found := other.search(key); found {
+					continue
+				}
+			}
+			prefix := table.prefix(key)
+			indicator := &Indicator{Prefix: prefix.String()}
+			if table.meta != nil && table.meta[i] != 0 {
+				indicator = set.indicators[table.meta[i]-1]
+			}
+			added.Insert(prefix, indicator)
+		}
+	}
+	for domain, indicator := range set.domains {
+		if _, found := previous.domains[domain]; !found {
+			added.InsertDomain(domain, indicator)
+		}
+	}
+	added.compact(false)
+	return added
+}
+
+// compactPending compacts a set built by a caller other than
+// readIndicatorList, such as the tests. It is safe to call from concurrent
+// lookups, which only check an atomic flag once the set is compacted.
+func (set *IndicatorSet) compactPending() {
+	if !set.hasPending.Load() {
+		return
+	}
+	set.compactLock.Lock()
+	defer set.compactLock.Unlock()
+	if set.hasPending.Load() {
+		set.compact(false)
+	}
+}
+
+// compact moves all pending indicators into the sorted tables and builds the
+// Bloom filter if requested.
+func (set *IndicatorSet) compact(bloom bool) {
+	type tableID struct {
+		is4  bool
+		bits int
+	}
+	type entry struct {
+		key       prefixKey
+		seq       int // insertion order, so that the last of several equal keys wins below
+		indicator *Indicator
+	}
+	grouped := make(map[tableID][]entry)
+	for _, pending := range set.pending {
+		id := tableID{pending.prefix.Addr().Is4(), pending.prefix.Bits()}
+		if id.is4 {
+			id.bits += 96
+		}
+		grouped[id] = append(grouped[id], entry{keyFromAddr(pending.prefix.Addr()), len(grouped[id]), pending.indicator})
+	}
+	set.pending, set.tables, set.indicators, set.length = nil, nil, nil, 0
+	for id, entries := range grouped {
+		slices.SortFunc(entries, func(a, b entry) int {
+			if c := comparePrefixKeys(a.key, b.key); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.seq, b.seq)
+		})
+		table := prefixTable{is4: id.is4, bits: id.bits}
+		for i := 0; i < len(entries); i++ {
+			entry := entries[i]
+			indicator := entry.indicator
+			for i+1 < len(entries) && entries[i+1].key == entry.key {
+				i += 1
+				indicator = mergePorts(indicator, entries[i].indicator)
+			}
+			var meta uint32
+			if indicator.hasMetadata() {
+				set.indicators = append(set.indicators, indicator)
+				meta = uint32(len(set.indicators))
+				if table.meta == nil {
+					table.meta = make([]uint32, len(table.keys), cap(table.keys))
+				}
+			}
+			table.keys = append(table.keys, entry.key)
+			if table.meta != nil {
+				table.meta = append(table.meta, meta)
+			}
+		}
+		table.keys = slices.Clip(table.keys)
+		if table.meta != nil {
+			table.meta = slices.Clip(table.meta)
+		}
+		if len(table.keys) >= 1<<16 {
+			table.index = make([]uint32, 1<<16+1)
+			var next int
+			for b := range table.index { // first key in bucket b or later
+				for next < len(table.keys) && table.bucket(table.keys[next]) < b {
+					next += 1
+				}
+				table.index[b] = uint32(next)
+			}
+		}
+		set.tables = append(set.tables, table)
+		set.length += len(table.keys)
+	}
+	slices.SortFunc(set.tables, func(a, b prefixTable) int { return cmp.Compare(b.bits, a.bits) })
+
+	set.bloom = nil
+	if bloom {
+		set.addBloomFilter()
+	}
+	set.hasPending.Store(false)
+}
+
+// addBloomFilter builds the Bloom filter checked before searching each table.
+func (set *IndicatorSet) addBloomFilter() {
+	set.bloom = newBloomFilter(set.length)
+	for _, table := range set.tables {
+		for _, key := range table.keys {
+			set.bloom.add(table.bits, key)
+		}
+	}
+}
+
+// withBloomFilter returns a copy of the set sharing its tables, with a Bloom
+// filter added, and leaves the set itself unchanged.
+func (set *IndicatorSet) withBloomFilter() *IndicatorSet {
+	set.compactPending()
+	filtered := &IndicatorSet{
+		tables:     set.tables,
+		indicators: set.indicators,
+		length:     set.length,
+		domains:    set.domains,
+		expires:    set.expires,
+	}
+	filtered.addBloomFilter()
+	return filtered
+}
+
+// hasMetadata reports whether the indicator carries anything beyond its
+// prefix. Indicators without metadata are not stored.
+func (indicator *Indicator) hasMetadata() bool {
+	return indicator != nil && (indicator.Score != 0 || len(indicator.Categories) > 0 ||
+		len(indicator.Blacklists) > 0 || len(indicator.Tags) > 0 || len(indicator.ASNs) > 0 ||
+		!indicator.LastEvent.IsZero() || len(indicator.Ports) > 0)
+}
+
+func keyFromAddr(addr netip.Addr) prefixKey {
+	b := addr.As16()
+	return prefixKey{binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])}
+}
+
+// mask returns the key with all but the first bits set to zero.
+func (key prefixKey) mask(bits int) prefixKey {
+	if bits >= 64 {
+		return prefixKey{key.hi, key.lo & (math.MaxUint64 << (128 - bits))}
+	}
+	return prefixKey{key.hi & (math.MaxUint64 << (64 - bits)), 0}
+}
+
+// prefix converts a key of this table back into a prefix.
+func (table *prefixTable) prefix(key prefixKey) netip.Prefix {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], key.hi)
+	binary.BigEndian.PutUint64(b[8:], key.lo)
+	addr := netip.AddrFrom16(b)
+	if table.is4 {
+		return netip.PrefixFrom(addr.Unmap(), table.bits-96)
+	}
+	return netip.PrefixFrom(addr, table.bits)
+}
+
+// search returns the position of key in the table and whether it was found.
+func (table *prefixTable) search(key prefixKey) (int, bool) {
+	if table.index == nil {
+		return slices.BinarySearchFunc(table.keys, key, comparePrefixKeys)
+	}
+	b := table.bucket(key)
+	start, end := table.index[b], table.index[b+1]
+	i, found := slices.BinarySearchFunc(table.keys[start:end], key, comparePrefixKeys)
+	return int(start) + i, found
+}
+
+// bucket returns the leading 16 bits of the address in key.
+func (table *prefixTable) bucket(key prefixKey) int {
+	if table.is4 {
+		return int(key.lo>>16) & 0xffff
+	}
+	return int(key.hi >> 48)
+}
+
+func comparePrefixKeys(a, b prefixKey) int {
+	if c := cmp.Compare(a.hi, b.hi); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.lo, b.lo)
+}
+
+// A bloomFilter answers whether a prefix may be in the set without searching
+// its table. It is sized for a false positive rate of about 1%.
+type bloomFilter struct {
+	bits []uint64
+	k    int
+	seed maphash.Seed
+}
+
+func newBloomFilter(n int) *bloomFilter {
+	m := max(n*10, 64) // bits, ~1% false positives with k = 7
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), k: 7, seed: maphash.MakeSeed()}
+}
+
+func (filter *bloomFilter) hashes(bits int, key prefixKey) (uint64, uint64) {
+	var b [17]byte
+	binary.BigEndian.PutUint64(b[:8], key.hi)
+	binary.BigEndian.PutUint64(b[8:16], key.lo)
+	b[16] = byte(bits)
+	h := maphash.Bytes(filter.seed, b[:])
+	return h & math.MaxUint32, h>>32 | 1
+}
+
+func (filter *bloomFilter) add(bits int, key prefixKey) {
+	h1, h2 := filter.hashes(bits, key)
+	m := uint64(len(filter.bits) * 64)
+	for i := 0; i < filter.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (filter *bloomFilter) contains(bits int, key prefixKey) bool {
+	h1, h2 := filter.hashes(bits, key)
+	m := uint64(len(filter.bits) * 64)
+	for i := 0; i < filter.k; i++ {
+		bit := (h1 + uint64(i)*h2) % m
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
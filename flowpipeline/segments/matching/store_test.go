@@ -0,0 +1,168 @@
+package matching
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/bwNetFlow/ip_prefix_trie"
+)
+
+func TestIndicatorSet_lookup(t *testing.T) {
+	for _, bloom := range []bool{false, true} {
+		set := &IndicatorSet{}
+		set.Insert(netip.MustParsePrefix("0.0.0.0/0"), &Indicator{Prefix: "0.0.0.0/0"})
+		set.Insert(netip.MustParsePrefix("203.0.113.0/24"), &Indicator{Prefix: "203.0.113.0/24", Tags: []string{"first"}})
+		set.Insert(netip.MustParsePrefix("203.0.113.0/24"), &Indicator{Prefix: "203.0.113.0/24", Tags: []string{"second"}})
+		set.Insert(netip.MustParsePrefix("203.0.113.128/25"), &Indicator{Prefix: "203.0.113.128/25"})
+		set.Insert(netip.MustParsePrefix("2001:db8::/32"), &Indicator{Prefix: "2001:db8::/32"})
+		set.compact(bloom)
+
+		for addr, prefix := range map[string]string{
+			"203.0.113.1":   "203.0.113.0/24",
+			"203.0.113.200": "203.0.113.128/25",
+			"192.0.2.1":     "0.0.0.0/0",
+			"2001:db8::1":   "2001:db8::/32",
+			"2001:db9::1":   "", // IPv4 default route must not match IPv6
+		} {
+			if got := lookupPrefix(set, addr); got != prefix {
+				t.Errorf("[error] Bloom %t: got prefix '%s' for %s, should be '%s'.", bloom, got, addr, prefix)
+			}
+		}
+		if indicator := set.Lookup(net.ParseIP("203.0.113.1")); len(indicator.Tags) != 1 || indicator.Tags[0] != "second" {
+			t.Errorf("[error] Bloom %t: duplicate prefix did not replace the previous indicator: %+v", bloom, indicator)
+		}
+		if set.Len() != 4 {
+			t.Errorf("[error] Bloom %t: got %d prefixes, should be 4.", bloom, set.Len())
+		}
+		if set.Lookup(nil) != nil {
+			t.Errorf("[error] Bloom %t: nil address matched.", bloom)
+		}
+	}
+}
+
+// Concurrent first lookups must not race compacting the set, run with -race.
+func TestIndicatorSet_concurrentLookup(t *testing.T) {
+	set := &IndicatorSet{}
+	for _, prefix := range randomPrefixes(1000) {
+		set.Insert(prefix, &Indicator{Prefix: prefix.String()})
+	}
+	addr := net.ParseIP(set.pending[0].prefix.Addr().String())
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if set.Lookup(addr) == nil {
+				t.Error("[error] Concurrent lookup did not find an inserted prefix.")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// randomPrefixes returns n random IPv4 prefixes with lengths as commonly found
+// in aggregated blocklists, mostly single addresses.
+func randomPrefixes(n int) []netip.Prefix {
+	rng := rand.New(rand.NewSource(1))
+	lengths := []int{32, 32, 32, 32, 32, 32, 32, 24, 24, 16}
+	prefixes := make([]netip.Prefix, n)
+	for i := range prefixes {
+		addr := netip.AddrFrom4([4]byte{byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))})
+		prefixes[i] = netip.PrefixFrom(addr, lengths[rng.Intn(len(lengths))]).Masked()
+	}
+	return prefixes
+}
+
+// randomAddrs returns n addresses, about half of which are contained in one of
+// the prefixes.
+func randomAddrs(n int, prefixes []netip.Prefix) []net.IP {
+	rng := rand.New(rand.NewSource(2))
+	addrs := make([]net.IP, n)
+	for i := range addrs {
+		if i%2 == 0 {
+			addrs[i] = net.IP(prefixes[rng.Intn(len(prefixes))].Addr().AsSlice())
+		} else {
+			addrs[i] = net.IPv4(byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))).To4()
+		}
+	}
+	return addrs
+}
+
+// heapInUse returns the live heap size after a garbage collection.
+func heapInUse() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+// BenchmarkIndicatorSet compares lookups and memory use of the compact
+// IndicatorSet against the map of address strings used previously, which
+// only supports exact matches, and the prefix trie used before compaction.
+// Memory is reported as bytes/prefix.
+func BenchmarkIndicatorSet(b *testing.B) {
+	for _, n := range []int{100_000, 1_000_000} {
+		prefixes := randomPrefixes(n)
+		addrs := randomAddrs(1<<16, prefixes)
+
+		b.Run(fmt.Sprintf("compact/%d", n), func(b *testing.B) {
+			before := heapInUse()
+			set := &IndicatorSet{}
+			for _, prefix := range prefixes {
+				set.Insert(prefix, &Indicator{Prefix: prefix.String()})
+			}
+			set.compact(false)
+			bytes := float64(heapInUse()-before) / float64(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				set.Lookup(addrs[i%len(addrs)])
+			}
+			b.ReportMetric(bytes, "bytes/prefix")
+		})
+		b.Run(fmt.Sprintf("compact+bloom/%d", n), func(b *testing.B) {
+			before := heapInUse()
+			set := &IndicatorSet{}
+			for _, prefix := range prefixes {
+				set.Insert(prefix, &Indicator{Prefix: prefix.String()})
+			}
+			set.compact(true)
+			bytes := float64(heapInUse()-before) / float64(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				set.Lookup(addrs[i%len(addrs)])
+			}
+			b.ReportMetric(bytes, "bytes/prefix")
+		})
+		b.Run(fmt.Sprintf("map/%d", n), func(b *testing.B) {
+			before := heapInUse()
+			set := make(map[string]string)
+			for _, prefix := range prefixes {
+				set[prefix.Addr().String()] = "bad_ip"
+			}
+			bytes := float64(heapInUse()-before) / float64(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = set[addrs[i%len(addrs)].String()]
+			}
+			b.ReportMetric(bytes, "bytes/prefix")
+		})
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			before := heapInUse()
+			trie := &ip_prefix_trie.TrieNode{}
+			for _, prefix := range prefixes {
+				trie.Insert(&Indicator{Prefix: prefix.String()}, []string{prefix.String()})
+			}
+			bytes := float64(heapInUse()-before) / float64(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				trie.Lookup(addrs[i%len(addrs)])
+			}
+			b.ReportMetric(bytes, "bytes/prefix")
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package matching
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// Watchlist tags flows from or to autonomous systems or countries on a
+// watchlist, such as known bulletproof hosters. The AS numbers are taken from
+// the SrcAs and DstAs fields set by the aslookup segment or the exporter, the
+// countries from the fields set by the geolocation segment. Every entry has
+// its own tag ID and severity. Flows already tagged by a previous segment are
+// passed on unchanged.
+type Watchlist struct {
+	segments.BaseSegment
+	WatchlistPath  string        // required, the watchlist, see readWatchlist
+	Direction      string        // optional, default is "both", which sides to look up, one of "both", "remote", "inbound" or "outbound"
+	ReloadInterval time.Duration // optional, default is 1m, how often to check the watchlist for changes, 0 disables
+
+	watchlist *watchlist
+	modTime   time.Time
+	size      int64
+}
+
+// A watchlist holds the entries of a watchlist file by AS number and by
+// country code.
+type watchlist struct {
+	asns      map[uint32]*watchlistEntry
+	countries map[string]*watchlistEntry
+}
+
+type watchlistEntry struct {
+	text     string // the entry as written, e.g. "AS64496" or "RU"
+	tid      uint32
+	severity string
+	note     string
+}
+
+// Severities of watchlist entries, in increasing order.
+var severities = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// New implements segments.Segment.
+func (segment Watchlist) New(config map[string]string) segments.Segment {
+	newsegment := &Watchlist{
+		ReloadInterval: time.Minute,
+	}
+	if config["watchlist_path"] == "" {
+		log.Error().Msg("Watchlist: This segment requires a 'watchlist_path' parameter.")
+		return nil
+	}
+	newsegment.WatchlistPath = segments.ContainerVolumePrefix + config["watchlist_path"]
+	switch config["direction"] {
+	case "", "both":
+		newsegment.Direction = "both"
+	case "remote", "inbound", "outbound":
+		newsegment.Direction = config["direction"]
+	default:
+		log.Error().Msgf("Watchlist: Unknown direction '%s', must be one of 'both', 'remote', 'inbound' or 'outbound'.", config["direction"])
+		return nil
+	}
+	if config["reload_interval"] != "" {
+		reloadInterval, err := time.ParseDuration(config["reload_interval"])
+		if err != nil || reloadInterval < 0 {
+			log.Error().Msg("Watchlist: Could not parse 'reload_interval' parameter, must be a positive duration such as '30s' or 0.")
+			return nil
+		}
+		newsegment.ReloadInterval = reloadInterval
+	} else {
+		log.Info().Msg("Watchlist: 'reload_interval' set to default '1m'.")
+	}
+	if err := newsegment.reload(); err != nil {
+		log.Error().Err(err).Msgf("Watchlist: Could not read watchlist '%s': ", newsegment.WatchlistPath)
+		return nil
+	}
+	return newsegment
+}
+
+// Run implements segments.Segment.
+func (segment *Watchlist) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, ReloadSignal)
+	defer signal.Stop(sigs)
+	var tick <-chan time.Time
+	if segment.ReloadInterval > 0 {
+		ticker := time.NewTicker(segment.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if segment.changed() {
+				segment.reloadOrKeep()
+			}
+		case <-sigs:
+			segment.reloadOrKeep()
+		case msg, ok := <-segment.In:
+			if !ok {
+				return
+			}
+			if !msg.Inlist {
+				checkSrc, checkDst := sidesToCheck(segment.Direction, msg)
+				if entry, side := segment.watchlist.lookup(msg, checkSrc, checkDst); entry != nil {
+					TagWithID(msg, entry.tid, entry.note)
+					msg.MatchedPrefix = entry.text
+					msg.MatchedSide = side
+					msg.Severity = entry.severity
+				}
+			}
+			segment.Out <- msg
+		}
+	}
+}
+
+// changed reports whether the file looks different from the last time it was
+// read.
+func (segment *Watchlist) changed() bool {
+	info, err := os.Stat(segment.WatchlistPath)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Watchlist: Could not check %s for changes: ", segment.WatchlistPath)
+		return false
+	}
+	return !info.ModTime().Equal(segment.modTime) || info.Size() != segment.size
+}
+
+func (segment *Watchlist) reloadOrKeep() {
+	if err := segment.reload(); err != nil {
+		log.Error().Err(err).Msgf("Watchlist: Failed reloading %s, keeping the previous version: ", segment.WatchlistPath)
+	}
+}
+
+// reload reads the watchlist file. A file which fails to read is not retried
+// until it changes again.
+func (segment *Watchlist) reload() error {
+	info, err := os.Stat(segment.WatchlistPath)
+	if err != nil {
+		return err
+	}
+	segment.modTime, segment.size = info.ModTime(), info.Size()
+	file, err := os.Open(segment.WatchlistPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	watchlist, err := readWatchlist(file)
+	if err != nil {
+		return err
+	}
+	segment.watchlist = watchlist
+	log.Info().Msgf("Watchlist: Loaded %d autonomous systems and %d countries from %s.", len(watchlist.asns), len(watchlist.countries), segment.WatchlistPath)
+	return nil
+}
+
+// readWatchlist reads one entry per line, empty lines and everything
+// following a '#' are ignored. Each entry consists of an AS number such as
+// 'AS64496' or a two letter country code such as 'RU', the tag ID and the
+// severity, one of 'low', 'medium', 'high' or 'critical', optionally followed
+// by a note, e.g.:
+//
+//	AS64496 65020 high bulletproof_hoster
+//	RU      65021 low
+func readWatchlist(r io.Reader) (*watchlist, error) {
+	watchlist := &watchlist{
+		asns:      make(map[uint32]*watchlistEntry),
+		countries: make(map[string]*watchlistEntry),
+	}
+	scanner := bufio.NewScanner(r)
+	var lineno int
+	for scanner.Scan() {
+		lineno += 1
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected an AS number or country, a tag ID and a severity", lineno)
+		}
+		tid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil || tid == 0 {
+			return nil, fmt.Errorf("line %d: invalid tag ID '%s'", lineno, fields[1])
+		}
+		entry := &watchlistEntry{tid: uint32(tid), severity: strings.ToLower(fields[2]), note: "watchlist"}
+		if _, ok := severities[entry.severity]; !ok {
+			return nil, fmt.Errorf("line %d: invalid severity '%s', must be one of 'low', 'medium', 'high' or 'critical'", lineno, fields[2])
+		}
+		if len(fields) > 3 {
+			entry.note = strings.Join(fields[3:], " ")
+		}
+
+		if number, isASN := strings.CutPrefix(strings.ToUpper(fields[0]), "AS"); isASN && number != "" {
+			asn, err := strconv.ParseUint(number, 10, 32)
+			if err != nil || asn == 0 {
+				return nil, fmt.Errorf("line %d: invalid AS number '%s'", lineno, fields[0])
+			}
+			entry.text = "AS" + number
+			watchlist.asns[uint32(asn)] = entry
+		} else if country := strings.ToUpper(fields[0]); len(country) == 2 && country[0] >= 'A' && country[0] <= 'Z' && country[1] >= 'A' && country[1] <= 'Z' {
+			entry.text = country
+			watchlist.countries[country] = entry
+		} else {
+			return nil, fmt.Errorf("line %d: '%s' is neither an AS number nor a country code", lineno, fields[0])
+		}
+	}
+	return watchlist, scanner.Err()
+}
+
+// lookup returns the entry with the highest severity matching the AS numbers
+// or countries of the sides to check, preferring the source on ties, and which
+// sides matched any entry.
+func (watchlist *watchlist) lookup(msg *pb.EnrichedFlow, checkSrc bool, checkDst bool) (*watchlistEntry, pb.EnrichedFlow_MatchedSideType) {
+	srcCountry, dstCountry := flowCountries(msg)
+	var srcEntry, dstEntry *watchlistEntry
+	if checkSrc {
+		srcEntry = mostSevere(watchlist.asns[msg.GetSrcAs()], watchlist.countries[srcCountry])
+	}
+	if checkDst {
+		dstEntry = mostSevere(watchlist.asns[msg.GetDstAs()], watchlist.countries[dstCountry])
+	}
+	switch {
+	case srcEntry != nil && dstEntry != nil:
+		return mostSevere(srcEntry, dstEntry), pb.EnrichedFlow_MatchedBoth
+	case srcEntry != nil:
+		return srcEntry, pb.EnrichedFlow_MatchedSrc
+	case dstEntry != nil:
+		return dstEntry, pb.EnrichedFlow_MatchedDst
+	}
+	return nil, pb.EnrichedFlow_NotMatched
+}
+
+// mostSevere returns the entry with the higher severity, a on ties.
+func mostSevere(a *watchlistEntry, b *watchlistEntry) *watchlistEntry {
+	if a == nil || (b != nil && severities[b.severity] > severities[a.severity]) {
+		return b
+	}
+	return a
+}
+
+// flowCountries returns the country codes of source and destination. If the
+// geolocation segment only set RemoteCountry, it is used for the remote side.
+func flowCountries(msg *pb.EnrichedFlow) (string, string) {
+	src, dst := msg.GetSrcCountry(), msg.GetDstCountry()
+	if src == "" && dst == "" && msg.GetRemoteCountry() != "" {
+		switch msg.GetRemoteAddr() {
+		case pb.EnrichedFlow_Src:
+			src = msg.GetRemoteCountry()
+		case pb.EnrichedFlow_Dst:
+			dst = msg.GetRemoteCountry()
+		}
+	}
+	return strings.ToUpper(src), strings.ToUpper(dst)
+}
+
+func init() {
+	segment := &Watchlist{}
+	segments.RegisterSegment("watchlist", segment)
+}
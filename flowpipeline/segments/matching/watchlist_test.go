@@ -0,0 +1,130 @@
+package matching
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+const testWatchlist = `# test watchlist
+AS64496 65020 high bulletproof hoster
+as64497 65021 low
+RU      65022 medium
+`
+
+func writeTestWatchlist(t testing.TB, content string) string {
+	path := filepath.Join(t.TempDir(), "watchlist.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadWatchlist(t *testing.T) {
+	watchlist, err := readWatchlist(strings.NewReader(testWatchlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := watchlist.asns[64496]; entry == nil || entry.tid != 65020 || entry.severity != "high" || entry.note != "bulletproof hoster" || entry.text != "AS64496" {
+		t.Errorf("[error] Read unexpected AS entry %+v.", entry)
+	}
+	if entry := watchlist.asns[64497]; entry == nil || entry.note != "watchlist" {
+		t.Errorf("[error] Read unexpected AS entry without note %+v.", entry)
+	}
+	if entry := watchlist.countries["RU"]; entry == nil || entry.severity != "medium" {
+		t.Errorf("[error] Read unexpected country entry %+v.", entry)
+	}
+	for _, invalid := range []string{"AS64496 65020", "AS64496 0 high", "AS64496 65020 severe", "ASX 65020 high", "RUS 65020 high", "64496 65020 high"} {
+		if _, err := readWatchlist(strings.NewReader(invalid)); err == nil {
+			t.Errorf("[error] Accepted invalid watchlist entry '%s'.", invalid)
+		}
+	}
+}
+
+// Watchlist Segment test, flows are tagged by AS number and country
+func TestSegment_Watchlist_match(t *testing.T) {
+	config := map[string]string{"watchlist_path": writeTestWatchlist(t, testWatchlist)}
+	for _, test := range []struct {
+		flow     *pb.EnrichedFlow
+		tid      uint32
+		severity string
+		entry    string
+		side     pb.EnrichedFlow_MatchedSideType
+	}{
+		{&pb.EnrichedFlow{SrcAs: 64496, DstAs: 553}, 65020, "high", "AS64496", pb.EnrichedFlow_MatchedSrc},
+		{&pb.EnrichedFlow{SrcAs: 553, DstCountry: "ru"}, 65022, "medium", "RU", pb.EnrichedFlow_MatchedDst},
+		{&pb.EnrichedFlow{SrcAs: 64497, DstCountry: "RU"}, 65022, "medium", "RU", pb.EnrichedFlow_MatchedBoth},
+		{&pb.EnrichedFlow{DstAs: 64496, SrcCountry: "RU"}, 65020, "high", "AS64496", pb.EnrichedFlow_MatchedBoth},
+		{&pb.EnrichedFlow{RemoteCountry: "RU", RemoteAddr: pb.EnrichedFlow_Src}, 65022, "medium", "RU", pb.EnrichedFlow_MatchedSrc},
+		{&pb.EnrichedFlow{SrcAs: 553, DstCountry: "DE"}, 0, "", "", pb.EnrichedFlow_NotMatched},
+	} {
+		result := segments.TestSegment("watchlist", config, test.flow)
+		if result.Tid != test.tid || result.Severity != test.severity || result.MatchedPrefix != test.entry || result.MatchedSide != test.side || result.Inlist != (test.tid != 0) {
+			t.Errorf("[error] Segment Watchlist reports tid %d severity '%s' entry '%s' side %s, should be %d '%s' '%s' %s.",
+				result.Tid, result.Severity, result.MatchedPrefix, result.MatchedSide, test.tid, test.severity, test.entry, test.side)
+		}
+	}
+	result := segments.TestSegment("watchlist", config, &pb.EnrichedFlow{SrcAs: 64496, Tid: 65001, Inlist: true, Note: "bad_ip"})
+	if result.Tid != 65001 || result.Severity != "" {
+		t.Error("[error] Segment Watchlist is changing flows tagged by a previous segment.")
+	}
+	result = segments.TestSegment("watchlist", map[string]string{"watchlist_path": config["watchlist_path"], "direction": "outbound"},
+		&pb.EnrichedFlow{SrcAs: 64496})
+	if result.Inlist {
+		t.Error("[error] Segment Watchlist is not respecting 'direction'.")
+	}
+}
+
+// Watchlist Segment test, invalid configurations are rejected
+func TestSegment_Watchlist_invalid(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{"watchlist_path": "does-not-exist.txt"},
+		{"watchlist_path": writeTestWatchlist(t, "AS1 1 bad\n")},
+		{"watchlist_path": writeTestWatchlist(t, testWatchlist), "direction": "sideways"},
+	} {
+		if segment := (Watchlist{}).New(config); segment != nil {
+			t.Errorf("[error] Segment Watchlist accepts invalid config %v.", config)
+		}
+	}
+}
+
+// Watchlist Segment test, changes are picked up while running
+func TestSegment_Watchlist_reload(t *testing.T) {
+	path := writeTestWatchlist(t, testWatchlist)
+	segment := Watchlist{}.New(map[string]string{"watchlist_path": path, "reload_interval": "10ms"})
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	defer func() {
+		close(in)
+		wg.Wait()
+	}()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("AS553 65030 critical\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		in <- &pb.EnrichedFlow{SrcAs: 553}
+		if result := <-out; result.Tid == 65030 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("[error] Segment Watchlist did not reload the changed watchlist.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/admin"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/BelWue/flowpipeline/segments/analysis/toptalkers_metrics"
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,7 +21,7 @@ type DelayMonitoring struct {
 
 	SamplingRate int     // flow samplingrate fpr calculating delay - default 100
 	Alpha        float64 // alpha used for the exponential window moving average?
-	Endpoint     string  // optional, default value is ":8080"
+	Endpoint     string  // optional, default value is ":8080", or "/monitoring" on the admin server if it is enabled
 
 	msgCounter                   int
 	movingAverageProcessingDelay float64
@@ -46,7 +47,7 @@ func (segment DelayMonitoring) New(config map[string]string) segments.Segment {
 			"Exponential window moving average delay between flow received and processing time",
 			[]string{}, nil,
 		),
-		Endpoint:     ":8080",
+		Endpoint:     admin.DefaultEndpoint("/monitoring"),
 		SamplingRate: 1000,
 		Alpha:        0.2,
 	}
@@ -77,15 +78,16 @@ func (segment DelayMonitoring) New(config map[string]string) segments.Segment {
 }
 
 func (segment *DelayMonitoring) Run(wg *sync.WaitGroup) {
-	defer func() {
-		close(segment.Out)
-		wg.Done()
-	}()
 	var promExporter = PrometheusExporter{}
 	promExporter.Initialize()
 	promExporter.DelayReg.MustRegister(segment)
 	//start timers
-	promExporter.ServeEndpoints(segment.Endpoint)
+	stopServing := promExporter.ServeEndpoints(segment.Endpoint)
+	defer func() {
+		stopServing()
+		close(segment.Out)
+		wg.Done()
+	}()
 
 	log.Info().Msgf("Delay Monitoring: Prometheus running on %s", segment.Endpoint)
 	for msg := range segment.In {
@@ -159,8 +161,10 @@ func (e *PrometheusExporter) Initialize() {
 	e.MetaReg.MustRegister(e.dbSize)
 }
 
-// listen on given endpoint addr with Handler for metricPath and flowdataPath
-func (e *PrometheusExporter) ServeEndpoints(endpoint string) {
+// serve Handlers for /metrics and /delay on the given endpoint, see
+// admin.ServeSegment, the returned function has to be called when the segment
+// stops
+func (e *PrometheusExporter) ServeEndpoints(endpoint string) func() {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(e.MetaReg, promhttp.HandlerOpts{}))
 	mux.Handle("/delay", promhttp.HandlerFor(e.DelayReg, promhttp.HandlerOpts{}))
@@ -169,18 +173,18 @@ func (e *PrometheusExporter) ServeEndpoints(endpoint string) {
 			<head><title>Delay Indicator</title></head>
 			<body>
 			<h1>Delay Indicator</h1>
-			<p><a href="/metrics">Metrics</p>
-			<p><a href="/delay">Delay Measurements</p>
+			<p><a href="./metrics">Metrics</p>
+			<p><a href="./delay">Delay Measurements</p>
 			</body>
 		</html>`))
 	})
-	go func() {
-		err := http.ListenAndServe(endpoint, mux)
-		if err != nil {
-			log.Error().Err(err).Msgf("Delay Monitoring: Failed to start https endpoint on port %s", endpoint)
-		}
-	}()
+	stop, err := admin.ServeSegment(endpoint, mux)
+	if err != nil {
+		log.Error().Err(err).Msgf("Delay Monitoring: Failed to start https endpoint on port %s", endpoint)
+		return func() {}
+	}
 	log.Info().Msgf("Delay Monitoring: Enabled delay metrics on /metrics and /delay, listening at %s.", endpoint)
+	return stop
 }
 
 func init() {
@@ -2,6 +2,8 @@
 package dropfields
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"regexp"
 	"strings"
@@ -31,6 +33,10 @@ type DropFields struct {
 }
 
 func (segment *DropFields) New(config map[string]string) segments.Segment {
+	return segments.NewFromConstructor("DropFields", segment, config)
+}
+
+func (segment *DropFields) Construct(config map[string]string) (segments.Segment, error) {
 	var (
 		policy Policy
 		fields []string
@@ -43,7 +49,7 @@ func (segment *DropFields) New(config map[string]string) segments.Segment {
 	case "drop":
 		policy = PolicyDrop
 	default:
-		log.Fatal().Msg("DropFields: The 'policy' parameter is required to be either 'keep' or 'drop'.")
+		return nil, errors.New("the 'policy' parameter is required to be either 'keep' or 'drop'")
 	}
 
 	// parse fields
@@ -51,11 +57,19 @@ func (segment *DropFields) New(config map[string]string) segments.Segment {
 	if len(fields) == 0 {
 		log.Warn().Msg("DropFields: The 'fields' parameter can not be empty.")
 	}
+	if policy == PolicyKeep {
+		flowType := reflect.TypeOf((*pb.EnrichedFlow)(nil)).Elem()
+		for _, fieldName := range fields {
+			if field, ok := flowType.FieldByName(fieldName); !ok || !field.IsExported() {
+				return nil, fmt.Errorf("field '%s' is not valid or can not be set", fieldName)
+			}
+		}
+	}
 
 	return &DropFields{
 		Policy: policy,
 		Fields: fields,
-	}
+	}, nil
 }
 
 func (segment *DropFields) Run(wg *sync.WaitGroup) {
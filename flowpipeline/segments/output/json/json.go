@@ -4,9 +4,11 @@ package json
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog/log"
@@ -17,24 +19,40 @@ import (
 
 type Json struct {
 	segments.BaseSegment
-	writer *bufio.Writer
+	writer  *bufio.Writer
+	closers []io.Closer // the zstd encoder and file, if any, closed in this order after flushing writer
+	started *atomic.Bool
+	lost    *segments.LostFlows
 
 	FileName string // optional, default is empty which means stdout
 	Pretty   bool   // optional, default is false
+	Append   bool   // optional, default is false, which truncates an existing file
 }
 
 func (segment Json) New(config map[string]string) segments.Segment {
-	newsegment := &Json{}
+	return segments.NewFromConstructor("Json", segment, config)
+}
+
+func (segment Json) Construct(config map[string]string) (segments.Segment, error) {
+	newsegment := &Json{started: &atomic.Bool{}, lost: &segments.LostFlows{}}
 
+	appendFile, err := parseAppend(config)
+	if err != nil {
+		return nil, err
+	}
 	var filename string = "stdout"
 	var file *os.File
-	var err error
 	if config["filename"] != "" {
-		file, err = os.Create(config["filename"])
+		if appendFile {
+			file, err = os.OpenFile(config["filename"], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+		} else {
+			file, err = os.Create(config["filename"])
+		}
 		if err != nil {
-			log.Error().Err(err).Msg("Json: File specified in 'filename' is not accessible: ")
+			return nil, fmt.Errorf("file specified in 'filename' is not accessible: %w", err)
 		}
 		filename = config["filename"]
+		newsegment.closers = append(newsegment.closers, file)
 	} else {
 		file = os.Stdout
 		log.Info().Msg("Json: 'filename' unset, using stdout.")
@@ -51,9 +69,10 @@ func (segment Json) New(config map[string]string) segments.Segment {
 		}
 		encoder, err := zstd.NewWriter(file, zstd.WithEncoderLevel(level))
 		if err != nil {
-			log.Fatal().Err(err).Msg("Json: error creating zstd encoder: ")
+			return nil, fmt.Errorf("error creating zstd encoder: %w", err)
 		}
 		newsegment.writer = bufio.NewWriter(encoder)
+		newsegment.closers = append([]io.Closer{encoder}, newsegment.closers...)
 	} else {
 		// no compression
 		newsegment.writer = bufio.NewWriter(file)
@@ -72,13 +91,40 @@ func (segment Json) New(config map[string]string) segments.Segment {
 
 	newsegment.FileName = filename
 	newsegment.Pretty = pretty
+	newsegment.Append = appendFile
+
+	return newsegment, nil
+}
 
-	return newsegment
+// Checks a config without creating or truncating the file, see
+// segments.Checker.
+func (segment Json) Check(config map[string]string) error {
+	if _, err := parseAppend(config); err != nil {
+		return err
+	}
+	if config["filename"] != "" {
+		if err := segments.CheckWritableFile(config["filename"]); err != nil {
+			return fmt.Errorf("file specified in 'filename' is not accessible: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseAppend(config map[string]string) (bool, error) {
+	if config["append"] == "" {
+		return false, nil
+	}
+	appendFile, err := strconv.ParseBool(config["append"])
+	if err != nil {
+		return false, fmt.Errorf("could not parse 'append' parameter, must be a boolean")
+	}
+	return appendFile, nil
 }
 
 func (segment *Json) Run(wg *sync.WaitGroup) {
+	segment.started.Store(true)
 	defer func() {
-		_ = segment.writer.Flush()
+		segment.close()
 		close(segment.Out)
 		wg.Done()
 	}()
@@ -95,15 +141,48 @@ func (segment *Json) Run(wg *sync.WaitGroup) {
 		_, err = fmt.Fprintln(segment.writer, string(data))
 		if err != nil {
 			log.Warn().Err(err).Msgf("Json: Skipping a flow, failed to write to file %s", segment.FileName)
+			segment.lost.Add(1, err)
 			continue
 		}
 		// we need to flush here every time because we need full lines and can not wait
 		// in case of using this output as in input for other instances consuming flow data
-		_ = segment.writer.Flush()
+		if err := segment.writer.Flush(); err != nil {
+			segment.lost.Add(1, err)
+		}
 		segment.Out <- msg
 	}
 }
 
+// Close implements segments.Segment. It closes the file of a segment which has
+// been constructed but is never run, such as when a reload fails.
+func (segment *Json) Close() {
+	if !segment.started.Swap(true) {
+		segment.close()
+	}
+}
+
+// Flushes the writer and closes the zstd encoder, which writes the end of the
+// compressed stream, and the file.
+func (segment *Json) close() {
+	if err := segment.writer.Flush(); err != nil {
+		segment.lost.Add(0, err)
+	}
+	for _, closer := range segment.closers {
+		if err := closer.Close(); err != nil {
+			log.Error().Err(err).Msgf("Json: Failed to close %s", segment.FileName)
+			segment.lost.Add(0, err)
+		}
+	}
+}
+
+// Reports flows which could not be written, see segments.WritingSegment.
+func (segment *Json) WriteError() error {
+	if err := segment.lost.Err(); err != nil {
+		return fmt.Errorf("json %s: %w", segment.FileName, err)
+	}
+	return nil
+}
+
 func init() {
 	segment := &Json{}
 	segments.RegisterSegment("json", segment)
@@ -1,10 +1,15 @@
 package json
 
 import (
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/rs/zerolog"
@@ -19,6 +24,58 @@ func TestSegment_Json_passthrough(t *testing.T) {
 	}
 }
 
+// Json Segment test, the zstd stream is complete once the segment stopped
+func TestSegment_Json_zstd(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flows.json.zst")
+	segments.TestSegment("json", map[string]string{"filename": filename, "zstd": "3"},
+		&pb.EnrichedFlow{Bytes: 42})
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	data, err := io.ReadAll(decoder)
+	if err != nil || !strings.Contains(string(data), `"bytes":"42"`) {
+		t.Errorf("[error] Segment Json wrote an incomplete zstd stream: %q, %v", data, err)
+	}
+}
+
+// Json Segment test, existing files are appended to and closed if the segment
+// never runs
+func TestSegment_Json_append(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flows.json")
+	if err := os.WriteFile(filename, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	segment, err := Json{}.Construct(map[string]string{"filename": filename, "append": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment.Close()
+	segments.TestSegment("json", map[string]string{"filename": filename, "append": "true"},
+		&pb.EnrichedFlow{Bytes: 42})
+	data, err := os.ReadFile(filename)
+	if err != nil || !strings.HasPrefix(string(data), "{}\n") || !strings.Contains(string(data), `"bytes":"42"`) {
+		t.Errorf("[error] Segment Json did not append to the existing file: %q, %v", data, err)
+	}
+
+	segments.TestSegment("json", map[string]string{"filename": filename},
+		&pb.EnrichedFlow{Bytes: 43})
+	data, err = os.ReadFile(filename)
+	if err != nil || strings.HasPrefix(string(data), "{}\n") || strings.Contains(string(data), `"bytes":"42"`) {
+		t.Errorf("[error] Segment Json did not truncate the existing file without 'append': %q, %v", data, err)
+	}
+
+	if _, err := (Json{}).Construct(map[string]string{"filename": filename, "append": "maybe"}); err == nil {
+		t.Error("[error] Segment Json accepts an invalid 'append' parameter.")
+	}
+}
+
 // Json Segment benchmark passthrough
 func BenchmarkJson(b *testing.B) {
 	zerolog.SetGlobalLevel(zerolog.Disabled)
@@ -178,59 +178,115 @@ func (segment *KafkaProducer) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	producer, err := sarama.NewAsyncProducer(strings.Split(segment.Server, ","), segment.saramaConfig)
+	producer := segment.newProducer()
+	if producer == nil {
+		return
+	}
 
 	for msg := range segment.In {
+		// produce before passing the flow on, as encoding it modifies it
+		ok := segment.produce(producer, msg)
 		segment.Out <- msg
-		var binary []byte
-		if segment.Legacy {
-			legacyFlow := msg.ConvertToLegacyEnrichedFlow()
-			if binary, err = proto.Marshal(legacyFlow); err != nil {
-				log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
-				continue
-			}
-		} else {
-			if msg != nil {
-				protoProducerMessage := pb.ProtoProducerMessage{}
-				msg.SyncMissingTimeStamps()
-				protoProducerMessage.EnrichedFlow = *msg
-				if binary, err = protoProducerMessage.MarshalBinary(); err != nil {
-					log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
-					continue
-				}
-			} else {
-				log.Error().Msgf("KafkaProducer: Empty message")
-				continue
+		if !ok {
+			segment.ShutdownParentPipeline()
+			return
+		}
+	}
+}
+
+// Like Run, but for pipelines using the batched transport, see
+// segments.BatchSegment.
+func (segment *KafkaProducer) RunBatch(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.BatchOut)
+		wg.Done()
+	}()
+
+	producer := segment.newProducer()
+	if producer == nil {
+		return
+	}
+
+	for batch := range segment.BatchIn {
+		// produce before passing the batch on, as encoding modifies the flows
+		ok := true
+		for _, msg := range batch {
+			if ok = segment.produce(producer, msg); !ok {
+				break
 			}
 		}
+		segment.BatchOut <- batch
+		if !ok {
+			segment.ShutdownParentPipeline()
+			return
+		}
+	}
+}
 
-		if segment.TopicSuffix == "" {
-			producer.Input() <- &sarama.ProducerMessage{
-				Topic: segment.Topic,
-				Value: sarama.ByteEncoder(binary),
+// Connects to the Kafka cluster, or logs the error, shuts down the pipeline and
+// returns nil if this fails.
+func (segment *KafkaProducer) newProducer() sarama.AsyncProducer {
+	producer, err := sarama.NewAsyncProducer(strings.Split(segment.Server, ","), segment.saramaConfig)
+	if err != nil {
+		log.Error().Err(err).Msgf("KafkaProducer: Error creating the producer for %s: ", segment.Server)
+		segment.ShutdownParentPipeline()
+		return nil
+	}
+	return producer
+}
+
+// Encodes a flow and hands it to the producer. Flows which cannot be encoded
+// are skipped, and false is returned if the segment cannot continue.
+func (segment *KafkaProducer) produce(producer sarama.AsyncProducer, msg *pb.EnrichedFlow) bool {
+	var binary []byte
+	var err error
+	if segment.Legacy {
+		legacyFlow := msg.ConvertToLegacyEnrichedFlow()
+		if binary, err = proto.Marshal(legacyFlow); err != nil {
+			log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
+			return true
+		}
+	} else {
+		if msg != nil {
+			protoProducerMessage := pb.ProtoProducerMessage{}
+			msg.SyncMissingTimeStamps()
+			protoProducerMessage.EnrichedFlow = *msg
+			if binary, err = protoProducerMessage.MarshalBinary(); err != nil {
+				log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
+				return true
 			}
 		} else {
-			fmsg := reflect.ValueOf(msg).Elem()
-			field := fmsg.FieldByName(segment.TopicSuffix)
-			var suffix string
-			switch field.Type().String() {
-			case "uint32": // this is because FormatUint is much faster than Sprint
-				suffix = strconv.FormatUint(uint64(field.Interface().(uint32)), 10)
-			case "uint64": // this is because FormatUint is much faster than Sprint
-				suffix = strconv.FormatUint(uint64(field.Interface().(uint64)), 10)
-			case "string": // this is because doing nothing is also much faster than Sprint
-				suffix = field.Interface().(string)
-			default:
-				log.Error().Msg("KafkaProducer: TopicSuffix must be of type uint or string.")
-				segment.ShutdownParentPipeline()
-				return
-			}
-			producer.Input() <- &sarama.ProducerMessage{
-				Topic: segment.Topic + "-" + suffix,
-				Value: sarama.ByteEncoder(binary),
-			}
+			log.Error().Msgf("KafkaProducer: Empty message")
+			return true
+		}
+	}
+
+	if segment.TopicSuffix == "" {
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic: segment.Topic,
+			Value: sarama.ByteEncoder(binary),
+		}
+	} else {
+		fmsg := reflect.ValueOf(msg).Elem()
+		field := fmsg.FieldByName(segment.TopicSuffix)
+		var suffix string
+		switch field.Type().String() {
+		case "uint32": // this is because FormatUint is much faster than Sprint
+			suffix = strconv.FormatUint(uint64(field.Interface().(uint32)), 10)
+		case "uint64": // this is because FormatUint is much faster than Sprint
+			suffix = strconv.FormatUint(uint64(field.Interface().(uint64)), 10)
+		case "string": // this is because doing nothing is also much faster than Sprint
+			suffix = field.Interface().(string)
+		default:
+			log.Error().Msg("KafkaProducer: TopicSuffix must be of type uint or string.")
+			return false
+		}
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic: segment.Topic + "-" + suffix,
+			Value: sarama.ByteEncoder(binary),
 		}
 	}
+	return true
 }
 
 func init() {
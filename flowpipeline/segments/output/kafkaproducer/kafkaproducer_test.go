@@ -1,7 +1,13 @@
 package kafkaproducer
 
 import (
+	"os"
+	"os/signal"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
 )
 
 func TestSegment_KafkaProducer_instanciation(t *testing.T) {
@@ -36,3 +42,30 @@ func TestSegment_KafkaProducer_instanciation(t *testing.T) {
 		t.Error("([error] Segment KafkaProducer did not initiate successfully.")
 	}
 }
+
+// KafkaProducer Segment test, an unreachable server stops the segment and
+// shuts down the pipeline instead of panicking
+func TestSegment_KafkaProducer_unreachable(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	for _, batched := range []bool{false, true} {
+		segment := KafkaProducer{}.New(map[string]string{"server": "127.0.0.1:1", "topic": "flows", "auth": "0"}).(*KafkaProducer)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		if batched {
+			segment.RewireBatch(make(chan []*pb.EnrichedFlow), make(chan []*pb.EnrichedFlow))
+			go segment.RunBatch(wg)
+		} else {
+			segment.Rewire(make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow))
+			go segment.Run(wg)
+		}
+		select {
+		case <-signals:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("[error] Segment KafkaProducer did not shut down the pipeline (batched: %t).", batched)
+		}
+		wg.Wait()
+	}
+}
@@ -107,11 +107,18 @@ func (c *resilientClient) Send(events []interface{}) {
 
 // SendNoRetry will try to send the given events to the server. If the connection fails, it will not retry.
 func (c *resilientClient) SendNoRetry(events []interface{}) (int, error) {
+	// connect on first send when no client exists
+	if c.sc == nil {
+		c.connect()
+	}
 	return c.sc.Send(events)
 }
 
 // Close will close the connection to the server.
 func (c *resilientClient) Close() {
+	if c.sc == nil {
+		return
+	}
 	err := c.sc.Close()
 	if err != nil {
 		log.Error().Err(err).Msgf("Lumberjack: Error closing connection to server %s", c.ServerName)
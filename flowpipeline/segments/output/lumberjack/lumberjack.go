@@ -2,6 +2,8 @@
 package lumberjack
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
 	"runtime"
 	"strconv"
@@ -40,6 +42,7 @@ type Lumberjack struct {
 	QueueStatusInterval time.Duration
 	ReconnectWait       time.Duration
 	LumberjackOut       chan *pb.EnrichedFlow
+	lost                *segments.LostFlows
 }
 
 func NoDebugPrintf(format string, v ...any) {}
@@ -48,6 +51,11 @@ func DoDebugPrintf(format string, v ...any) {
 }
 
 func (segment *Lumberjack) New(config map[string]string) segments.Segment {
+	return segments.NewFromConstructor("Lumberjack", segment, config)
+}
+
+func (segment *Lumberjack) Construct(config map[string]string) (segments.Segment, error) {
+	segment = &Lumberjack{} // do not configure the registered template
 	var (
 		err                error
 		buflen             int
@@ -61,10 +69,10 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	} else {
 		defaultCompression, err = strconv.Atoi(defaultCompressionString)
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse default compression level %s", defaultCompressionString)
+			return nil, fmt.Errorf("failed to parse default compression level %s: %w", defaultCompressionString, err)
 		}
 		if defaultCompression < 0 || defaultCompression > 9 {
-			log.Fatal().Msgf("Lumberjack: Default compression level %d is out of range", defaultCompression)
+			return nil, fmt.Errorf("default compression level %d is out of range", defaultCompression)
 		}
 	}
 
@@ -74,13 +82,13 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 		rawServerStrings[idx] = strings.TrimSpace(serverName)
 	}
 	if len(rawServerStrings) == 0 {
-		log.Fatal().Msg("Lumberjack: No servers specified in 'servers' config option.")
+		return nil, errors.New("no servers specified in 'servers' config option")
 	} else {
 		segment.Servers = make(map[string]ServerOptions)
 		for _, rawServerString := range rawServerStrings {
 			serverURL, err := url.Parse(rawServerString)
 			if err != nil {
-				log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse server URL %s", rawServerString)
+				return nil, fmt.Errorf("failed to parse server URL %s: %w", rawServerString, err)
 			}
 			urlQueryParams := serverURL.Query()
 
@@ -97,7 +105,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 				useTLS = true
 				verifyTLS = false
 			default:
-				log.Fatal().Msgf("Lumberjack: Unknown scheme %s in server URL %s", serverURL.Scheme, rawServerString)
+				return nil, fmt.Errorf("unknown scheme %s in server URL %s", serverURL.Scheme, rawServerString)
 			}
 
 			// parse compression level
@@ -110,10 +118,10 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 			} else {
 				compressionLevel, err = strconv.Atoi(compressionString)
 				if err != nil {
-					log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse compression level %s for host %s", compressionString, serverURL.Host)
+					return nil, fmt.Errorf("failed to parse compression level %s for host %s: %w", compressionString, serverURL.Host, err)
 				}
 				if compressionLevel < 0 || compressionLevel > 9 {
-					log.Fatal().Msgf("Lumberjack: Compression level %d out of range for host %s", compressionLevel, serverURL.Host)
+					return nil, fmt.Errorf("compression level %d out of range for host %s", compressionLevel, serverURL.Host)
 				}
 			}
 
@@ -126,7 +134,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 				numRoutines, err = strconv.Atoi(numRoutinesString)
 				switch {
 				case err != nil:
-					log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse count %s for host %s", numRoutinesString, serverURL.Host)
+					return nil, fmt.Errorf("failed to parse count %s for host %s: %w", numRoutinesString, serverURL.Host, err)
 				case numRoutines < 1:
 					log.Warn().Msgf("Lumberjack: count is smaller than 1, setting to 1")
 					numRoutines = 1
@@ -149,7 +157,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["batchsize"] != "" {
 		segment.BatchSize, err = strconv.Atoi(strings.ReplaceAll(config["batchsize"], "_", ""))
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse batchsize config option: ")
+			return nil, fmt.Errorf("failed to parse batchsize config option: %w", err)
 		}
 	}
 	if segment.BatchSize < 0 {
@@ -160,7 +168,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["batchtimeout"] != "" {
 		segment.BatchTimeout, err = time.ParseDuration(config["batchtimeout"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse timeout config option: ")
+			return nil, fmt.Errorf("failed to parse timeout config option: %w", err)
 		}
 	}
 
@@ -176,7 +184,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["batchdebug"] != "" {
 		batchDebug, err := strconv.ParseBool(config["batchdebug"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse batchdebug config option: ")
+			return nil, fmt.Errorf("failed to parse batchdebug config option: %w", err)
 		}
 		// set proper BatchDebugPrintf function
 		if batchDebug {
@@ -191,7 +199,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["reconnectwait"] != "" {
 		segment.ReconnectWait, err = time.ParseDuration(config["reconnectwait"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse reconnectwait config option: ")
+			return nil, fmt.Errorf("failed to parse reconnectwait config option: %w", err)
 		}
 	}
 
@@ -200,7 +208,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["queuestatusinterval"] != "" {
 		segment.QueueStatusInterval, err = time.ParseDuration(config["queuestatusinterval"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse queuestatussnterval config option: ")
+			return nil, fmt.Errorf("failed to parse queuestatusinterval config option: %w", err)
 		}
 	}
 
@@ -208,7 +216,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["queuesize"] != "" {
 		buflen, err = strconv.Atoi(strings.ReplaceAll(config["queuesize"], "_", ""))
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse queuesize config option: ")
+			return nil, fmt.Errorf("failed to parse queuesize config option: %w", err)
 		}
 	} else {
 		buflen = defaultQueueSize
@@ -219,7 +227,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	}
 	segment.LumberjackOut = make(chan *pb.EnrichedFlow, buflen)
 
-	return segment
+	return segment, nil
 }
 
 func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
@@ -244,11 +252,13 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 		}()
 	}
 
+	segment.lost = &segments.LostFlows{}
+
 	// run goroutine for each lumberjack server
 	for server, options := range segment.Servers {
-		writerWG.Add(1)
 		options := options
 		for i := 0; i < options.Parallism; i++ {
+			writerWG.Add(1)
 			go func(server string, numServer int) {
 				defer writerWG.Done()
 				// connect to lumberjack server
@@ -271,13 +281,16 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 						// exit on closed channel
 						if !isOpen {
 							// send local buffer
+							if idx == 0 {
+								return
+							}
 							count, err := client.SendNoRetry(flowInterface[:idx])
 							if err != nil {
 								log.Error().Err(err).Msgf("Lumberjack: Failed to send final flow batch upon exit to %s", server)
+								segment.lost.Add(idx-count, fmt.Errorf("sending final batch to %s: %w", server, err))
 							} else {
 								segment.BatchDebugPrintf("Lumberjack: %s Sent final batch (%d)", server, count)
 							}
-							wg.Done()
 							return
 						}
 
@@ -335,6 +348,15 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 	close(segment.LumberjackOut)
 }
 
+// Reports flows of final batches which could not be sent, see
+// segments.WritingSegment. Other batches are retried until they are sent.
+func (segment *Lumberjack) WriteError() error {
+	if err := segment.lost.Err(); err != nil {
+		return fmt.Errorf("lumberjack: %w", err)
+	}
+	return nil
+}
+
 // register segment
 func init() {
 	segment := &Lumberjack{}
@@ -32,6 +32,7 @@ type Mongodb struct {
 	fieldTypes     []string
 	fieldNames     []string
 	ringbufferSize int64
+	lost           *segments.LostFlows
 
 	databaseName   string // default flowdata
 	collectionName string // default ringbuffer
@@ -84,14 +85,29 @@ func (segment *Mongodb) Run(wg *sync.WaitGroup) {
 	segment.dbCollection = db.Collection(segment.collectionName)
 
 	defer client.Disconnect(ctx)
+	segment.lost = &segments.LostFlows{}
 	unsavedJson := make(chan []interface{})
 	messagesToSave := make(chan *pb.EnrichedFlow)
-	go segment.bulkInsert(ctx, unsavedJson)
+	inserted := make(chan struct{})
+	go func() {
+		segment.bulkInsert(ctx, unsavedJson)
+		close(inserted)
+	}()
 	go segment.prepareDataForBulkInsert(messagesToSave, unsavedJson)
 	for msg := range segment.In {
 		messagesToSave <- msg
 		segment.Out <- msg
 	}
+	close(messagesToSave)
+	<-inserted // insert the last batch before disconnecting
+}
+
+// Reports flows which could not be inserted, see segments.WritingSegment.
+func (segment *Mongodb) WriteError() error {
+	if err := segment.lost.Err(); err != nil {
+		return fmt.Errorf("mongodb %s.%s: %w", segment.databaseName, segment.collectionName, err)
+	}
+	return nil
 }
 
 func fillSegmentWithConfig(newsegment *Mongodb, config map[string]string) (*Mongodb, error) {
@@ -176,18 +192,19 @@ func fillSegmentWithConfig(newsegment *Mongodb, config map[string]string) (*Mong
 }
 
 func (segment Mongodb) prepareDataForBulkInsert(msgChan chan *pb.EnrichedFlow, unsavedJsonFlows chan []interface{}) {
-	unsavedFlowData := make([]interface{}, segment.BatchSize)
-	nrOfFlows := 0
+	unsavedFlowData := make([]interface{}, 0, segment.BatchSize)
 	for msg := range msgChan {
 		flowData := formatFlowToMongoDbJson(msg, segment)
-		unsavedFlowData[nrOfFlows] = flowData
-		nrOfFlows += 1
-		if nrOfFlows >= segment.BatchSize {
+		unsavedFlowData = append(unsavedFlowData, flowData)
+		if len(unsavedFlowData) >= segment.BatchSize {
 			unsavedJsonFlows <- unsavedFlowData
-			nrOfFlows = 0
+			unsavedFlowData = make([]interface{}, 0, segment.BatchSize) // the sent batch is still being inserted
 		}
 	}
-
+	if len(unsavedFlowData) > 0 {
+		unsavedJsonFlows <- unsavedFlowData
+	}
+	close(unsavedJsonFlows)
 }
 
 func (segment Mongodb) bulkInsert(ctx context.Context, unsavedJsonFlows chan []interface{}) {
@@ -195,9 +212,14 @@ func (segment Mongodb) bulkInsert(ctx context.Context, unsavedJsonFlows chan []i
 	// ("You cannot write to capped collections in transactions."
 	// https://www.mongodb.com/docs/manual/core/capped-collections/)
 	for unsavedFlows := range unsavedJsonFlows {
-		_, err := segment.dbCollection.InsertMany(ctx, unsavedFlows)
+		result, err := segment.dbCollection.InsertMany(ctx, unsavedFlows)
 		if err != nil {
 			log.Error().Err(err).Msg("MongoDB: Failed to insert to mongo db")
+			var inserted int
+			if result != nil {
+				inserted = len(result.InsertedIDs)
+			}
+			segment.lost.Add(len(unsavedFlows)-inserted, err)
 		}
 	}
 }
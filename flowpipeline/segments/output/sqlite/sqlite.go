@@ -30,6 +30,7 @@ type Sqlite struct {
 	fieldNames      []string
 	createStatement string
 	insertStatement string
+	lost            *segments.LostFlows
 
 	FileName  string // required
 	Fields    string // optional comma-separated list of fields to export, default is "", meaning all fields
@@ -126,13 +127,59 @@ func (segment *Sqlite) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
+	segment.open()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+	for msg := range segment.In {
+		unsaved = segment.save(append(unsaved, msg))
+		segment.Out <- msg
+	}
+	if err := segment.bulkInsert(unsaved); err != nil {
+		log.Error().Err(err).Msg("Sqlite: Failed bulk insert of the final batch")
+	}
+}
+
+// Like Run, but for pipelines using the batched transport, see
+// segments.BatchSegment.
+func (segment *Sqlite) RunBatch(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.BatchOut)
+		wg.Done()
+	}()
+	segment.open()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+	for batch := range segment.BatchIn {
+		unsaved = segment.save(append(unsaved, batch...))
+		segment.BatchOut <- batch
+	}
+	if err := segment.bulkInsert(unsaved); err != nil {
+		log.Error().Err(err).Msg("Sqlite: Failed bulk insert of the final batch")
+	}
+}
 
+// Inserts the unsaved flows once there are at least BatchSize of them, and
+// returns those still unsaved.
+func (segment *Sqlite) save(unsaved []*pb.EnrichedFlow) []*pb.EnrichedFlow {
+	if len(unsaved) < segment.BatchSize {
+		return unsaved
+	}
+	err := segment.bulkInsert(unsaved)
+	if err != nil {
+		log.Error().Err(err).Msg("Sqlite: Failed bulk insert")
+	}
+	return []*pb.EnrichedFlow{}
+}
+
+// Opens the database and creates the table if needed.
+func (segment *Sqlite) open() {
 	var err error
 	segment.db, err = sql.Open("sqlite3", segment.FileName)
 	if err != nil {
 		log.Panic().Err(err).Msgf("Sqlite: Failed opening DB \"%s\"", segment.FileName) // this has already been checked in New
 	}
-	defer segment.db.Close()
 
 	tx, err := segment.db.Begin()
 	if err != nil {
@@ -144,20 +191,15 @@ func (segment *Sqlite) Run(wg *sync.WaitGroup) {
 	}
 	tx.Commit()
 
-	var unsaved []*pb.EnrichedFlow
+	segment.lost = &segments.LostFlows{}
+}
 
-	for msg := range segment.In {
-		unsaved = append(unsaved, msg)
-		if len(unsaved) >= segment.BatchSize {
-			err := segment.bulkInsert(unsaved)
-			if err != nil {
-				log.Error().Err(err).Msg("Sqlite: Failed bluk insert")
-			}
-			unsaved = []*pb.EnrichedFlow{}
-		}
-		segment.Out <- msg
+// Reports flows which could not be inserted, see segments.WritingSegment.
+func (segment *Sqlite) WriteError() error {
+	if err := segment.lost.Err(); err != nil {
+		return fmt.Errorf("sqlite %s: %w", segment.FileName, err)
 	}
-	segment.bulkInsert(unsaved)
+	return nil
 }
 
 func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
@@ -166,8 +208,11 @@ func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
 	}
 	tx, err := segment.db.Begin()
 	if err != nil {
-		log.Error().Err(err).Msgf("Sqlite: Error starting transaction for current batch of %d flows", len(unsavedFlows))
+		segment.lost.Add(len(unsavedFlows), err)
+		return fmt.Errorf("error starting transaction for current batch of %d flows: %w", len(unsavedFlows), err)
 	}
+	var failed int
+	var insertErr error
 	for _, msg := range unsavedFlows {
 		valueArgs := make([]interface{}, 0, len(segment.fieldNames))
 		values := reflect.ValueOf(msg).Elem()
@@ -188,10 +233,20 @@ func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
 		}
 		_, err := tx.Exec(segment.insertStatement, valueArgs...)
 		if err != nil {
-			log.Error().Err(err).Msgf("Sqlite: Error inserting flow into transaction")
+			failed += 1
+			if insertErr == nil {
+				insertErr = err
+			}
 		}
 	}
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		segment.lost.Add(len(unsavedFlows), err)
+		return fmt.Errorf("error committing batch of %d flows: %w", len(unsavedFlows), err)
+	}
+	if failed > 0 {
+		segment.lost.Add(failed, insertErr)
+		return fmt.Errorf("error inserting %d of %d flows: %w", failed, len(unsavedFlows), insertErr)
+	}
 	return nil
 }
 
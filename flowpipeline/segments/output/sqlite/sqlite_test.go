@@ -4,7 +4,9 @@
 package sqlite
 
 import (
+	"database/sql"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -36,6 +38,35 @@ func TestSegment_Sqlite_passthrough(t *testing.T) {
 	wg.Wait()
 }
 
+// Sqlite Segment test, batches are inserted and passed on
+func TestSegment_Sqlite_batch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "batch.sqlite")
+	segment := Sqlite{}.New(map[string]string{"filename": filename, "batchsize": "2"}).(*Sqlite)
+
+	in, out := make(chan []*pb.EnrichedFlow), make(chan []*pb.EnrichedFlow)
+	segment.RewireBatch(in, out)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.RunBatch(wg)
+	in <- []*pb.EnrichedFlow{{Proto: 1}, {Proto: 2}, {Proto: 3}}
+	if result := <-out; len(result) != 3 {
+		t.Errorf("[error] Segment Sqlite passed on a batch of %d flows instead of 3.", len(result))
+	}
+	close(in)
+	wg.Wait()
+
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM flows").Scan(&count); err != nil || count != 3 {
+		t.Errorf("[error] Segment Sqlite inserted %d flows instead of 3: %v", count, err)
+	}
+}
+
 // Sqlite Segment benchmark with 1000 samples stored in memory
 func BenchmarkSqlite_1000(b *testing.B) {
 	zerolog.SetGlobalLevel(zerolog.Disabled)
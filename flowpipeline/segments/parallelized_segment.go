@@ -14,6 +14,7 @@ import (
 type ParallelizedSegment struct {
 	BaseFilterSegment
 	segments []Segment
+	outs     []chan *pb.EnrichedFlow // one per contained segment, as each of them closes its Out
 }
 
 func (segment *ParallelizedSegment) New(config map[string]string) Segment {
@@ -37,18 +38,34 @@ func (segment *ParallelizedSegment) SubscribeDrops(drop chan *pb.EnrichedFlow) {
 }
 
 func (segment *ParallelizedSegment) Run(wg *sync.WaitGroup) {
-	defer wg.Done()
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
 	segmentWg := sync.WaitGroup{}
-	for _, segment := range segment.segments {
+	mergeWg := sync.WaitGroup{}
+	for i, nestedSegment := range segment.segments {
 		segmentWg.Add(1)
-		go segment.Run(&segmentWg)
+		go nestedSegment.Run(&segmentWg)
+		mergeWg.Add(1)
+		go func(out <-chan *pb.EnrichedFlow) {
+			defer mergeWg.Done()
+			for msg := range out {
+				segment.Out <- msg
+			}
+		}(segment.outs[i])
 	}
 	segmentWg.Wait()
+	mergeWg.Wait()
 }
 
 func (segment *ParallelizedSegment) Rewire(in chan *pb.EnrichedFlow, out chan *pb.EnrichedFlow) {
-	for _, segment := range segment.segments {
-		segment.Rewire(in, out)
+	segment.In = in
+	segment.Out = out
+	segment.outs = make([]chan *pb.EnrichedFlow, len(segment.segments))
+	for i, nestedSegment := range segment.segments {
+		segment.outs[i] = make(chan *pb.EnrichedFlow)
+		nestedSegment.Rewire(in, segment.outs[i])
 	}
 }
 
@@ -56,6 +73,11 @@ func (segment *ParallelizedSegment) AddSegment(nestedSegment Segment) {
 	segment.segments = append(segment.segments, nestedSegment)
 }
 
+// Returns the contained segments, one per job.
+func (segment *ParallelizedSegment) Segments() []Segment {
+	return segment.segments
+}
+
 // ShutdownParentPipeline implements Segment.
 func (segment *ParallelizedSegment) ShutdownParentPipeline() {
 	for _, segment := range segment.segments {
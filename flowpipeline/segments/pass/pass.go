@@ -44,6 +44,20 @@ func (segment *Pass) Run(wg *sync.WaitGroup) {
 	}
 }
 
+// Optionally, Segments implement RunBatch to receive and emit flows in batches
+// in pipelines using the batched transport, see segments.BatchSegment. The
+// same rules as for Run apply, using BatchIn and BatchOut.
+func (segment *Pass) RunBatch(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.BatchOut)
+		wg.Done()
+	}()
+	for batch := range segment.BatchIn {
+		// Work with the flow messages here, the batch may be modified.
+		segment.BatchOut <- batch
+	}
+}
+
 // Every Segment needs an init() function of some form in its file to be
 // callable from config. An unregistered Segment will only be available using
 // the API.
@@ -34,6 +34,8 @@ type TopTalkers struct {
 	ThresholdBps   uint64 // optional, default is 0, only log talkers with an average bits per second rate higher than this value
 	ThresholdPps   uint64 // optional, default is 0, only log talkers with an average packets per second rate higher than this value
 	TopN           uint64 // optional, default is 10, sets the number of top talkers per report
+
+	database map[string]*Record
 }
 
 func (segment TopTalkers) New(config map[string]string) segments.Segment {
@@ -136,7 +138,10 @@ func (segment *TopTalkers) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
-	database := map[string]*Record{}
+	if segment.database == nil {
+		segment.database = map[string]*Record{}
+	}
+	database := segment.database
 
 	ticker := time.NewTicker(time.Duration(segment.ReportInterval) * time.Second)
 
@@ -199,6 +204,14 @@ func (segment *TopTalkers) Run(wg *sync.WaitGroup) {
 	}
 }
 
+// Continues with the records of a previous toptalkers segment with the same
+// window size after a config reload.
+func (segment *TopTalkers) InheritState(previous segments.Segment) {
+	if previous, ok := previous.(*TopTalkers); ok && previous.Window == segment.Window {
+		segment.database = previous.database
+	}
+}
+
 func init() {
 	segment := &TopTalkers{}
 	segments.RegisterSegment("toptalkers", segment)
@@ -5,6 +5,12 @@
 package segments
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"syscall"
 
@@ -34,15 +40,39 @@ func RegisterSegment(name string, s Segment) {
 // Used by the pipeline package to convert segment names in configuration to
 // actual Segment objects.
 func LookupSegment(name string) Segment {
-	lock.RLock()
-	segment, ok := registeredSegments[name]
-	lock.RUnlock()
+	segment, ok := FindSegment(name)
 	if !ok {
 		log.Fatal().Msgf("Segments: Could not find a segment named '%s'.", name)
 	}
 	return segment
 }
 
+// Like LookupSegment, but reports whether a segment named name is registered
+// instead of exiting if there is none.
+func FindSegment(name string) (Segment, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	segment, ok := registeredSegments[name]
+	return segment, ok
+}
+
+// Returns the name the type of a segment is registered under, or its type
+// name if there is none. Parallelized segments are named after their jobs.
+func SegmentName(segment Segment) string {
+	if parallelized, ok := segment.(*ParallelizedSegment); ok && len(parallelized.segments) > 0 {
+		segment = parallelized.segments[0]
+	}
+	segmentType := reflect.TypeOf(segment)
+	lock.RLock()
+	defer lock.RUnlock()
+	for name, template := range registeredSegments {
+		if reflect.TypeOf(template) == segmentType {
+			return name
+		}
+	}
+	return segmentType.String()
+}
+
 // Used by the tests to run single flow messages through a segment.
 func TestSegment(name string, config map[string]string, msg *pb.EnrichedFlow) *pb.EnrichedFlow {
 	segment := LookupSegment(name).New(config)
@@ -77,12 +107,149 @@ type Segment interface {
 	Close()
 }
 
+// Segments may implement this in addition to the Segment interface to return
+// configuration problems as an error instead of logging them and returning nil
+// from New. Their New method can use NewFromConstructor.
+type Constructor interface {
+	Construct(config map[string]string) (Segment, error) // like New, but never returns a nil Segment without an error
+}
+
+// Returned by Construct for segments not implementing Constructor whose New
+// method returned nil.
+var ErrNotInitialized = errors.New("segment could not be initialized, see previous log messages")
+
+// Instantiates a segment with the given config from the template registered
+// for it. This uses the Construct method of segments implementing
+// Constructor, and adapts the New method of all others.
+func Construct(template Segment, config map[string]string) (Segment, error) {
+	if constructor, ok := template.(Constructor); ok {
+		return constructor.Construct(config)
+	}
+	segment := template.New(config)
+	if segment == nil {
+		return nil, ErrNotInitialized
+	}
+	return segment, nil
+}
+
+// Implements the New method of a segment implementing Constructor by logging
+// any error, with the segment's name as prefix.
+func NewFromConstructor(name string, constructor Constructor, config map[string]string) Segment {
+	segment, err := constructor.Construct(config)
+	if err != nil {
+		log.Error().Err(err).Msgf("%s: Invalid configuration: ", name)
+		return nil
+	}
+	return segment
+}
+
+// Segments which truncate files or otherwise affect their surroundings when
+// constructed can implement this to validate a config without doing so. When
+// checking a config, Check is used instead of constructing such segments.
+type Checker interface {
+	Check(config map[string]string) error
+}
+
+// Checks whether a file could be opened for writing, without creating or
+// truncating it.
+func CheckWritableFile(filename string) error {
+	info, err := os.Stat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		info, err = os.Stat(filepath.Dir(filename))
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", filepath.Dir(filename))
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", filename)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Segments keeping state across flows, such as sliding windows, can implement
+// this to continue where the segment they replace left off when the pipeline
+// configuration is reloaded. InheritState is called before Run with a stopped
+// segment of the same type from the previous pipeline, and should ignore state
+// which does not fit its own configuration.
+type StatefulSegment interface {
+	InheritState(previous Segment)
+}
+
+// Segments may implement this in addition to the Segment interface to receive
+// and emit flows in batches if the pipeline uses the batched transport, which
+// saves a channel operation per flow. In pipelines exchanging single flows,
+// or if a segment does not implement this, Run is used instead.
+type BatchSegment interface {
+	RewireBatch(in chan []*pb.EnrichedFlow, out chan []*pb.EnrichedFlow) // embed this using BaseSegment
+	RunBatch(wg *sync.WaitGroup)                                         // goroutine, like Run, but must close(segment.BatchOut) when segment.BatchIn is closed
+}
+
+// Segments writing flows to files, databases or remote servers, often in
+// batches, can implement this to confirm whether all flows they received have
+// been written. WriteError is called after Run returned, i.e. after the
+// segment flushed anything it held back, for instance when shutting down.
+type WritingSegment interface {
+	WriteError() error // nil if all flows have been written
+}
+
+// Counts flows a WritingSegment failed to write and keeps the first error,
+// safe for concurrent use. The zero value is ready to use.
+type LostFlows struct {
+	lock  sync.Mutex
+	count int
+	err   error
+}
+
+// Records that count flows could not be written because of err. A count of 0
+// records an error which lost an unknown amount of data, such as a failure to
+// finalize a file.
+func (lost *LostFlows) Add(count int, err error) {
+	lost.lock.Lock()
+	defer lost.lock.Unlock()
+	lost.count += count
+	if lost.err == nil {
+		lost.err = err
+	}
+}
+
+// Returns an error describing the lost flows, or nil if there were none. This
+// can be called on nil, e.g. if the segment never ran.
+func (lost *LostFlows) Err() error {
+	if lost == nil {
+		return nil
+	}
+	lost.lock.Lock()
+	defer lost.lock.Unlock()
+	if lost.err == nil {
+		return nil
+	}
+	if lost.count == 0 {
+		return lost.err
+	}
+	return fmt.Errorf("%d flows not written: %w", lost.count, lost.err)
+}
+
 // Serves as a basis for any Segment implementations. Segments embedding this
 // type only need the New and the Run methods to be compliant to the Segment
 // interface.
 type BaseSegment struct {
 	In  <-chan *pb.EnrichedFlow
 	Out chan<- *pb.EnrichedFlow
+
+	// Used instead of In and Out by segments implementing BatchSegment in
+	// pipelines using the batched transport. A batch belongs to the segment
+	// receiving it, which may modify and pass on the same slice, and must not
+	// be touched after sending it.
+	BatchIn  <-chan []*pb.EnrichedFlow
+	BatchOut chan<- []*pb.EnrichedFlow
 }
 
 // This function rewires this Segment with the provided channels. This is
@@ -96,6 +263,13 @@ func (segment *BaseSegment) Rewire(in chan *pb.EnrichedFlow, out chan *pb.Enrich
 	segment.Out = out
 }
 
+// Like Rewire, but for segments implementing BatchSegment in pipelines using
+// the batched transport.
+func (segment *BaseSegment) RewireBatch(in chan []*pb.EnrichedFlow, out chan []*pb.EnrichedFlow) {
+	segment.BatchIn = in
+	segment.BatchOut = out
+}
+
 // This functions shutdown Parent Pipeline segments on the given syscall.
 // It is used for intended termination within pipeline function, e.g. end pipeline on read from file.
 func (segment *BaseSegment) ShutdownParentPipeline() {